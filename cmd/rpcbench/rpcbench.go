@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
@@ -12,7 +13,10 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
 	"github.com/codingpoeta/net-model-bench/pkg/datagen"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/codingpoeta/net-model-bench/pkg/net/gonet"
 	"github.com/codingpoeta/net-model-bench/pkg/net/gorpc"
 	"github.com/codingpoeta/net-model-bench/pkg/net/grpc"
 	"github.com/codingpoeta/net-model-bench/pkg/net/iorpc"
@@ -33,24 +37,46 @@ func cmdServer() *cli.Command {
 		Category: "category2",
 		Action: func(c *cli.Context) (err error) {
 			fmt.Println("start server...")
+			publishCodecs(c.Bool("codec-stats"))
 			var svr common.BlockServer
 			switch c.String("mode") {
 			case "grpc":
-				svr, err = grpc.NewServer(c.String("ip"), c.String("network"), datagen.NewMemData())
+				svr, err = grpc.NewServer(c.String("ip"), c.String("network"), memData(c))
 			case "gorpc":
-				svr, err = gorpc.NewServer(c.String("ip"), c.String("network"), datagen.NewMemData())
+				svr, err = gorpc.NewServer(c.String("ip"), c.String("network"), memData(c))
 			case "tcpsendfile":
-				svr, err = tcpsendfile.NewServer(c.String("ip"), c.String("network"), datagen.NewFileData("./data/"))
+				svr, err = tcpsendfile.NewServer(c.String("ip"), c.String("network"), fileData(c, "./data/"))
 			case "perf":
-				svr, err = perf.NewServer(c.String("ip"), c.String("network"), datagen.NewMemData())
+				svr, err = perf.NewServer(c.String("ip"), c.String("network"), memData(c))
 			case "jnet":
-				svr, err = jnet.NewServer(c.String("ip"), c.String("network"), datagen.NewMemData())
+				var js *jnet.Server
+				// The file modes send the bodies from files without a copy.
+				dg := memData(c)
+				if mode := os.Getenv("SERVER_MODE"); mode == "sendfile" || mode == "splice" {
+					dg = fileData(c, "./data/")
+				}
+				js, err = jnet.NewServerWithOptions(c.String("ip"), c.String("network"), dg, jnet.ServerOptions{
+					Batch: jnetBatchPolicy(c),
+				})
+				if err == nil {
+					svr = js
+					expvar.Publish("jnet_batches", expvar.Func(func() any {
+						recv, sent := js.BatchStats()
+						return map[string]jnet.BatchHistogram{"recv": recv, "sent": sent}
+					}))
+				}
 			case "iorpc":
-				svr, err = iorpc.NewServer(c.String("ip"), c.String("network"), datagen.NewFileData("./data/"))
+				if c.Bool("iouring") {
+					svr, err = iorpc.NewIOUringServer(c.String("ip"), c.String("network"), fileData(c, "./data/"))
+				} else {
+					svr, err = iorpc.NewServer(c.String("ip"), c.String("network"), fileData(c, "./data/"))
+				}
 			case "quic":
-				svr, err = quic.NewServer(c.String("ip"), c.String("network"), datagen.NewMemData())
+				svr, err = quic.NewServer(c.String("ip"), c.String("network"), memData(c))
+			case "gonet":
+				svr, err = gonet.NewServer(c.String("ip"), c.String("network"), memData(c))
 			default:
-				svr, err = tcppool.NewServer(c.String("ip"), c.String("network"), datagen.NewMemData())
+				svr, err = tcppool.NewServer(c.String("ip"), c.String("network"), memData(c))
 			}
 			if err != nil {
 				fmt.Println(err)
@@ -59,10 +85,10 @@ func cmdServer() *cli.Command {
 			defer svr.Close()
 			return svr.Serve()
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:  "ip",
-				Usage: "ip",
+				Usage: "ip, or unix://path and unix-abstract://name to listen to a unix socket",
 			},
 			&cli.StringFlag{
 				Name:  "network",
@@ -72,7 +98,19 @@ func cmdServer() *cli.Command {
 				Name:  "mode",
 				Usage: "mode",
 			},
-		},
+			&cli.BoolFlag{
+				Name:  "iouring",
+				Usage: "run iorpc connections over io_uring",
+			},
+			&cli.IntFlag{
+				Name:  "compressibility",
+				Usage: "percent the bodies compress by, random bytes with zeroed blocks; by default a pattern compressing to almost nothing",
+			},
+			&cli.BoolFlag{
+				Name:  "codec-stats",
+				Usage: "print the CPU time and the bytes saved of the codecs every second",
+			},
+		}, jnetBatchFlags()...),
 	}
 }
 
@@ -97,29 +135,83 @@ func cmdClient() *cli.Command {
 
 			fmt.Println("client")
 			var cli common.BlockClient
-			var err error
+			framing, err := frame.Parse(c.String("framing"))
+			if err != nil {
+				return err
+			}
+			// --codec overrides the LZ4 of --compress.
+			var spec codec.Spec
+			if c.Bool("compress") {
+				spec = codec.Spec{ID: codec.LZ4}
+			}
+			if c.IsSet("codec") {
+				if spec, err = codec.Parse(c.String("codec")); err != nil {
+					return err
+				}
+			}
+			publishCodecs(c.Bool("codec-stats"))
 			switch c.String("mode") {
 			case "grpc":
 				cli = grpc.NewClient(c.String("addr"), tpc, int(threads/tpc))
 			case "gorpc":
 				cli = gorpc.NewClient(c.String("addr"), threads)
 			case "jnet":
-				cli, err = jnet.NewClient(c.String("addr"), threads, c.Bool("compress"), c.Bool("crc"))
+				policy := jnet.RoundRobin
+				if c.String("balance") != "" {
+					if policy, err = jnet.ParseQueuePolicy(c.String("balance")); err != nil {
+						panic(err)
+					}
+				}
+				var jc *jnet.Client
+				jc, err = jnet.NewClientWithOptions(c.String("addr"), jnet.ClientOptions{
+					Conns:   threads,
+					Codec:   spec,
+					CrcOn:   c.Bool("crc"),
+					Framing: framing,
+					Queue:   policy,
+					Batch:   jnetBatchPolicy(c),
+				})
 				if err != nil {
 					panic(err)
 				}
+				cli = jc
+				expvar.Publish("jnet_batches", expvar.Func(func() any {
+					return jc.BatchStats()
+				}))
 			case "iorpc":
-				cli = iorpc.NewClient(c.String("addr"), int(threads/tpc))
+				cli, err = iorpc.NewClient(c.String("addr"), iorpc.ClientOptions{
+					Conns:          int(threads / tpc),
+					Balance:        c.String("balance"),
+					Retries:        c.Int("retries"),
+					AttemptTimeout: c.Duration("attempt-timeout"),
+					Hedge:          c.Bool("hedge"),
+					IOUring:        c.Bool("iouring"),
+				})
+				if err != nil {
+					panic(err)
+				}
 			case "tcpsendfile":
 				cli = tcpsendfile.NewClient(c.String("addr"), threads, datagen.NewMemData())
 			case "perf":
 				cli = perf.NewClient(c.String("addr"), threads)
 			case "quic":
 				cli = quic.NewClient(c.String("addr"), threads, c.Bool("compress"), c.Bool("crc"))
+				if qc, ok := cli.(*quic.Client); ok {
+					qc.Framing = framing
+					qc.Codec = spec
+				}
+			case "gonet":
+				gc := gonet.NewClient(c.String("addr"), threads, c.Bool("compress"), c.Bool("crc")).(*gonet.Client)
+				gc.Framing = framing
+				gc.Codec = spec
+				cli = gc
 			default:
-				cli = tcppool.NewClient(c.String("addr"), threads, c.Bool("compress"), c.Bool("crc"))
+				tc := tcppool.NewClient(c.String("addr"), threads, c.Bool("compress"), c.Bool("crc")).(*tcppool.Client)
+				tc.Framing = framing
+				tc.Codec = spec
+				cli = tc
 			}
-			cmd := uint8(c.Int("cmd"))
+			cmd := uint32(c.Int("cmd"))
 			defer cli.Close()
 			var wg sync.WaitGroup
 			var cnt atomic.Uint64
@@ -141,11 +233,9 @@ func cmdClient() *cli.Command {
 						// fmt.Println("data len:", res.tsz, "bodysize", len(res.body))
 						// cnt.Add(uint64(tsz))
 						cnt.Add(1)
-						sz.Add(uint64(len(res.Body)))
+						sz.Add(uint64(res.Len()))
 						lat.Add(uint64(time.Since(since)))
-						if res.BB != nil {
-							res.BB.Dec()
-						}
+						res.Release()
 					}
 				}(i)
 			}
@@ -186,10 +276,14 @@ func cmdClient() *cli.Command {
 
 			return nil
 		},
-		Flags: []cli.Flag{
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{
 				Name:  "addr",
-				Usage: "addr",
+				Usage: "addr, or unix://path and unix-abstract://name to connect to a unix socket",
+			},
+			&cli.StringFlag{
+				Name:  "balance",
+				Usage: "balance policy for comma-separated iorpc addrs: roundrobin, leastpending, p2c or hash; for the jnet queues: roundrobin, hash or cpu",
 			},
 			&cli.IntFlag{
 				Name:        "threads",
@@ -221,14 +315,119 @@ func cmdClient() *cli.Command {
 				Usage:   "compress",
 				Aliases: []string{"C"},
 			},
+			&cli.StringFlag{
+				Name:  "codec",
+				Usage: "response codec of tcppool, quic, gonet and jnet: none, lz4, snappy, zstd or zstd-<level>; other than lz4, and any for jnet, needs --framing v2",
+			},
 			&cli.BoolFlag{
 				Name:  "crc",
 				Usage: "crc",
 			},
+			&cli.BoolFlag{
+				Name:  "codec-stats",
+				Usage: "print the CPU time and the bytes saved of the codecs every second",
+			},
+			&cli.StringFlag{
+				Name:  "framing",
+				Usage: "wire format of tcppool, quic, gonet and jnet: v1, the format of the servers before v2, or v2 for the commands over 15, keys over 4 KiB, ranges, codecs, and the request IDs of tcppool and the checksummed batches of jnet",
+				Value: "v1",
+			},
+			&cli.IntFlag{
+				Name:  "retries",
+				Usage: "retries of failed iorpc reads",
+			},
+			&cli.DurationFlag{
+				Name:  "attempt-timeout",
+				Usage: "timeout of every iorpc read attempt, enables retries of timed out reads",
+			},
+			&cli.BoolFlag{
+				Name:  "hedge",
+				Usage: "hedge iorpc reads slower than the recent p95 latency",
+			},
+			&cli.BoolFlag{
+				Name:  "iouring",
+				Usage: "run iorpc connections over io_uring",
+			},
+		}, jnetBatchFlags()...),
+	}
+}
+
+// memData returns the memory data of the --compressibility flag.
+func memData(c *cli.Context) common.DataGen {
+	if c.IsSet("compressibility") {
+		return datagen.NewCompressibleMemData(c.Int("compressibility"))
+	}
+	return datagen.NewMemData()
+}
+
+// fileData returns the file data of the --compressibility flag.
+func fileData(c *cli.Context, basePath string) common.DataGen {
+	if c.IsSet("compressibility") {
+		return datagen.NewCompressibleFileData(basePath, c.Int("compressibility"))
+	}
+	return datagen.NewFileData(basePath)
+}
+
+// publishCodecs exports the work of the codecs as the codecs var at
+// /debug/vars. With print, it also prints what they did every second
+// they were used: the CPU time of the compressions against the bytes saved.
+func publishCodecs(print bool) {
+	expvar.Publish("codecs", expvar.Func(func() any {
+		rs := make(map[string]codec.Report)
+		for _, r := range codec.Reports() {
+			rs[r.Spec.String()] = r
+		}
+		return rs
+	}))
+	if !print {
+		return
+	}
+	go func() {
+		prev := make(map[codec.Spec]codec.Report)
+		for range time.Tick(time.Second) {
+			for _, r := range codec.Reports() {
+				d := r.Sub(prev[r.Spec])
+				prev[r.Spec] = r
+				if d.Compress.Calls+d.Decompress.Calls > 0 {
+					fmt.Println("codec", d)
+				}
+			}
+		}
+	}()
+}
+
+// jnetBatchFlags are the jnet batching flags of both the server and the client.
+// The batch histograms are exported as the jnet_batches var at /debug/vars.
+func jnetBatchFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "max-batch-count",
+			Usage: "max requests or responses of a jnet batch",
+		},
+		&cli.IntFlag{
+			Name:  "max-batch-bytes",
+			Usage: "max body bytes of a jnet batch",
+		},
+		&cli.DurationFlag{
+			Name:  "max-batch-delay",
+			Usage: "max time the first message of a jnet batch waits for the others, negative to not wait",
+		},
+		&cli.BoolFlag{
+			Name:  "adaptive-batch",
+			Usage: "stop waiting for a jnet batch once the next message is overdue by the arrival rate",
 		},
 	}
 }
 
+func jnetBatchPolicy(c *cli.Context) jnet.BatchPolicy {
+	return jnet.BatchPolicy{
+		MaxCount: c.Int("max-batch-count"),
+		MaxBytes: c.Int("max-batch-bytes"),
+		MaxDelay: c.Duration("max-batch-delay"),
+		Adaptive: c.Bool("adaptive-batch"),
+	}
+}
+
 func main() {
 	go func() {
 		for debugPort < 6100 {
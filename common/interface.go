@@ -25,4 +25,5 @@ const (
 	MODE_SENDBUF = iota
 	MODE_SENDFILE
 	MODE_SPLICE
+	MODE_ZEROCOPY
 )
@@ -2,6 +2,35 @@ package common
 
 type Request struct {
 	Batch int
-	CMD   uint8
+	CMD   uint32
 	Key   string
+
+	// Op is the operation on the key, OpGet by default.
+	Op Op
+	// Offset and Length select a range of the body, Length 0 is up
+	// to the end.
+	Offset uint64
+	Length uint64
+}
+
+// Op is the operation of a request.
+type Op uint8
+
+const (
+	OpGet Op = iota
+	OpPut
+	OpDelete
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "get"
+	case OpPut:
+		return "put"
+	case OpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
 }
@@ -1,6 +1,9 @@
 package common
 
-import "sync/atomic"
+import (
+	"net"
+	"sync/atomic"
+)
 
 type BodyBuffer struct {
 	Buf     []byte
@@ -19,9 +22,55 @@ func (bb *BodyBuffer) Dec() {
 	}
 }
 
+// BodySlice is a part of a body held by a reference to its BodyBuffer.
+type BodySlice struct {
+	Buf []byte
+	BB  *BodyBuffer
+}
+
 type Response struct {
 	Size   uint32
 	Body   []byte
 	CRCSum uint32
 	BB     *BodyBuffer
+
+	// Vec is the body scattered over several buffers without a copy,
+	// Body and BB are nil then.
+	Vec []BodySlice
+}
+
+// Len returns the length of the body, in Body or in Vec.
+func (r *Response) Len() int {
+	n := len(r.Body)
+	for _, s := range r.Vec {
+		n += len(s.Buf)
+	}
+	return n
+}
+
+// Buffers returns the body for a vectored write.
+func (r *Response) Buffers() net.Buffers {
+	if r.Vec == nil {
+		return net.Buffers{r.Body}
+	}
+	bufs := make(net.Buffers, len(r.Vec))
+	for i, s := range r.Vec {
+		bufs[i] = s.Buf
+	}
+	return bufs
+}
+
+// Release drops the references to the body buffers, the body must
+// not be used after.
+func (r *Response) Release() {
+	if r.BB != nil {
+		r.BB.Dec()
+		r.BB = nil
+	}
+	for _, s := range r.Vec {
+		if s.BB != nil {
+			s.BB.Dec()
+		}
+	}
+	r.Vec = nil
 }
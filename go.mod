@@ -1,8 +1,10 @@
 module github.com/codingpoeta/net-model-bench
 
 require (
+	github.com/golang/snappy v1.0.0
 	github.com/hanwen/go-fuse/v2 v2.1.1-0.20210611132105-24a1dfe6b4f8
 	github.com/juicedata/juicefs v1.1.2
+	github.com/klauspost/compress v1.13.4
 	github.com/panjf2000/gnet v1.6.7
 	github.com/pkg/errors v0.9.1
 	github.com/quic-go/quic-go v0.45.1
@@ -12,6 +14,7 @@ require (
 	github.com/valyala/bytebufferpool v1.0.0
 	github.com/valyala/gorpc v0.0.0-20160519171614-908281bef774
 	golang.org/x/sync v0.7.0
+	golang.org/x/sys v0.20.0
 	google.golang.org/grpc v1.64.0
 	google.golang.org/protobuf v1.34.1
 )
@@ -36,7 +39,6 @@ require (
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/mod v0.17.0 // indirect
 	golang.org/x/net v0.25.0 // indirect
-	golang.org/x/sys v0.20.0 // indirect
 	golang.org/x/text v0.15.0 // indirect
 	golang.org/x/tools v0.21.0 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240610135401-a8a62080eff3 // indirect
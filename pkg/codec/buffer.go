@@ -0,0 +1,56 @@
+package codec
+
+import (
+	"math/bits"
+	"sync"
+
+	"github.com/codingpoeta/net-model-bench/common"
+)
+
+// The buffers of the compressed bodies are pooled by powers of two,
+// from minBufShift up.
+const (
+	minBufShift = 12
+	bufClasses  = 12
+)
+
+var bufPools [bufClasses]sync.Pool
+
+// GetBuffer returns a buffer of at least n bytes with a reference,
+// released to its pool by Dec. The buffers beyond the pooled sizes
+// are left to the GC.
+func GetBuffer(n int) *common.BodyBuffer {
+	class := max(bits.Len(uint(n-1)), minBufShift) - minBufShift
+	if n <= 0 {
+		class = 0
+	}
+	if class >= bufClasses {
+		bb := &common.BodyBuffer{Buf: make([]byte, n), Release: func() {}}
+		bb.Inc()
+		return bb
+	}
+	bb, ok := bufPools[class].Get().(*common.BodyBuffer)
+	if !ok {
+		bb = &common.BodyBuffer{Buf: make([]byte, 1<<(class+minBufShift))}
+		bb.Release = func() { bufPools[class].Put(bb) }
+	}
+	bb.Inc()
+	return bb
+}
+
+// CompressBody compresses the body with c into a buffer of GetBuffer.
+// It returns a nil buffer if the body doesn't shrink, so it's sent as
+// is. The compressed body holds the reference of the buffer. The codecs
+// of Spec.Codec count the failures in their Reports.
+func CompressBody(c Codec, body []byte) (*common.BodyBuffer, []byte, error) {
+	if len(body) == 0 || c.Spec().ID == None {
+		return nil, nil, nil
+	}
+	bb := GetBuffer(c.CompressBound(len(body)))
+	n, err := c.Compress(bb.Buf[:c.CompressBound(len(body))], body)
+	if err != nil || n >= len(body) {
+		bb.Dec()
+		return nil, nil, err
+	}
+	return bb, bb.Buf[:n], nil
+}
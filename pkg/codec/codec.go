@@ -0,0 +1,259 @@
+// Package codec compresses the response bodies of tcppool, quic and jnet.
+//
+// The clients ask for a codec and its level per request, see Spec and
+// frame.Header, the servers answer with the body compressed by it, or
+// as is if it doesn't shrink. The codecs returned by Spec.Codec count
+// their work, see Reports.
+package codec
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/juicedata/juicefs/pkg/compress"
+	"github.com/klauspost/compress/zstd"
+)
+
+// ID identifies a codec on the wire.
+type ID uint8
+
+const (
+	None ID = iota
+	LZ4
+	Zstd
+	Snappy
+)
+
+// MaxZstdLevel is the highest zstd level, level 0 is the zstd default.
+// The levels map to the four speeds of the pure Go encoder, see
+// zstd.EncoderLevelFromZstd.
+const MaxZstdLevel = 22
+
+// zstdDefaultLevel is the level 0 stands for.
+const zstdDefaultLevel = 3
+
+var names = [...]string{
+	None:   "none",
+	LZ4:    "lz4",
+	Zstd:   "zstd",
+	Snappy: "snappy",
+}
+
+func (id ID) String() string {
+	if int(id) < len(names) {
+		return names[id]
+	}
+	return fmt.Sprintf("codec(%d)", uint8(id))
+}
+
+// Spec selects a codec and its level. Only zstd has levels, level 0 is
+// the default of every codec. The zero Spec is no compression.
+type Spec struct {
+	ID    ID
+	Level int
+}
+
+// Parse parses the -codec flag values: none, lz4, snappy, zstd and
+// zstd-<level>.
+func Parse(s string) (Spec, error) {
+	name, level, hasLevel := strings.Cut(s, "-")
+	var spec Spec
+	switch name {
+	case "none", "":
+		spec.ID = None
+	case "lz4":
+		spec.ID = LZ4
+	case "zstd":
+		spec.ID = Zstd
+	case "snappy":
+		spec.ID = Snappy
+	default:
+		return Spec{}, fmt.Errorf("unknown codec %q", s)
+	}
+	if hasLevel {
+		l, err := strconv.Atoi(level)
+		if err != nil {
+			return Spec{}, fmt.Errorf("invalid codec level %q", s)
+		}
+		spec.Level = l
+	}
+	return spec, spec.Validate()
+}
+
+// Validate checks the codec is known and has the level.
+func (s Spec) Validate() error {
+	switch s.ID {
+	case None, LZ4, Snappy:
+		if s.Level != 0 {
+			return fmt.Errorf("codec %s has no levels", s.ID)
+		}
+	case Zstd:
+		if s.Level < 0 || s.Level > MaxZstdLevel {
+			return fmt.Errorf("zstd level %d out of 0..%d", s.Level, MaxZstdLevel)
+		}
+	default:
+		return fmt.Errorf("unknown codec %d", uint8(s.ID))
+	}
+	return nil
+}
+
+func (s Spec) String() string {
+	if s.Level == 0 {
+		return s.ID.String()
+	}
+	return fmt.Sprintf("%s-%d", s.ID, s.Level)
+}
+
+// Codec compresses bodies into buffers of CompressBound bytes, and
+// decompresses them into buffers of their original size.
+type Codec interface {
+	Spec() Spec
+	CompressBound(n int) int
+	Compress(dst, src []byte) (int, error)
+	Decompress(dst, src []byte) (int, error)
+}
+
+// Codec returns the codec of the spec, counting its work.
+func (s Spec) Codec() (Codec, error) {
+	if m, ok := meters.Load(s); ok {
+		return m.(*meter), nil
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	var c Codec
+	switch s.ID {
+	case None:
+		c = noOp{}
+	case LZ4:
+		c = lz4{}
+	case Zstd:
+		z, err := newZstd(s.Level)
+		if err != nil {
+			return nil, err
+		}
+		c = z
+	case Snappy:
+		c = snappyCodec{}
+	}
+	m, _ := meters.LoadOrStore(s, &meter{Codec: c})
+	return m.(*meter), nil
+}
+
+type noOp struct{}
+
+func (noOp) Spec() Spec              { return Spec{ID: None} }
+func (noOp) CompressBound(n int) int { return n }
+
+func (noOp) Compress(dst, src []byte) (int, error) {
+	if len(dst) < len(src) {
+		return 0, errShort(len(dst), len(src))
+	}
+	return copy(dst, src), nil
+}
+
+func (noOp) Decompress(dst, src []byte) (int, error) {
+	if len(dst) < len(src) {
+		return 0, errShort(len(dst), len(src))
+	}
+	return copy(dst, src), nil
+}
+
+type lz4 struct {
+	compress.LZ4
+}
+
+func (lz4) Spec() Spec { return Spec{ID: LZ4} }
+
+type zstdCodec struct {
+	level int
+	enc   *zstd.Encoder
+}
+
+func newZstd(level int) (zstdCodec, error) {
+	l := level
+	if l == 0 {
+		l = zstdDefaultLevel
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(l)))
+	if err != nil {
+		return zstdCodec{}, err
+	}
+	return zstdCodec{level: level, enc: enc}, nil
+}
+
+// zstdDecoder decompresses the bodies of every level, DecodeAll is safe
+// for concurrent use.
+var zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+	return zstd.NewReader(nil)
+})
+
+func (c zstdCodec) Spec() Spec { return Spec{ID: Zstd, Level: c.level} }
+
+// CompressBound is ZSTD_COMPRESSBOUND of the C library.
+func (zstdCodec) CompressBound(n int) int {
+	bound := n + n>>8
+	if n < 128<<10 {
+		bound += (128<<10 - n) >> 11
+	}
+	return bound
+}
+
+func (c zstdCodec) Compress(dst, src []byte) (int, error) {
+	d := c.enc.EncodeAll(src, dst[:0])
+	if !inPlace(d, dst) {
+		return 0, errShort(len(dst), c.CompressBound(len(src)))
+	}
+	return len(d), nil
+}
+
+func (zstdCodec) Decompress(dst, src []byte) (int, error) {
+	dec, err := zstdDecoder()
+	if err != nil {
+		return 0, err
+	}
+	d, err := dec.DecodeAll(src, dst[:0])
+	if err != nil {
+		return 0, err
+	}
+	if !inPlace(d, dst) {
+		return 0, errShort(len(dst), len(d))
+	}
+	return len(d), nil
+}
+
+// inPlace reports whether d, appended to dst[:0], fits in dst.
+func inPlace(d, dst []byte) bool {
+	return len(d) == 0 || len(d) <= len(dst) && &d[0] == &dst[0]
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Spec() Spec              { return Spec{ID: Snappy} }
+func (snappyCodec) CompressBound(n int) int { return snappy.MaxEncodedLen(n) }
+
+func (snappyCodec) Compress(dst, src []byte) (int, error) {
+	if n := snappy.MaxEncodedLen(len(src)); len(dst) < n {
+		return 0, errShort(len(dst), n)
+	}
+	return len(snappy.Encode(dst, src)), nil
+}
+
+func (snappyCodec) Decompress(dst, src []byte) (int, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return 0, err
+	}
+	if len(dst) < n {
+		return 0, errShort(len(dst), n)
+	}
+	d, err := snappy.Decode(dst, src)
+	return len(d), err
+}
+
+func errShort(have, want int) error {
+	return fmt.Errorf("codec: buffer too short: %d < %d", have, want)
+}
@@ -0,0 +1,106 @@
+package codec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	a := assert.New(t)
+
+	body := bytes.Repeat([]byte("55AA5aa compressible "), 10000)
+	for _, s := range []string{"none", "lz4", "zstd", "zstd-1", "zstd-19", "snappy"} {
+		spec, err := Parse(s)
+		a.NoError(err)
+		a.Equal(s, spec.String())
+		c, err := spec.Codec()
+		a.NoError(err)
+		a.Equal(spec, c.Spec())
+
+		dst := make([]byte, c.CompressBound(len(body)))
+		n, err := c.Compress(dst, body)
+		a.NoError(err, s)
+		out := make([]byte, len(body))
+		m, err := c.Decompress(out, dst[:n])
+		a.NoError(err, s)
+		a.Equal(len(body), m)
+		a.Equal(body, out)
+
+		_, err = c.Decompress(out[:len(body)/2], dst[:n])
+		a.Error(err, s)
+	}
+}
+
+func TestParse(t *testing.T) {
+	for _, s := range []string{"gzip", "lz4-1", "zstd-23", "zstd-x", "snappy-2"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+	_, err := Spec{ID: 42}.Codec()
+	assert.Error(t, err)
+}
+
+func TestCompressBody(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := Spec{ID: Zstd, Level: 3}.Codec()
+	a.NoError(err)
+	before := report(c.Spec())
+
+	body := bytes.Repeat([]byte{7}, 1<<20)
+	bb, out, err := CompressBody(c, body)
+	a.NoError(err)
+	a.NotNil(bb)
+	a.Less(len(out), len(body))
+	bb.Dec()
+
+	random := make([]byte, 64<<10)
+	rand.Read(random)
+	bb, out, err = CompressBody(c, random)
+	a.NoError(err)
+	a.Nil(bb)
+	a.Nil(out)
+
+	r := report(c.Spec()).Sub(before)
+	a.Equal(uint64(2), r.Compress.Calls)
+	a.Equal(uint64(len(body)+len(random)), r.Compress.In)
+	a.Greater(r.Saved(), int64(0))
+}
+
+func TestGetBuffer(t *testing.T) {
+	a := assert.New(t)
+
+	for _, n := range []int{0, 1, 4096, 4097, 5 << 20, 9 << 20} {
+		bb := GetBuffer(n)
+		a.GreaterOrEqual(len(bb.Buf), n)
+		bb.Dec()
+	}
+}
+
+func report(s Spec) Report {
+	for _, r := range Reports() {
+		if r.Spec == s {
+			return r
+		}
+	}
+	return Report{Spec: s}
+}
+
+func TestReportErrors(t *testing.T) {
+	a := assert.New(t)
+
+	c, err := Spec{ID: Snappy}.Codec()
+	a.NoError(err)
+	before := report(c.Spec())
+
+	_, err = c.Decompress(make([]byte, 64), []byte("not snappy"))
+	a.Error(err)
+
+	r := report(c.Spec()).Sub(before)
+	a.Equal(uint64(0), r.Decompress.Calls)
+	a.Equal(uint64(1), r.Decompress.Errors)
+	a.Contains(r.String(), "1 failed")
+}
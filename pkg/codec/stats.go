@@ -0,0 +1,162 @@
+package codec
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// meters holds the *meter of every Spec used.
+var meters sync.Map
+
+// meter counts the calls of a codec.
+type meter struct {
+	Codec
+	compress, decompress counters
+}
+
+func (m *meter) Compress(dst, src []byte) (int, error) {
+	start := time.Now()
+	n, err := m.Codec.Compress(dst, src)
+	if err == nil {
+		m.compress.add(len(src), n, time.Since(start))
+	} else {
+		m.compress.errors.Add(1)
+	}
+	return n, err
+}
+
+func (m *meter) Decompress(dst, src []byte) (int, error) {
+	start := time.Now()
+	n, err := m.Codec.Decompress(dst, src)
+	if err == nil {
+		m.decompress.add(len(src), n, time.Since(start))
+	} else {
+		m.decompress.errors.Add(1)
+	}
+	return n, err
+}
+
+type counters struct {
+	calls, in, out, nanos, errors atomic.Uint64
+}
+
+func (c *counters) add(in, out int, d time.Duration) {
+	c.calls.Add(1)
+	c.in.Add(uint64(in))
+	c.out.Add(uint64(out))
+	c.nanos.Add(uint64(d))
+}
+
+func (c *counters) load() Stats {
+	return Stats{
+		Calls:  c.calls.Load(),
+		In:     c.in.Load(),
+		Out:    c.out.Load(),
+		Time:   time.Duration(c.nanos.Load()),
+		Errors: c.errors.Load(),
+	}
+}
+
+// Stats counts the compressions or the decompressions of a codec.
+type Stats struct {
+	Calls uint64
+	In    uint64 // bytes
+	Out   uint64 // bytes
+
+	// Time is spent in the calls. They run on the calling thread
+	// without blocking, so it's their CPU time.
+	Time time.Duration
+
+	// Errors counts the failed calls, they aren't in the other counts.
+	Errors uint64
+}
+
+// Sub returns the counts since prev.
+func (s Stats) Sub(prev Stats) Stats {
+	return Stats{
+		Calls:  s.Calls - prev.Calls,
+		In:     s.In - prev.In,
+		Out:    s.Out - prev.Out,
+		Time:   s.Time - prev.Time,
+		Errors: s.Errors - prev.Errors,
+	}
+}
+
+// Report is the work of a codec.
+type Report struct {
+	Spec       Spec
+	Compress   Stats
+	Decompress Stats
+}
+
+// Reports returns the work of the codecs used by the process, by Spec.
+func Reports() []Report {
+	var rs []Report
+	meters.Range(func(k, v any) bool {
+		m := v.(*meter)
+		rs = append(rs, Report{
+			Spec:       k.(Spec),
+			Compress:   m.compress.load(),
+			Decompress: m.decompress.load(),
+		})
+		return true
+	})
+	sort.Slice(rs, func(i, j int) bool {
+		if rs[i].Spec.ID != rs[j].Spec.ID {
+			return rs[i].Spec.ID < rs[j].Spec.ID
+		}
+		return rs[i].Spec.Level < rs[j].Spec.Level
+	})
+	return rs
+}
+
+// Sub returns the work since prev of the same codec.
+func (r Report) Sub(prev Report) Report {
+	return Report{
+		Spec:       r.Spec,
+		Compress:   r.Compress.Sub(prev.Compress),
+		Decompress: r.Decompress.Sub(prev.Decompress),
+	}
+}
+
+// Saved returns the bytes the codec kept off the wire: the bytes
+// compressed less their compressed size, or the bytes decompressed
+// less their compressed size.
+func (r Report) Saved() int64 {
+	return int64(r.Compress.In) - int64(r.Compress.Out) + int64(r.Decompress.Out) - int64(r.Decompress.In)
+}
+
+func (r Report) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s:", r.Spec)
+	if s := r.Compress; s.Calls > 0 {
+		fmt.Fprintf(&b, " compressed %d bodies %s -> %s (%.1f%%) in %v,", s.Calls,
+			size(s.In), size(s.Out), 100*float64(s.Out)/float64(max(s.In, 1)), s.Time.Round(time.Microsecond))
+	}
+	if s := r.Decompress; s.Calls > 0 {
+		fmt.Fprintf(&b, " decompressed %d bodies %s -> %s in %v,", s.Calls,
+			size(s.In), size(s.Out), s.Time.Round(time.Microsecond))
+	}
+	if n := r.Compress.Errors + r.Decompress.Errors; n > 0 {
+		fmt.Fprintf(&b, " %d failed,", n)
+	}
+	fmt.Fprintf(&b, " saved %s", size(uint64(max(r.Saved(), 0))))
+	return b.String()
+}
+
+func size(n uint64) string {
+	switch {
+	case n >= 10<<30:
+		return fmt.Sprintf("%d GiB", n>>30)
+	case n >= 10<<20:
+		return fmt.Sprintf("%d MiB", n>>20)
+	case n >= 10<<10:
+		return fmt.Sprintf("%d KiB", n>>10)
+	default:
+		return fmt.Sprintf("%d B", n)
+	}
+}
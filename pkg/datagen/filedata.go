@@ -17,6 +17,16 @@ type FileData struct {
 }
 
 func NewFileData(basePath string) common.DataGen {
+	return newFileData(basePath, NewMemData())
+}
+
+// NewCompressibleFileData returns the files of the keys of
+// NewCompressibleMemData.
+func NewCompressibleFileData(basePath string, percent int) common.DataGen {
+	return newFileData(basePath, NewCompressibleMemData(percent))
+}
+
+func newFileData(basePath string, mem common.DataGen) common.DataGen {
 	res := &FileData{
 		basePath: basePath,
 	}
@@ -25,7 +35,7 @@ func NewFileData(basePath string) common.DataGen {
 		if err != nil {
 			panic(err)
 		}
-		file.Write(NewMemData().Get(fmt.Sprintf("key%d", i)))
+		file.Write(mem.Get(fmt.Sprintf("key%d", i)))
 		file.Close()
 	}
 	for k := 0; k < 5; k++ {
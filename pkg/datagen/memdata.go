@@ -15,10 +15,14 @@ type MemData struct {
 	data map[string][]byte
 }
 
+const memDataSize = 1 << 24
+
+// NewMemData returns the keys filled with a repeated pattern, which
+// compresses to almost nothing, see NewCompressibleMemData.
 func NewMemData() common.DataGen {
-	buf := make([]byte, 1<<24)
+	buf := make([]byte, memDataSize)
 
-	for i := 0; i < 1<<24; i++ {
+	for i := 0; i < memDataSize; i++ {
 		buf[i] = utils.Letters[rand.Intn(len(utils.Letters))]
 	}
 	for i := 0; i < 1<<17; i++ {
@@ -27,8 +31,29 @@ func NewMemData() common.DataGen {
 			buf[i<<7+j<<3+7] = byte(j)
 		}
 	}
+	return newMemData(buf)
+}
+
+// compressBlock is the unit of NewCompressibleMemData, all the keys
+// start on a block.
+const compressBlock = 4 << 10
+
+// NewCompressibleMemData returns the keys of NewMemData compressing by
+// about percent of their size: every block is random bytes, except for
+// its last percent which is zero. The data is the same on every run.
+func NewCompressibleMemData(percent int) common.DataGen {
+	percent = min(max(percent, 0), 100)
+	buf := make([]byte, memDataSize)
+	r := rand.New(rand.NewSource(uint64(percent)))
+	random := compressBlock * (100 - percent) / 100
+	for i := 0; i < memDataSize; i += compressBlock {
+		r.Read(buf[i : i+random])
+	}
+	return newMemData(buf)
+}
 
-	res := &MemData{
+func newMemData(buf []byte) *MemData {
+	return &MemData{
 		data: map[string][]byte{
 			"key0": buf[:4<<10],
 			"key1": buf[4<<10 : 68<<10],
@@ -37,7 +62,6 @@ func NewMemData() common.DataGen {
 			"key4": buf[12<<20 : 16<<20],
 		},
 	}
-	return res
 }
 
 func (m *MemData) Get(key string) []byte {
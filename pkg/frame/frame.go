@@ -0,0 +1,372 @@
+// Package frame encodes the request headers of tcppool, quic, gonet and jnet.
+//
+// The V1 header is 3 bytes: the command in the low 4 bits of the first byte,
+// the key length in its high 4 bits and the second byte, and the flags.
+// It limits the commands to 16 and the keys to 4 KiB.
+//
+// The V2 header starts with Magic, followed by the varint command, the
+// flags with the operation in their high bits, the varint key length and
+// the key, the varint offset and length if FlagRange is set, and the
+// codec ID and level bytes if FlagCodec is set. A V1 header can't start
+// with Magic unless its key is longer than 3.75 KiB, which no V1 peer
+// read, so the servers accept both. They answer the V1 headers with the
+// responses of the servers before V2, and the V1 clients expect those, so
+// either side talks to the older peers.
+//
+// FlagCompress alone asks for LZ4, the only codec of the V1 headers.
+package frame
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+)
+
+// Version selects the request header format.
+type Version uint8
+
+const (
+	V1 Version = 1
+	V2 Version = 2
+)
+
+// Magic is the first byte of the V2 headers.
+const Magic = 0xF2
+
+// Flags of the headers.
+const (
+	FlagCompress = 0x01
+	FlagCRC      = 0x02
+	// FlagRange is set if the V2 header has an offset and a length.
+	FlagRange = 0x04
+	// FlagCodec is set with FlagCompress if the V2 header names the
+	// codec of the response body.
+	FlagCodec = 0x08
+
+	opShift = 4
+)
+
+const (
+	v1Len       = 3
+	v1MaxCMD    = 0x0F
+	v1MaxKeyLen = 0x0FFF
+
+	// MaxKeyLen bounds the keys of the V2 headers.
+	MaxKeyLen = 64 << 10
+
+	// MaxLen bounds the V2 header with the longest key.
+	MaxLen = 1 + 3*binary.MaxVarintLen64 + 1 + MaxKeyLen + 2
+)
+
+var (
+	// ErrShort is returned by Decode if b holds part of a header only.
+	ErrShort = errors.New("frame: short header")
+
+	errKeyTooLong = errors.New("frame: key too long")
+)
+
+// Header is a request header.
+type Header struct {
+	Version Version
+	CMD     uint32
+	Key     string
+	Op      common.Op
+	Offset  uint64
+	Length  uint64
+	Codec   codec.Spec // of the response body
+	CRC     bool
+}
+
+// NewHeader returns the header of the request.
+func NewHeader(v Version, req *common.Request, c codec.Spec, crc bool) Header {
+	return Header{
+		Version: v,
+		CMD:     req.CMD,
+		Key:     req.Key,
+		Op:      req.Op,
+		Offset:  req.Offset,
+		Length:  req.Length,
+		Codec:   c,
+		CRC:     crc,
+	}
+}
+
+// Request returns the request of the header.
+func (h *Header) Request() common.Request {
+	return common.Request{
+		CMD:    h.CMD,
+		Key:    h.Key,
+		Op:     h.Op,
+		Offset: h.Offset,
+		Length: h.Length,
+	}
+}
+
+func (h *Header) flags() byte {
+	var f byte
+	if h.Codec.ID != codec.None {
+		f |= FlagCompress
+	}
+	if h.Codec.ID != codec.None && h.Codec != lz4 {
+		f |= FlagCodec
+	}
+	if h.CRC {
+		f |= FlagCRC
+	}
+	return f
+}
+
+func (h *Header) setFlags(f byte) {
+	if f&FlagCompress != 0 {
+		h.Codec = lz4
+	}
+	h.CRC = f&FlagCRC != 0
+}
+
+// lz4 is the codec of FlagCompress alone.
+var lz4 = codec.Spec{ID: codec.LZ4}
+
+func (h *Header) setCodec(id, level byte) error {
+	h.Codec = codec.Spec{ID: codec.ID(id), Level: int(level)}
+	return h.Codec.Validate()
+}
+
+// Append appends the encoded header to b. The V1 headers can't hold
+// the commands over 15, the keys over 4095 bytes, the operations other
+// than OpGet, the ranges and the codecs other than LZ4.
+func (h *Header) Append(b []byte) ([]byte, error) {
+	if h.Version == V1 {
+		switch {
+		case h.CMD > v1MaxCMD:
+			return b, fmt.Errorf("frame: command %d needs V2", h.CMD)
+		case len(h.Key) > v1MaxKeyLen:
+			return b, fmt.Errorf("frame: %d bytes key needs V2", len(h.Key))
+		case h.Op != common.OpGet || h.Offset != 0 || h.Length != 0:
+			return b, errors.New("frame: operations and ranges need V2")
+		case h.Codec.ID != codec.None && h.Codec != lz4:
+			return b, fmt.Errorf("frame: codec %s needs V2", h.Codec)
+		}
+		b = append(b, byte(h.CMD)|byte(len(h.Key)>>8)<<4, byte(len(h.Key)), h.flags())
+		return append(b, h.Key...), nil
+	}
+	if len(h.Key) > MaxKeyLen {
+		return b, errKeyTooLong
+	}
+	f := h.flags() | byte(h.Op)<<opShift
+	if h.Offset != 0 || h.Length != 0 {
+		f |= FlagRange
+	}
+	b = append(b, Magic)
+	b = binary.AppendUvarint(b, uint64(h.CMD))
+	b = append(b, f)
+	b = binary.AppendUvarint(b, uint64(len(h.Key)))
+	b = append(b, h.Key...)
+	if f&FlagRange != 0 {
+		b = binary.AppendUvarint(b, h.Offset)
+		b = binary.AppendUvarint(b, h.Length)
+	}
+	if f&FlagCodec != 0 {
+		if err := h.Codec.Validate(); err != nil {
+			return b, err
+		}
+		b = append(b, byte(h.Codec.ID), byte(h.Codec.Level))
+	}
+	return b, nil
+}
+
+// Decode decodes the header at the start of b and returns its length.
+// It returns ErrShort if b ends before the header.
+func Decode(b []byte, h *Header) (int, error) {
+	if len(b) == 0 {
+		return 0, ErrShort
+	}
+	if b[0] != Magic {
+		if len(b) < v1Len {
+			return 0, ErrShort
+		}
+		size := int(b[1]) + int(b[0]>>4)<<8
+		if len(b) < v1Len+size {
+			return 0, ErrShort
+		}
+		*h = Header{Version: V1, CMD: uint32(b[0] & 0x0F), Key: string(b[v1Len : v1Len+size])}
+		h.setFlags(b[2])
+		return v1Len + size, nil
+	}
+	*h = Header{Version: V2}
+	n := 1
+	cmd, err := uvarint(b, &n)
+	if err != nil {
+		return 0, err
+	}
+	if cmd > 1<<32-1 {
+		return 0, fmt.Errorf("frame: command %d overflows", cmd)
+	}
+	h.CMD = uint32(cmd)
+	if len(b) <= n {
+		return 0, ErrShort
+	}
+	f := b[n]
+	n++
+	h.setFlags(f)
+	h.Op = common.Op(f >> opShift)
+	size, err := uvarint(b, &n)
+	if err != nil {
+		return 0, err
+	}
+	if size > MaxKeyLen {
+		return 0, errKeyTooLong
+	}
+	if uint64(len(b)-n) < size {
+		return 0, ErrShort
+	}
+	h.Key = string(b[n : n+int(size)])
+	n += int(size)
+	if f&FlagRange != 0 {
+		if h.Offset, err = uvarint(b, &n); err != nil {
+			return 0, err
+		}
+		if h.Length, err = uvarint(b, &n); err != nil {
+			return 0, err
+		}
+	}
+	if f&FlagCodec != 0 {
+		if len(b) < n+2 {
+			return 0, ErrShort
+		}
+		if err := h.setCodec(b[n], b[n+1]); err != nil {
+			return 0, err
+		}
+		n += 2
+	}
+	return n, nil
+}
+
+func uvarint(b []byte, n *int) (uint64, error) {
+	v, m := binary.Uvarint(b[*n:])
+	if m == 0 {
+		return 0, ErrShort
+	}
+	if m < 0 {
+		return 0, errors.New("frame: varint overflows")
+	}
+	*n += m
+	return v, nil
+}
+
+// Read reads a header of either version from r.
+func Read(r *bufio.Reader, h *Header) error {
+	first, err := r.Peek(1)
+	if err != nil {
+		return err
+	}
+	if first[0] != Magic {
+		var b [v1Len]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return err
+		}
+		key := make([]byte, int(b[1])+int(b[0]>>4)<<8)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return noEOF(err)
+		}
+		*h = Header{Version: V1, CMD: uint32(b[0] & 0x0F), Key: string(key)}
+		h.setFlags(b[2])
+		return nil
+	}
+	r.Discard(1)
+	*h = Header{Version: V2}
+	cmd, err := binary.ReadUvarint(r)
+	if err != nil {
+		return noEOF(err)
+	}
+	if cmd > 1<<32-1 {
+		return fmt.Errorf("frame: command %d overflows", cmd)
+	}
+	h.CMD = uint32(cmd)
+	f, err := r.ReadByte()
+	if err != nil {
+		return noEOF(err)
+	}
+	h.setFlags(f)
+	h.Op = common.Op(f >> opShift)
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return noEOF(err)
+	}
+	if size > MaxKeyLen {
+		return errKeyTooLong
+	}
+	key := make([]byte, size)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return noEOF(err)
+	}
+	h.Key = string(key)
+	if f&FlagRange != 0 {
+		if h.Offset, err = binary.ReadUvarint(r); err != nil {
+			return noEOF(err)
+		}
+		if h.Length, err = binary.ReadUvarint(r); err != nil {
+			return noEOF(err)
+		}
+	}
+	if f&FlagCodec != 0 {
+		var c [2]byte
+		if _, err := io.ReadFull(r, c[:]); err != nil {
+			return noEOF(err)
+		}
+		return h.setCodec(c[0], c[1])
+	}
+	return nil
+}
+
+// noEOF reports the headers cut short as such.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Range returns the part of body selected by the header.
+func (h *Header) Range(body []byte) ([]byte, error) {
+	n, err := Range(uint64(len(body)), h.Offset, h.Length)
+	if err != nil {
+		return nil, err
+	}
+	return body[h.Offset : h.Offset+n], nil
+}
+
+// Range returns the length of the range at offset of a body of size
+// bytes, the rest of the body if length is 0.
+func Range(size, offset, length uint64) (uint64, error) {
+	if offset > size {
+		return 0, fmt.Errorf("offset %d beyond %d bytes", offset, size)
+	}
+	if length == 0 {
+		return size - offset, nil
+	}
+	if length > size-offset {
+		return 0, fmt.Errorf("length %d beyond %d bytes", length, size-offset)
+	}
+	return length, nil
+}
+
+// Parse parses the -framing flag values v1 and v2, V1 by default.
+func Parse(s string) (Version, error) {
+	switch s {
+	case "v1", "":
+		return V1, nil
+	case "v2":
+		return V2, nil
+	default:
+		return 0, fmt.Errorf("unknown framing %q", s)
+	}
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d", uint8(v))
+}
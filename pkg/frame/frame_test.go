@@ -0,0 +1,111 @@
+package frame
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	a := assert.New(t)
+
+	headers := []Header{
+		{Version: V1, CMD: 3, Key: "key", CRC: true},
+		{Version: V1, CMD: 15, Key: strings.Repeat("k", v1MaxKeyLen), Codec: lz4},
+		{Version: V2, CMD: 1 << 20, Key: strings.Repeat("k", 10000)},
+		{Version: V2, CMD: 4, Key: "key", Op: common.OpDelete, Codec: lz4, CRC: true},
+		{Version: V2, Key: "range", Offset: 1 << 40, Length: 4096},
+		{Version: V2, Key: "zstd", Offset: 1, Codec: codec.Spec{ID: codec.Zstd, Level: 19}},
+		{Version: V2, Key: "snappy", Codec: codec.Spec{ID: codec.Snappy}, CRC: true},
+	}
+	var stream []byte
+	for _, h := range headers {
+		b, err := h.Append(nil)
+		a.NoError(err)
+		stream = append(stream, b...)
+
+		var got Header
+		n, err := Decode(b, &got)
+		a.NoError(err)
+		a.Equal(len(b), n)
+		a.Equal(h, got)
+
+		for i := 0; i < len(b); i++ {
+			_, err = Decode(b[:i], &got)
+			a.Equal(ErrShort, err, "%d bytes", i)
+		}
+	}
+
+	r := bufio.NewReader(bytes.NewReader(stream))
+	for _, h := range headers {
+		var got Header
+		a.NoError(Read(r, &got))
+		a.Equal(h, got)
+	}
+	var got Header
+	a.Equal(io.EOF, Read(r, &got))
+}
+
+func TestV1Limits(t *testing.T) {
+	a := assert.New(t)
+
+	for _, h := range []Header{
+		{Version: V1, CMD: 16},
+		{Version: V1, Key: strings.Repeat("k", v1MaxKeyLen+1)},
+		{Version: V1, Op: common.OpPut},
+		{Version: V1, Length: 1},
+		{Version: V1, Codec: codec.Spec{ID: codec.Snappy}},
+	} {
+		_, err := h.Append(nil)
+		a.Error(err)
+	}
+
+	h := Header{Version: V2, Key: strings.Repeat("k", MaxKeyLen+1)}
+	_, err := h.Append(nil)
+	a.Error(err)
+
+	h = Header{Version: V2, Codec: codec.Spec{ID: codec.Zstd, Level: codec.MaxZstdLevel + 1}}
+	_, err = h.Append(nil)
+	a.Error(err)
+}
+
+func TestUnknownCodec(t *testing.T) {
+	h := Header{Version: V2, Key: "key", Codec: codec.Spec{ID: codec.Snappy}}
+	b, _ := h.Append(nil)
+	b[len(b)-2] = 0xFF
+	_, err := Decode(b, &h)
+	assert.Error(t, err)
+	assert.Error(t, Read(bufio.NewReader(bytes.NewReader(b)), &h))
+}
+
+func TestReadShort(t *testing.T) {
+	h := Header{Version: V2, CMD: 7, Key: "key"}
+	b, _ := h.Append(nil)
+	r := bufio.NewReader(bytes.NewReader(b[:len(b)-1]))
+	assert.Equal(t, io.ErrUnexpectedEOF, Read(r, &h))
+}
+
+func TestRange(t *testing.T) {
+	a := assert.New(t)
+
+	body := []byte("0123456789")
+	h := Header{Offset: 2, Length: 3}
+	b, err := h.Range(body)
+	a.NoError(err)
+	a.Equal("234", string(b))
+
+	h = Header{Offset: 4}
+	b, err = h.Range(body)
+	a.NoError(err)
+	a.Equal("456789", string(b))
+
+	h = Header{Offset: 8, Length: 3}
+	_, err = h.Range(body)
+	a.Error(err)
+}
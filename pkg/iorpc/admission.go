@@ -0,0 +1,160 @@
+package iorpc
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	errAdmissionTimeout = errors.New("admission timeout")
+	errAdmissionStopped = errors.New("admission stopped")
+)
+
+// admission shares the Server.Concurrency handler slots between
+// the connections.
+//
+// Every connection waits for a slot with a single request at a time.
+// Free slots are granted to the waiting connections in round-robin order,
+// a connection with weight w gets up to w slots in a row while it keeps
+// waiting. Connections running their limit of handlers are skipped.
+type admission struct {
+	mu   sync.Mutex
+	free int
+
+	// queue is the connections waiting for a slot, in service order.
+	queue []*admissionConn
+
+	// turn is the connection granted last.
+	turn *admissionConn
+}
+
+// admissionConn is the admission state of a single connection.
+type admissionConn struct {
+	weight int
+	limit  int
+
+	// The fields below are guarded by admission.mu.
+	running int
+	credit  int
+	queued  bool
+
+	// ready receives the granted slot.
+	ready chan struct{}
+}
+
+func newAdmission(slots int) *admission {
+	return &admission{free: slots}
+}
+
+func newAdmissionConn(weight, limit int) *admissionConn {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &admissionConn{
+		weight: weight,
+		limit:  limit,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// acquire waits for a handler slot of the connection.
+//
+// errAdmissionTimeout is returned if no slot is granted during the timeout,
+// zero timeout waits until stopChan is closed.
+func (a *admission) acquire(ac *admissionConn, timeout time.Duration, stopChan <-chan struct{}) error {
+	a.mu.Lock()
+	a.enqueue(ac)
+	a.dispatch()
+	queued := ac.queued
+	a.mu.Unlock()
+	if !queued {
+		<-ac.ready
+		return nil
+	}
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		t := acquireTimer(timeout)
+		defer releaseTimer(t)
+		timeoutChan = t.C
+	}
+	err := errAdmissionTimeout
+	select {
+	case <-ac.ready:
+		return nil
+	case <-timeoutChan:
+	case <-stopChan:
+		err = errAdmissionStopped
+	}
+
+	a.mu.Lock()
+	if !ac.queued {
+		// The slot has been granted meanwhile.
+		a.mu.Unlock()
+		<-ac.ready
+		if err == errAdmissionStopped {
+			a.release(ac)
+			return err
+		}
+		return nil
+	}
+	a.remove(ac)
+	a.mu.Unlock()
+	return err
+}
+
+// release returns the slot acquired by the connection.
+func (a *admission) release(ac *admissionConn) {
+	a.mu.Lock()
+	ac.running--
+	a.free++
+	a.dispatch()
+	a.mu.Unlock()
+}
+
+// enqueue queues the connection for a slot. It must be called with a.mu held.
+func (a *admission) enqueue(ac *admissionConn) {
+	if a.turn == ac && ac.credit > 0 {
+		// Keep the turn of the connection.
+		a.queue = append(a.queue, nil)
+		copy(a.queue[1:], a.queue)
+		a.queue[0] = ac
+	} else {
+		ac.credit = ac.weight
+		a.queue = append(a.queue, ac)
+	}
+	ac.queued = true
+}
+
+// dispatch grants the free slots to the queued connections.
+// It must be called with a.mu held.
+func (a *admission) dispatch() {
+	for a.free > 0 {
+		i := 0
+		for i < len(a.queue) && a.queue[i].limit > 0 && a.queue[i].running >= a.queue[i].limit {
+			i++
+		}
+		if i == len(a.queue) {
+			return
+		}
+		ac := a.queue[i]
+		a.queue = append(a.queue[:i], a.queue[i+1:]...)
+		ac.queued = false
+		ac.running++
+		ac.credit--
+		a.free--
+		a.turn = ac
+		ac.ready <- struct{}{}
+	}
+}
+
+func (a *admission) remove(ac *admissionConn) {
+	for i, qc := range a.queue {
+		if qc == ac {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			break
+		}
+	}
+	ac.queued = false
+}
@@ -0,0 +1,153 @@
+package iorpc
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdmissionWeights(t *testing.T) {
+	a := assert.New(t)
+
+	adm := newAdmission(0)
+	heavy := newAdmissionConn(2, 0)
+	light := newAdmissionConn(1, 0)
+	names := map[*admissionConn]string{heavy: "heavy", light: "light"}
+
+	// grant frees a slot and returns the connection it is granted to.
+	grant := func() *admissionConn {
+		adm.mu.Lock()
+		adm.free++
+		adm.dispatch()
+		adm.mu.Unlock()
+		select {
+		case <-heavy.ready:
+			return heavy
+		case <-light.ready:
+			return light
+		default:
+			return nil
+		}
+	}
+	wait := func(ac *admissionConn) {
+		adm.mu.Lock()
+		adm.enqueue(ac)
+		adm.mu.Unlock()
+	}
+
+	wait(heavy)
+	wait(light)
+	var order []string
+	for i := 0; i < 6; i++ {
+		ac := grant()
+		if !a.NotNil(ac) {
+			return
+		}
+		order = append(order, names[ac])
+		// Both connections keep waiting.
+		wait(ac)
+	}
+	a.Equal([]string{"heavy", "heavy", "light", "heavy", "heavy", "light"}, order)
+}
+
+func TestAdmissionConnLimit(t *testing.T) {
+	a := assert.New(t)
+
+	adm := newAdmission(2)
+	limited := newAdmissionConn(1, 1)
+	other := newAdmissionConn(1, 0)
+	stopChan := make(chan struct{})
+
+	a.Nil(adm.acquire(limited, 0, stopChan))
+	// The limit is reached, although a slot is free.
+	a.Equal(errAdmissionTimeout, adm.acquire(limited, 10*time.Millisecond, stopChan))
+	a.Nil(adm.acquire(other, 10*time.Millisecond, stopChan))
+
+	// No free slots.
+	a.Equal(errAdmissionTimeout, adm.acquire(other, 10*time.Millisecond, stopChan))
+
+	acquired := make(chan error, 1)
+	go func() {
+		acquired <- adm.acquire(limited, 0, stopChan)
+	}()
+	// The slot of other isn't granted to limited.
+	adm.release(other)
+	select {
+	case <-acquired:
+		t.Fatal("the connection limit is exceeded")
+	case <-time.After(10 * time.Millisecond):
+	}
+	adm.release(limited)
+	a.Nil(<-acquired)
+
+	go func() {
+		acquired <- adm.acquire(limited, 0, stopChan)
+	}()
+	close(stopChan)
+	a.Equal(errAdmissionStopped, <-acquired)
+	a.Empty(adm.queue)
+}
+
+func TestServerBusy(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	block := make(chan struct{})
+	d := NewDispatcher()
+	svc, _ := d.AddService("Block", func(clientAddr string, request Request) (*Response, error) {
+		<-block
+		return &Response{}, nil
+	})
+	lookalike, _ := d.AddService("Lookalike", func(clientAddr string, request Request) (*Response, error) {
+		return nil, errors.New("gorpc.Server: server is busy")
+	})
+
+	s := NewTCPServer("127.0.0.1:0", d.HandlerFunc())
+	s.Concurrency = 1
+	s.QueueTimeout = 10 * time.Millisecond
+	a.Nil(s.Listener.Init(s.Addr))
+	a.Nil(s.Start())
+	defer s.Stop()
+
+	c := NewTCPClient(s.Listener.ListenAddr().String())
+	c.Start()
+	defer c.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := c.Call(Request{Service: svc})
+		a.Nil(err)
+	}()
+	for conns := s.Conns(); len(conns) == 0 || conns[0].InFlight == 0; conns = s.Conns() {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, err := c.Call(Request{Service: svc})
+	var clientErr *ClientError
+	if a.True(errors.As(err, &clientErr)) {
+		a.True(clientErr.Busy)
+	}
+	a.True(IsRetriable(err))
+	a.Equal(uint64(1), s.Stats.Snapshot().Rejected)
+	a.Equal(uint64(1), c.Stats.Snapshot().Rejected)
+
+	close(block)
+	wg.Wait()
+
+	// A handler error reading like a busy server is a plain server error.
+	_, err = c.Call(Request{Service: lookalike})
+	if a.True(errors.As(err, &clientErr)) {
+		a.True(clientErr.Server)
+		a.False(clientErr.Busy)
+	}
+
+	// The retried call succeeds once the server has capacity.
+	c.Retry = &RetryPolicy{}
+	_, err = c.Call(Request{Service: svc})
+	a.Nil(err)
+}
@@ -1,7 +1,38 @@
 package iorpc
 
-import "syscall"
+import (
+	"errors"
+	"os"
+	"syscall"
+)
 
 func sysWrite(fd int, p []byte) (n int, err error) {
 	return syscall.Write(fd, p)
 }
+
+func sysWritev(fd int, iovec [][]byte) (n int, err error) {
+	for _, b := range iovec {
+		m, err := syscall.Write(fd, b)
+		n += m
+		if err != nil || m < len(b) {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func sysSpliceAt(rfd, wfd int, off *int64, n int) (int, error) {
+	return 0, errors.New("splice is not supported")
+}
+
+func sysWaitReadable(fd int) error {
+	return errors.New("splice is not supported")
+}
+
+func sysFdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+func sysVmsplice(fd int, iovec [][]byte) (n int, err error) {
+	return 0, errors.New("vmsplice is not supported")
+}
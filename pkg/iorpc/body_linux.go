@@ -1,7 +1,44 @@
 package iorpc
 
-import "syscall"
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
 
 func sysWrite(fd int, p []byte) (n int, err error) {
 	return syscall.Write(fd, p)
 }
+
+func sysSpliceAt(rfd, wfd int, off *int64, n int) (int, error) {
+	written, err := unix.Splice(rfd, nil, wfd, off, n, unix.SPLICE_F_MOVE)
+	return int(written), err
+}
+
+// sysWaitReadable blocks until the fd has data to read.
+func sysWaitReadable(fd int) error {
+	_, err := unix.Poll([]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}, -1)
+	return err
+}
+
+func sysFdatasync(f *os.File) error {
+	return unix.Fdatasync(int(f.Fd()))
+}
+
+func sysWritev(fd int, iovec [][]byte) (n int, err error) {
+	return unix.Writev(fd, iovec)
+}
+
+func sysVmsplice(fd int, iovec [][]byte) (n int, err error) {
+	iovs := make([]unix.Iovec, 0, len(iovec))
+	for _, b := range iovec {
+		if len(b) == 0 {
+			continue
+		}
+		v := unix.Iovec{Base: &b[0]}
+		v.SetLen(len(b))
+		iovs = append(iovs, v)
+	}
+	return unix.Vmsplice(fd, iovs, unix.SPLICE_F_GIFT|unix.SPLICE_F_NONBLOCK)
+}
@@ -0,0 +1,307 @@
+package iorpc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type iovecBuffer struct {
+	iovec  [][]byte
+	closed chan struct{}
+	closes atomic.Int32
+}
+
+func newIovecBuffer(size, segments int) *iovecBuffer {
+	b := &iovecBuffer{closed: make(chan struct{}, 1)}
+	seg := size / segments
+	for i := 0; i < segments; i++ {
+		p := make([]byte, seg)
+		for j := range p {
+			p[j] = byte(i + j)
+		}
+		b.iovec = append(b.iovec, p)
+	}
+	return b
+}
+
+func (b *iovecBuffer) Iovec() [][]byte {
+	return b.iovec
+}
+
+func (b *iovecBuffer) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (b *iovecBuffer) Close() error {
+	b.closes.Add(1)
+	b.closed <- struct{}{}
+	return nil
+}
+
+func (b *iovecBuffer) bytes() []byte {
+	return bytes.Join(b.iovec, nil)
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestLoadIovecPartialWrites(t *testing.T) {
+	a := assert.New(t)
+
+	iovec := [][]byte{[]byte("hello"), {}, []byte(", "), []byte("world")}
+	var out []byte
+	write := func(fd int, iovec [][]byte) (int, error) {
+		// Write at most 3 bytes per call.
+		n := 0
+		for _, b := range iovec {
+			for _, c := range b {
+				if n == 3 {
+					return n, nil
+				}
+				out = append(out, c)
+				n++
+			}
+		}
+		return n, nil
+	}
+	a.Nil(loadIovec(write, 0, iovec))
+	a.Equal("hello, world", string(out))
+	a.Equal("hello", string(iovec[0]))
+}
+
+func TestSpliceBufferBody(t *testing.T) {
+	// The bodies from vmspliceMinSize on are vmspliced, the 4MiB one
+	// goes through the pipe in several rounds.
+	for _, size := range []int{4 << 10, 64 << 10, vmspliceMinSize, 4 << 20} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			a := assert.New(t)
+
+			client, server := tcpPair(t)
+			defer client.Close()
+			defer server.Close()
+
+			buf := newIovecBuffer(size, 4)
+			received := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(io.LimitReader(server, int64(size)))
+				received <- b
+			}()
+
+			body := Body{Size: uint64(size), Reader: buf}
+			spliced, err := body.spliceTo(client)
+			a.True(spliced)
+			a.Nil(err)
+			a.Zero(buf.closes.Load())
+			body.Close()
+
+			a.Equal(buf.bytes(), <-received)
+			a.Equal(int32(1), buf.closes.Load())
+		})
+	}
+}
+
+func TestZeroCopyBufferBody(t *testing.T) {
+	for _, size := range []int{4 << 10, 256 << 10} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			a := assert.New(t)
+
+			client, server := tcpPair(t)
+			defer server.Close()
+			conn := withZeroCopy(client, 64<<10)
+			defer conn.Close()
+			if _, ok := conn.(*zeroCopyConn); !ok {
+				t.Skip("MSG_ZEROCOPY is not supported")
+			}
+
+			buf := newIovecBuffer(size, 4)
+			received := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(io.LimitReader(server, int64(size)))
+				received <- b
+			}()
+
+			body := Body{Size: uint64(size), Reader: buf}
+			spliced, err := body.spliceTo(conn)
+			a.True(spliced)
+			a.Nil(err)
+			body.Close()
+
+			a.Equal(buf.bytes(), <-received)
+			select {
+			case <-buf.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the buffer hasn't been released")
+			}
+			time.Sleep(10 * time.Millisecond)
+			a.Equal(int32(1), buf.closes.Load())
+			a.Equal(size >= 64<<10, conn.(*zeroCopyConn).zc.Stats().Completed > 0)
+		})
+	}
+}
+
+func TestWriteBodyToFile(t *testing.T) {
+	a := assert.New(t)
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	f, err := os.CreateTemp(t.TempDir(), "body")
+	a.Nil(err)
+	defer f.Close()
+
+	data := newIovecBuffer(128<<10, 4).bytes()
+	go client.Write(data)
+
+	// The decoder splices request bodies from the connection to pipes.
+	pipe, err := PipeConn(server, len(data))
+	a.Nil(err)
+	n, err := WriteBodyToFile(pipe, f, 4096, len(data), DataSync)
+	pipe.Close()
+	a.Nil(err)
+	a.Equal(len(data), n)
+
+	n, err = WriteBodyToFile(bytes.NewReader(data[:100]), f, 0, 100, FullSync)
+	a.Nil(err)
+	a.Equal(100, n)
+
+	got, err := os.ReadFile(f.Name())
+	a.Nil(err)
+	a.Equal(4096+len(data), len(got))
+	a.Equal(data[:100], got[:100])
+	a.Equal(data, got[4096:])
+}
+
+// slowPipe is a non-blocking pipe body its writer keeps filling.
+type slowPipe struct {
+	r, w int
+}
+
+func (p *slowPipe) ReadFd() uintptr {
+	return uintptr(p.r)
+}
+
+func (p *slowPipe) WriteTo(fd uintptr, n int) (int, error) {
+	return 0, io.EOF
+}
+
+func (p *slowPipe) Read(b []byte) (int, error) {
+	return syscall.Read(p.r, b)
+}
+
+func (p *slowPipe) Close() error {
+	syscall.Close(p.r)
+	return syscall.Close(p.w)
+}
+
+func TestWriteSlowPipeToFile(t *testing.T) {
+	a := assert.New(t)
+
+	var fds [2]int
+	a.Nil(syscall.Pipe2(fds[:], syscall.O_NONBLOCK))
+	pipe := &slowPipe{r: fds[0], w: fds[1]}
+	defer pipe.Close()
+
+	f, err := os.CreateTemp(t.TempDir(), "body")
+	a.Nil(err)
+	defer f.Close()
+
+	// The file waits for the second half of the body.
+	data := newIovecBuffer(32<<10, 2).iovec
+	_, err = syscall.Write(pipe.w, data[0])
+	a.Nil(err)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		syscall.Write(pipe.w, data[1])
+	}()
+	n, err := WriteBodyToFile(pipe, f, 0, 32<<10, NoSync)
+	a.Nil(err)
+	a.Equal(32<<10, n)
+
+	got, err := os.ReadFile(f.Name())
+	a.Nil(err)
+	a.Equal(bytes.Join(data, nil), got)
+}
+
+// BenchmarkBufferBody compares sending a buffer body of 4 segments
+// to a loopback TCP connection with write per segment, writev
+// and vmsplice followed by splice.
+func BenchmarkBufferBody(b *testing.B) {
+	for _, size := range []int{4 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20} {
+		for _, mode := range []string{"write", "writev", "vmsplice"} {
+			b.Run(fmt.Sprintf("%s/%dKiB", mode, size>>10), func(b *testing.B) {
+				benchmarkBufferBody(b, mode, size)
+			})
+		}
+	}
+}
+
+func benchmarkBufferBody(b *testing.B, mode string, size int) {
+	client, server := tcpPair(b)
+	defer client.Close()
+	defer server.Close()
+	go io.Copy(io.Discard, server)
+
+	raw, err := client.SyscallConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	buf := newIovecBuffer(size, 4)
+
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		switch mode {
+		case "write":
+			for _, p := range buf.iovec {
+				if _, err = client.Write(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+		case "writev":
+			iovec := net.Buffers(append([][]byte(nil), buf.iovec...))
+			if _, err = iovec.WriteTo(client); err != nil {
+				b.Fatal(err)
+			}
+		case "vmsplice":
+			pipe, err := VmspliceBuffer(buf, size)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err = writePipe(raw, pipe, size); err != nil {
+				b.Fatal(err)
+			}
+			pipe.Close()
+		}
+	}
+}
@@ -2,8 +2,29 @@ package iorpc
 
 import (
 	"fmt"
+	"os"
 )
 
 func sysWrite(fd int, p []byte) (n int, err error) {
 	return 0, fmt.Errorf("not implemented")
 }
+
+func sysWritev(fd int, iovec [][]byte) (n int, err error) {
+	return 0, fmt.Errorf("not implemented")
+}
+
+func sysSpliceAt(rfd, wfd int, off *int64, n int) (int, error) {
+	return 0, fmt.Errorf("not implemented")
+}
+
+func sysWaitReadable(fd int) error {
+	return fmt.Errorf("not implemented")
+}
+
+func sysFdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+func sysVmsplice(fd int, iovec [][]byte) (n int, err error) {
+	return 0, fmt.Errorf("not implemented")
+}
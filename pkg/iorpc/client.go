@@ -57,6 +57,27 @@ type Client struct {
 	// Default value is DefaultRequestTimeout.
 	RequestTimeout time.Duration
 
+	// Interval of application-level pings sent to the server on idle
+	// connections.
+	//
+	// Zero value disables pings, so half-open connections are detected
+	// by TCP keepalive only.
+	PingInterval time.Duration
+
+	// The connection is closed and all its pending requests fail
+	// with ClientError.Connection if nothing has been received from
+	// the server during PingTimeout. The client reconnects afterwards.
+	//
+	// PingTimeout must exceed the time of receiving the largest response.
+	// Default value is 3*PingInterval.
+	PingTimeout time.Duration
+
+	// The connection is closed if the server doesn't complete the
+	// handshake during HandshakeTimeout, such as the servers sending
+	// no service table. The client reconnects afterwards.
+	// Default value is DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
 	// Disable data compression.
 	// By default data compression is enabled.
 	DisableCompression bool
@@ -69,6 +90,13 @@ type Client struct {
 	// Default value is DefaultBufferSize.
 	RecvBufferSize int
 
+	// Buffer bodies of at least ZeroCopyMinSize bytes are sent to TCP
+	// connections with MSG_ZEROCOPY and closed once the kernel completes
+	// the send. Smaller bodies are copied.
+	//
+	// Zero-copy sends are disabled by default.
+	ZeroCopyMinSize int
+
 	// OnConnect is called whenever connection to server is established.
 	// The callback can be used for authentication/authorization/encryption
 	// and/or for custom transport wrapping.
@@ -94,11 +122,48 @@ type Client struct {
 	// By default it returns TCP connections established to the Client.Addr.
 	Dial DialFunc
 
+	// The maximum size of headers accepted from the server.
+	// Default is DefaultMaxHeaderSize.
+	MaxHeaderSize int
+
+	// The maximum size of a body accepted from the server.
+	// Larger messages are treated as protocol errors and close the connection.
+	// Default is DefaultMaxBodySize.
+	MaxBodySize int
+
+	// The maximum size of an error message accepted from the server.
+	// Default is DefaultMaxErrorSize.
+	MaxErrorSize int
+
+	// HeadersRegistry maps request and response headers to their wire ids.
+	//
+	// By default a copy of the headers registered via RegisterHeaders()
+	// is taken on start.
+	HeadersRegistry *HeadersRegistry
+
 	// LogError is used for error logging.
 	//
 	// By default the function set via SetErrorLogger() is used.
 	LogError LoggerFunc
 
+	// Interceptor is called for every Client.Call() and Client.CallTimeout().
+	// Use ChainUnaryClientInterceptors for installing multiple interceptors.
+	//
+	// CallAsync(), Send() and Batch calls bypass the interceptor.
+	Interceptor UnaryClientInterceptor
+
+	// Retry repeats failed Client.Call() and Client.CallTimeout() calls.
+	// The interceptor sees all the attempts as a single call.
+	//
+	// By default failed calls are not retried.
+	Retry *RetryPolicy
+
+	// Hedge sends copies of slow Client.Call() and Client.CallTimeout()
+	// calls. See Stats.Hedges and Stats.HedgeWins for its effect.
+	//
+	// By default calls are not hedged.
+	Hedge *HedgePolicy
+
 	// Connection statistics.
 	//
 	// The stats doesn't reset automatically. Feel free resetting it
@@ -112,6 +177,14 @@ type Client struct {
 	pendingRequestsCount uint32
 	requestsChan         chan *AsyncResult
 
+	latency *latencyTracker
+
+	serviceStats serviceStatsSet
+
+	services      atomic.Pointer[serviceTable]
+	servicesReady chan struct{}
+	servicesOnce  *sync.Once
+
 	clientStopChan chan struct{}
 	stopWg         sync.WaitGroup
 }
@@ -139,15 +212,39 @@ func (c *Client) Start() {
 	if c.RequestTimeout <= 0 {
 		c.RequestTimeout = DefaultRequestTimeout
 	}
+	if c.PingInterval > 0 && c.PingTimeout <= 0 {
+		c.PingTimeout = 3 * c.PingInterval
+	}
+	if c.HandshakeTimeout <= 0 {
+		c.HandshakeTimeout = DefaultHandshakeTimeout
+	}
 	if c.SendBufferSize <= 0 {
 		c.SendBufferSize = DefaultBufferSize
 	}
 	if c.RecvBufferSize <= 0 {
 		c.RecvBufferSize = DefaultBufferSize
 	}
+	if c.MaxHeaderSize <= 0 {
+		c.MaxHeaderSize = DefaultMaxHeaderSize
+	}
+	if c.MaxBodySize <= 0 {
+		c.MaxBodySize = DefaultMaxBodySize
+	}
+	if c.MaxErrorSize <= 0 {
+		c.MaxErrorSize = DefaultMaxErrorSize
+	}
+	if c.HeadersRegistry == nil {
+		c.HeadersRegistry = globalHeaders.clone()
+	}
+	if c.Hedge != nil {
+		c.latency = newLatencyTracker(c.Hedge.Percentile)
+	}
 
 	c.requestsChan = make(chan *AsyncResult, c.PendingRequests)
 	c.clientStopChan = make(chan struct{})
+	c.services.Store(nil)
+	c.servicesReady = make(chan struct{})
+	c.servicesOnce = &sync.Once{}
 
 	if c.Conns <= 0 {
 		c.Conns = 1
@@ -184,6 +281,57 @@ func (c *Client) PendingRequestsCount() int {
 	return int(n) + len(c.requestsChan)
 }
 
+// Service returns the id of the service registered under the given name
+// on the server.
+//
+// The name->id table is advertised by the server (see Server.Services)
+// on every connection, so the returned id follows server restarts
+// with a different registration order.
+// If no connection has been established yet, Service waits for it
+// during Client.RequestTimeout.
+//
+// ErrUnknownService is returned if the server has no such service.
+func (c *Client) Service(name string) (Service, error) {
+	table := c.services.Load()
+	if table == nil {
+		t := acquireTimer(c.RequestTimeout)
+		select {
+		case <-c.servicesReady:
+		case <-t.C:
+			releaseTimer(t)
+			return 0, &ClientError{
+				Timeout: true,
+				err:     fmt.Errorf("gorpc.Client: [%s]. Cannot obtain service table during timeout=%s", c.Addr, c.RequestTimeout),
+			}
+		}
+		releaseTimer(t)
+		table = c.services.Load()
+	}
+
+	svc, ok := table.ids[name]
+	if !ok {
+		return 0, fmt.Errorf("gorpc.Client: [%s]. Service %q: %w", c.Addr, name, ErrUnknownService)
+	}
+	return svc, nil
+}
+
+// ServiceStats returns the snapshot of the per-service statistics of the calls
+// answered by the server, ordered by service.
+//
+// The stats doesn't reset automatically, see Client.ResetServiceStats.
+func (c *Client) ServiceStats() []ServiceStats {
+	var names map[Service]string
+	if table := c.services.Load(); table != nil {
+		names = table.names
+	}
+	return c.serviceStats.snapshot(names)
+}
+
+// ResetServiceStats resets the per-service statistics.
+func (c *Client) ResetServiceStats() {
+	c.serviceStats.reset()
+}
+
 // Call sends the given request to the server and obtains response
 // from the server.
 // Returns non-nil error if the response cannot be obtained during
@@ -219,6 +367,25 @@ func (c *Client) Call(request Request) (response Response, err error) {
 //
 // Don't forget starting the client with Client.Start() before calling Client.Call().
 func (c *Client) CallTimeout(request Request, timeout time.Duration) (response Response, err error) {
+	invoker := c.callTimeout
+	if c.Retry != nil || c.Hedge != nil {
+		invoker = c.callWithPolicies
+	}
+	if c.Interceptor == nil {
+		return invoker(request, timeout)
+	}
+	info := &UnaryClientInfo{
+		Addr:    c.Addr,
+		Service: request.Service,
+		Timeout: timeout,
+	}
+	if table := c.services.Load(); table != nil {
+		info.ServiceName = table.names[request.Service]
+	}
+	return c.Interceptor(info, request, invoker)
+}
+
+func (c *Client) callTimeout(request Request, timeout time.Duration) (response Response, err error) {
 	var m *AsyncResult
 	if m, err = c.callAsync(request, false, true); err != nil {
 		return Response{}, err
@@ -258,6 +425,7 @@ func releaseAsyncResult(m *AsyncResult) {
 	m.request.Body.Reset()
 	m.t = zeroTime
 	m.done = nil
+	atomic.StoreUint32(&m.canceled, 0)
 	asyncResultPool.Put(m)
 }
 
@@ -617,6 +785,10 @@ type ClientError struct {
 	// Set if the error is server-related.
 	Server bool
 
+	// Set if the server rejected the request without handling it,
+	// since it is overloaded. See Server.QueueTimeout.
+	Busy bool
+
 	// Set if the error is related to internal resources' overflow.
 	// Increase PendingRequests if you see a lot of such errors.
 	Overflow bool
@@ -695,30 +867,70 @@ func clientHandleConnection(c *Client, conn io.ReadWriteCloser) {
 		}
 		conn = newConn
 	}
+	conn = withZeroCopy(conn, c.ZeroCopyMinSize)
+
+	// Don't wait forever for a dead or an older server to complete
+	// the handshake. Closing the connection unblocks the reads of
+	// every transport, not only the ones with deadlines.
+	handshakeTimer := time.AfterFunc(c.HandshakeTimeout, func() {
+		conn.Close()
+	})
 
-	var buf [1]byte
+	buf := [1]byte{handshakeServiceTable}
 	if !c.DisableCompression {
-		buf[0] = 1
+		buf[0] |= handshakeCompression
 	}
 	_, err := conn.Write(buf[:])
 	if err != nil {
+		handshakeTimer.Stop()
 		c.LogError("gorpc.Client: [%s]. Error when writing handshake to server: [%s]", c.Addr, err)
 		conn.Close()
 		return
 	}
 
+	services, err := readServiceTable(conn)
+	if !handshakeTimer.Stop() {
+		err = fmt.Errorf("no service table during HandshakeTimeout=%s", c.HandshakeTimeout)
+	}
+	if err != nil {
+		c.LogError("gorpc.Client: [%s]. Error when reading service table from server: [%s]", c.Addr, err)
+		conn.Close()
+		return
+	}
+	c.services.Store(newServiceTable(services))
+	c.servicesOnce.Do(func() { close(c.servicesReady) })
+
 	stopChan := make(chan struct{})
 
 	pendingRequests := make(map[uint64]*AsyncResult)
 	var pendingRequestsLock sync.Mutex
 
+	ctrlChan := make(chan uint64, 1)
+	sendCtrl := func(id uint64) {
+		select {
+		case ctrlChan <- id:
+		default:
+		}
+	}
+	deadChan := make(chan struct{})
+	ka := newKeepalive(c.PingInterval, c.PingTimeout)
+	if ka != nil {
+		go ka.run(stopChan, func() { sendCtrl(pingID) }, deadChan)
+	}
+
 	writerDone := make(chan error, 1)
-	go clientWriter(c, conn, pendingRequests, &pendingRequestsLock, stopChan, writerDone)
+	go clientWriter(c, conn, pendingRequests, &pendingRequestsLock, ctrlChan, stopChan, writerDone)
 
 	readerDone := make(chan error, 1)
-	go clientReader(c, conn, pendingRequests, &pendingRequestsLock, readerDone)
+	go clientReader(c, conn, pendingRequests, &pendingRequestsLock, ka, sendCtrl, readerDone)
 
 	select {
+	case <-deadChan:
+		err = fmt.Errorf("gorpc.Client: [%s]. Server hasn't responded during PingTimeout=%s", c.Addr, c.PingTimeout)
+		close(stopChan)
+		conn.Close()
+		<-readerDone
+		<-writerDone
 	case err = <-writerDone:
 		close(stopChan)
 		conn.Close()
@@ -750,11 +962,11 @@ func clientHandleConnection(c *Client, conn io.ReadWriteCloser) {
 	}
 }
 
-func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex, stopChan <-chan struct{}, done chan<- error) {
+func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex, ctrlChan <-chan uint64, stopChan <-chan struct{}, done chan<- error) {
 	var err error
 	defer func() { done <- err }()
 
-	e := newMessageEncoder(w, &c.Stats)
+	e := newMessageEncoder(w, &c.Stats, c.HeadersRegistry)
 	defer e.Close()
 
 	t := time.NewTimer(c.FlushDelay)
@@ -763,9 +975,11 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 	var msgID uint64
 	for {
 		var m *AsyncResult
+		var ctrlID uint64
 
 		select {
 		case m = <-c.requestsChan:
+		case ctrlID = <-ctrlChan:
 		default:
 			// Give the last chance for ready goroutines filling c.requestsChan :)
 			runtime.Gosched()
@@ -774,6 +988,7 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 			case <-stopChan:
 				return
 			case m = <-c.requestsChan:
+			case ctrlID = <-ctrlChan:
 			case <-flushChan:
 				if err = e.Flush(); err != nil {
 					err = fmt.Errorf("gorpc.Client: [%s]. Cannot flush requests to underlying stream: [%s]", c.Addr, err)
@@ -788,6 +1003,14 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 			flushChan = getFlushChan(t, c.FlushDelay)
 		}
 
+		if ctrlID != 0 {
+			if err = e.EncodeRequest(wireRequest{ID: ctrlID}); err != nil {
+				err = fmt.Errorf("gorpc.Client: [%s]. Cannot send keepalive to wire: [%s]", c.Addr, err)
+				return
+			}
+			continue
+		}
+
 		if m.isCanceled() {
 			if m.done != nil {
 				m.Error = ErrCanceled
@@ -802,12 +1025,12 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 			wr.ID = 0
 		} else {
 			msgID++
-			if msgID == 0 {
-				msgID = 1
-			}
 			pendingRequestsLock.Lock()
 			n := len(pendingRequests)
 			for {
+				if msgID == 0 || msgID > maxMessageID {
+					msgID = 1
+				}
 				if _, ok := pendingRequests[msgID]; !ok {
 					break
 				}
@@ -841,7 +1064,7 @@ func clientWriter(c *Client, w io.Writer, pendingRequests map[uint64]*AsyncResul
 	}
 }
 
-func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex, done chan<- error) {
+func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResult, pendingRequestsLock *sync.Mutex, ka *keepalive, sendCtrl func(id uint64), done chan<- error) {
 	var err error
 	defer func() {
 		if r := recover(); r != nil {
@@ -852,7 +1075,11 @@ func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResul
 		done <- err
 	}()
 
-	d := newMessageDecoder(r, &c.Stats, c.CloseBody)
+	d := newMessageDecoder(r, &c.Stats, c.HeadersRegistry, messageLimits{
+		headerSize: uint64(c.MaxHeaderSize),
+		bodySize:   uint64(c.MaxBodySize),
+		errorSize:  uint64(c.MaxErrorSize),
+	}, c.CloseBody)
 	defer d.Close()
 
 	var wr wireResponse
@@ -861,6 +1088,18 @@ func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResul
 			err = fmt.Errorf("gorpc.Client: [%s]. Cannot decode response: [%s]", c.Addr, err)
 			return
 		}
+		ka.touch()
+
+		if isControlID(wr.ID) {
+			if wr.ID == pingID {
+				sendCtrl(pongID)
+			}
+			wr.Body.Close()
+			wr.ID = 0
+			wr.Headers = nil
+			wr.Body.Reset()
+			continue
+		}
 
 		pendingRequestsLock.Lock()
 		m, ok := pendingRequests[wr.ID]
@@ -884,7 +1123,15 @@ func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResul
 		wr.ID = 0
 		wr.Headers = nil
 		wr.Body.Reset()
-		if wr.Error != "" {
+		if wr.Busy {
+			m.Error = &ClientError{
+				Server: true,
+				Busy:   true,
+				err:    fmt.Errorf("gorpc.Client: [%s]. Server is busy", c.Addr),
+			}
+			c.Stats.incRejected()
+			wr.Error = ""
+		} else if wr.Error != "" {
 			m.Error = &ClientError{
 				Server: true,
 				err:    fmt.Errorf("gorpc.Client: [%s]. Server error: [%s]", c.Addr, wr.Error),
@@ -892,8 +1139,10 @@ func clientReader(c *Client, r io.Reader, pendingRequests map[uint64]*AsyncResul
 			wr.Error = ""
 		}
 
+		dt := time.Since(m.t)
 		c.Stats.incRPCCalls()
-		c.Stats.incRPCTime(uint64(time.Since(m.t).Seconds() * 1000))
+		c.Stats.incRPCTime(uint64(dt.Microseconds()))
+		c.serviceStats.record(m.request.Service, dt, m.Error != nil)
 
 		close(m.done)
 	}
@@ -16,6 +16,10 @@ const (
 	// DefaultRequestTimeout is the default timeout for client request.
 	DefaultRequestTimeout = 20 * time.Second
 
+	// DefaultHandshakeTimeout is the default time the client waits
+	// for the server to complete the handshake.
+	DefaultHandshakeTimeout = 5 * time.Second
+
 	// DefaultPendingMessages is the default number of pending messages
 	// handled by Client and Server.
 	DefaultPendingMessages = 32 * 1024
@@ -26,6 +30,18 @@ const (
 
 	// DefaultBufferSize is the default size for Client and Server buffers.
 	DefaultBufferSize = 64 * 1024
+
+	// DefaultMaxHeaderSize is the default limit for the size of headers
+	// accepted by Client and Server.
+	DefaultMaxHeaderSize = 64 * 1024
+
+	// DefaultMaxBodySize is the default limit for the size of bodies
+	// accepted by Client and Server.
+	DefaultMaxBodySize = 64 * 1024 * 1024
+
+	// DefaultMaxErrorSize is the default limit for the size of error
+	// messages accepted by Client.
+	DefaultMaxErrorSize = 64 * 1024
 )
 
 // OnConnectFunc is a callback, which may be called by both Client and Server
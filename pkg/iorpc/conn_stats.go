@@ -14,7 +14,7 @@ type ConnStats struct {
 	// The number of rpc calls performed.
 	RPCCalls uint64
 
-	// The total aggregate time for all rpc calls in milliseconds.
+	// The total aggregate time for all rpc calls in microseconds.
 	//
 	// This time can be used for calculating the average response time
 	// per RPC:
@@ -57,6 +57,19 @@ type ConnStats struct {
 	// The number of Accept() errors.
 	AcceptErrors uint64
 
+	// The number of calls repeated by Client.Retry.
+	Retries uint64
+
+	// The number of hedged copies sent by Client.Hedge.
+	Hedges uint64
+
+	// The number of hedged copies answered before the original call.
+	HedgeWins uint64
+
+	// The number of requests rejected by the server as busy,
+	// see Server.QueueTimeout.
+	Rejected uint64
+
 	// lock is for 386 builds. See https://github.com/valyala/gorpc/issues/5 .
 	lock sync.Mutex
 }
@@ -66,7 +79,7 @@ type ConnStats struct {
 // Use stats returned from ConnStats.Snapshot() on live Client and / or Server,
 // since the original stats can be updated by concurrently running goroutines.
 func (cs *ConnStats) AvgRPCTime() time.Duration {
-	return time.Duration(float64(cs.RPCTime)/float64(cs.RPCCalls)) * time.Millisecond
+	return time.Duration(float64(cs.RPCTime)/float64(cs.RPCCalls)) * time.Microsecond
 }
 
 // AvgRPCBytes returns the average bytes sent / received per RPC.
@@ -100,3 +113,62 @@ func (cs *ConnStats) AvgRPCBodyBytes() (send float64, recv float64) {
 func (cs *ConnStats) AvgRPCCalls() (write float64, read float64) {
 	return float64(cs.WriteCalls) / float64(cs.RPCCalls), float64(cs.ReadCalls) / float64(cs.RPCCalls)
 }
+
+// connStats is the statistics updated by messageEncoder and messageDecoder.
+type connStats interface {
+	addHeadWritten(n uint64)
+	addHeadRead(n uint64)
+	addBodyWritten(n uint64)
+	addBodyRead(n uint64)
+	incReadCalls()
+	incReadErrors()
+	incWriteCalls()
+	incWriteErrors()
+}
+
+// connStatsTee updates the stats of a single connection along with
+// the aggregate stats of the Server.
+type connStatsTee struct {
+	conn  *ConnStats
+	total *ConnStats
+}
+
+func (t connStatsTee) addHeadWritten(n uint64) {
+	t.conn.addHeadWritten(n)
+	t.total.addHeadWritten(n)
+}
+
+func (t connStatsTee) addHeadRead(n uint64) {
+	t.conn.addHeadRead(n)
+	t.total.addHeadRead(n)
+}
+
+func (t connStatsTee) addBodyWritten(n uint64) {
+	t.conn.addBodyWritten(n)
+	t.total.addBodyWritten(n)
+}
+
+func (t connStatsTee) addBodyRead(n uint64) {
+	t.conn.addBodyRead(n)
+	t.total.addBodyRead(n)
+}
+
+func (t connStatsTee) incReadCalls() {
+	t.conn.incReadCalls()
+	t.total.incReadCalls()
+}
+
+func (t connStatsTee) incReadErrors() {
+	t.conn.incReadErrors()
+	t.total.incReadErrors()
+}
+
+func (t connStatsTee) incWriteCalls() {
+	t.conn.incWriteCalls()
+	t.total.incWriteCalls()
+}
+
+func (t connStatsTee) incWriteErrors() {
+	t.conn.incWriteErrors()
+	t.total.incWriteErrors()
+}
@@ -28,8 +28,10 @@ func (cs *ConnStats) Reset() {
 	cs.lock.Lock()
 	cs.RPCCalls = 0
 	cs.RPCTime = 0
-	cs.BytesWritten = 0
-	cs.BytesRead = 0
+	cs.HeadWritten = 0
+	cs.BodyWritten = 0
+	cs.HeadRead = 0
+	cs.BodyRead = 0
 	cs.WriteCalls = 0
 	cs.WriteErrors = 0
 	cs.ReadCalls = 0
@@ -38,6 +40,10 @@ func (cs *ConnStats) Reset() {
 	cs.DialErrors = 0
 	cs.AcceptCalls = 0
 	cs.AcceptErrors = 0
+	cs.Retries = 0
+	cs.Hedges = 0
+	cs.HedgeWins = 0
+	cs.Rejected = 0
 	cs.lock.Unlock()
 }
 
@@ -53,15 +59,27 @@ func (cs *ConnStats) incRPCTime(dt uint64) {
 	cs.lock.Unlock()
 }
 
-func (cs *ConnStats) addBytesWritten(n uint64) {
+func (cs *ConnStats) addHeadWritten(n uint64) {
 	cs.lock.Lock()
-	cs.BytesWritten += n
+	cs.HeadWritten += n
 	cs.lock.Unlock()
 }
 
-func (cs *ConnStats) addBytesRead(n uint64) {
+func (cs *ConnStats) addHeadRead(n uint64) {
 	cs.lock.Lock()
-	cs.BytesRead += n
+	cs.HeadRead += n
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) addBodyWritten(n uint64) {
+	cs.lock.Lock()
+	cs.BodyWritten += n
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) addBodyRead(n uint64) {
+	cs.lock.Lock()
+	cs.BodyRead += n
 	cs.lock.Unlock()
 }
 
@@ -112,3 +130,27 @@ func (cs *ConnStats) incAcceptErrors() {
 	cs.AcceptErrors++
 	cs.lock.Unlock()
 }
+
+func (cs *ConnStats) incRetries() {
+	cs.lock.Lock()
+	cs.Retries++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incHedges() {
+	cs.lock.Lock()
+	cs.Hedges++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incHedgeWins() {
+	cs.lock.Lock()
+	cs.HedgeWins++
+	cs.lock.Unlock()
+}
+
+func (cs *ConnStats) incRejected() {
+	cs.lock.Lock()
+	cs.Rejected++
+	cs.lock.Unlock()
+}
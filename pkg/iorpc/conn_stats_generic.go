@@ -27,6 +27,10 @@ func (cs *ConnStats) Snapshot() *ConnStats {
 		DialErrors:   atomic.LoadUint64(&cs.DialErrors),
 		AcceptCalls:  atomic.LoadUint64(&cs.AcceptCalls),
 		AcceptErrors: atomic.LoadUint64(&cs.AcceptErrors),
+		Retries:      atomic.LoadUint64(&cs.Retries),
+		Hedges:       atomic.LoadUint64(&cs.Hedges),
+		HedgeWins:    atomic.LoadUint64(&cs.HedgeWins),
+		Rejected:     atomic.LoadUint64(&cs.Rejected),
 	}
 }
 
@@ -46,6 +50,10 @@ func (cs *ConnStats) Reset() {
 	atomic.StoreUint64(&cs.DialErrors, 0)
 	atomic.StoreUint64(&cs.AcceptCalls, 0)
 	atomic.StoreUint64(&cs.AcceptErrors, 0)
+	atomic.StoreUint64(&cs.Retries, 0)
+	atomic.StoreUint64(&cs.Hedges, 0)
+	atomic.StoreUint64(&cs.HedgeWins, 0)
+	atomic.StoreUint64(&cs.Rejected, 0)
 }
 
 func (cs *ConnStats) incRPCCalls() {
@@ -103,3 +111,19 @@ func (cs *ConnStats) incAcceptCalls() {
 func (cs *ConnStats) incAcceptErrors() {
 	atomic.AddUint64(&cs.AcceptErrors, 1)
 }
+
+func (cs *ConnStats) incRetries() {
+	atomic.AddUint64(&cs.Retries, 1)
+}
+
+func (cs *ConnStats) incHedges() {
+	atomic.AddUint64(&cs.Hedges, 1)
+}
+
+func (cs *ConnStats) incHedgeWins() {
+	atomic.AddUint64(&cs.HedgeWins, 1)
+}
+
+func (cs *ConnStats) incRejected() {
+	atomic.AddUint64(&cs.Rejected, 1)
+}
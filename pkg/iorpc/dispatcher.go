@@ -1,6 +1,9 @@
 package iorpc
 
-import "errors"
+import (
+	"errors"
+	"time"
+)
 
 var ErrUnknownService = errors.New("unknown service")
 
@@ -8,14 +11,26 @@ type Service uint32
 
 type Dispatcher struct {
 	services       []HandlerFunc
+	serviceNames   []string
 	serviceNameMap map[string]Service
+	interceptors   []UnaryServerInterceptor
 }
 
-func NewDispatcher() *Dispatcher {
-	return &Dispatcher{
+// NewDispatcher creates a dispatcher.
+//
+// Interceptors may be installed via UnaryInterceptor and ChainUnaryInterceptor
+// options, similar to grpc.NewServer:
+//
+//	d := iorpc.NewDispatcher(iorpc.ChainUnaryInterceptor(auth, metrics))
+func NewDispatcher(opts ...DispatcherOption) *Dispatcher {
+	d := &Dispatcher{
 		services:       make([]HandlerFunc, 0),
 		serviceNameMap: make(map[string]Service),
 	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
 }
 
 func (d *Dispatcher) AddService(name string, handler HandlerFunc) (srv Service, conflict bool) {
@@ -26,6 +41,7 @@ func (d *Dispatcher) AddService(name string, handler HandlerFunc) (srv Service,
 	srv = Service(len(d.services))
 	d.serviceNameMap[name] = srv
 	d.services = append(d.services, handler)
+	d.serviceNames = append(d.serviceNames, name)
 	return srv, false
 }
 
@@ -42,12 +58,41 @@ func (d *Dispatcher) MustGetService(name string) Service {
 	return svc
 }
 
+// Services returns the name->id table of the registered services.
+//
+// Assign it to Server.Services, so clients may resolve services by name
+// via Client.Service instead of relying on the registration order.
+func (d *Dispatcher) Services() map[string]Service {
+	services := make(map[string]Service, len(d.serviceNameMap))
+	for name, svc := range d.serviceNameMap {
+		services[name] = svc
+	}
+	return services
+}
+
 func (d *Dispatcher) HandlerFunc() HandlerFunc {
+	interceptor := chainServerInterceptors(d.interceptors)
+	if interceptor == nil {
+		return func(clientAddr string, request Request) (response *Response, err error) {
+			service := request.Service
+			if int(service) >= len(d.services) {
+				return nil, ErrUnknownService
+			}
+			return d.services[service](clientAddr, request)
+		}
+	}
+
 	return func(clientAddr string, request Request) (response *Response, err error) {
 		service := request.Service
 		if int(service) >= len(d.services) {
 			return nil, ErrUnknownService
 		}
-		return d.services[service](clientAddr, request)
+		info := &UnaryServerInfo{
+			Service:     service,
+			ServiceName: d.serviceNames[service],
+			ClientAddr:  clientAddr,
+			Start:       time.Now(),
+		}
+		return interceptor(info, request, d.services[service])
 	}
 }
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
-	"reflect"
 
 	"github.com/pkg/errors"
 )
@@ -13,36 +12,16 @@ const (
 	headerBufferSize = 4 << 10
 )
 
+// responseBusy flags the ErrorSize of the responses to the requests rejected
+// by the server, see Server.QueueTimeout. Clients turn them into
+// a ClientError with Busy set.
+const responseBusy = 1 << 31
+
 var (
 	requestStartLineSize  = binary.Size(requestStartLine{})
 	responseStartLineSize = binary.Size(responseStartLine{})
-
-	// headersConstructors[0] should be nil
-	headersConstructors = make([]func() Headers, 1)
-	headersIndexes      = make(map[reflect.Type]uint32)
 )
 
-func RegisterHeaders(constructor func() Headers) {
-	h := constructor()
-	headersIndexes[reflect.TypeOf(h)] = uint32(len(headersConstructors))
-	headersConstructors = append(headersConstructors, constructor)
-}
-
-func newHeaders(index uint32) Headers {
-	constructor := headersConstructors[index]
-	if constructor == nil {
-		return nil
-	}
-	return constructor()
-}
-
-func indexHeaders(h Headers) uint32 {
-	if h == nil {
-		return 0
-	}
-	return headersIndexes[reflect.TypeOf(h)]
-}
-
 type requestStartLine struct {
 	Service                Service
 	HeaderType, HeaderSize uint32
@@ -67,12 +46,14 @@ type wireResponse struct {
 	Headers Headers
 	Body    Body
 	Error   string
+	Busy    bool
 }
 
 type messageEncoder struct {
 	w            io.Writer
 	headerBuffer Buffer
-	stat         *ConnStats
+	headers      *HeadersRegistry
+	stat         connStats
 }
 
 func (e *messageEncoder) Close() error {
@@ -132,8 +113,11 @@ func (e *messageEncoder) encodeRequestHeaders(req wireRequest) error {
 	startLineBuf := e.headerBuffer.Bytes()[startLineIndex:startLineIndex]
 
 	headerSize := 0
-	headerIndex := indexHeaders(req.Headers)
-	if req.Headers != nil && headerIndex != 0 {
+	headerIndex, err := e.headers.indexHeaders(req.Headers)
+	if err != nil {
+		return errors.Wrap(err, "encode headers")
+	}
+	if headerIndex != 0 {
 		if headerSize, err = req.Headers.Encode(e.headerBuffer); err != nil {
 			return errors.Wrap(err, "encode headers")
 		}
@@ -178,18 +162,25 @@ func (e *messageEncoder) encodeResponseHeaders(resp wireResponse) error {
 	startLineBuf := e.headerBuffer.Bytes()[startLineIndex:startLineIndex]
 
 	headerSize := 0
-	headerIndex := indexHeaders(resp.Headers)
-	if resp.Headers != nil && headerIndex != 0 {
+	headerIndex, err := e.headers.indexHeaders(resp.Headers)
+	if err != nil {
+		return errors.Wrap(err, "encode headers")
+	}
+	if headerIndex != 0 {
 		if headerSize, err = resp.Headers.Encode(e.headerBuffer); err != nil {
 			return errors.Wrap(err, "encode headers")
 		}
 	}
 
 	respErr := []byte(resp.Error)
+	errorSize := uint32(len(respErr))
+	if resp.Busy {
+		errorSize |= responseBusy
+	}
 
 	if err := binary.Write(bytes.NewBuffer(startLineBuf), binary.BigEndian, responseStartLine{
 		ID:         resp.ID,
-		ErrorSize:  uint32(len(respErr)),
+		ErrorSize:  errorSize,
 		HeaderType: headerIndex,
 		HeaderSize: uint32(headerSize),
 		BodySize:   resp.Body.Size,
@@ -227,19 +218,44 @@ func (e *messageEncoder) EncodeResponse(resp wireResponse) error {
 	return e.encode(&resp.Body)
 }
 
-func newMessageEncoder(w io.Writer, s *ConnStats) *messageEncoder {
+func newMessageEncoder(w io.Writer, s connStats, headers *HeadersRegistry) *messageEncoder {
 	return &messageEncoder{
 		w:            w,
 		headerBuffer: bufferAllocator(headerBufferSize),
+		headers:      headers,
 		stat:         s,
 	}
 }
 
+// ErrMessageTooLarge is returned when the peer sends a message
+// exceeding the configured size limits.
+var ErrMessageTooLarge = errors.New("message too large")
+
+// messageLimits bounds the sizes the decoder trusts from the wire.
+type messageLimits struct {
+	headerSize, bodySize, errorSize uint64
+}
+
+var defaultMessageLimits = messageLimits{
+	headerSize: DefaultMaxHeaderSize,
+	bodySize:   DefaultMaxBodySize,
+	errorSize:  DefaultMaxErrorSize,
+}
+
+func (l messageLimits) check(what string, size, limit uint64) error {
+	if size > limit {
+		return errors.Wrapf(ErrMessageTooLarge, "%s size %d exceeds %d", what, size, limit)
+	}
+	return nil
+}
+
 type messageDecoder struct {
 	closeBody    bool
 	r            io.Reader
 	headerBuffer *ringBuffer
-	stat         *ConnStats
+	headers      *HeadersRegistry
+	limits       messageLimits
+	stat         connStats
 }
 
 func (d *messageDecoder) Close() error {
@@ -287,6 +303,52 @@ func (d *messageDecoder) decodeBody(size int64) (body io.ReadCloser, err error)
 	return
 }
 
+func (d *messageDecoder) decodeHeaders(headerType, size uint32) (headers Headers, err error) {
+	if err = d.limits.check("headers", uint64(size), d.limits.headerSize); err != nil {
+		d.stat.incReadErrors()
+		return nil, err
+	}
+
+	headers, err = d.headers.newHeaders(headerType)
+	if err != nil {
+		d.stat.incReadErrors()
+		return nil, errors.Wrap(err, "decode headers")
+	}
+	if headers == nil {
+		if size > 0 {
+			d.stat.incReadErrors()
+			return nil, errors.Errorf("decode headers: %d bytes of headers without type", size)
+		}
+		return nil, nil
+	}
+	if size == 0 {
+		return headers, nil
+	}
+
+	if _, err := io.CopyN(d.headerBuffer, d.r, int64(size)); err != nil {
+		d.stat.incReadErrors()
+		return nil, errors.Wrapf(err, "read headers: size(%d)", size)
+	}
+	d.stat.addHeadRead(uint64(size))
+	buf, _ := d.headerBuffer.TrySlice(int64(size))
+	if err := decodeHeadersSafe(headers, buf); err != nil {
+		d.stat.incReadErrors()
+		return nil, errors.Wrap(err, "decode headers")
+	}
+	return headers, nil
+}
+
+// decodeHeadersSafe converts panics of Headers.Decode on malformed input
+// into errors.
+func decodeHeadersSafe(headers Headers, buf []byte) (err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			err = errors.Errorf("panic: %v", x)
+		}
+	}()
+	return headers.Decode(buf)
+}
+
 func (d *messageDecoder) DecodeRequest(req *wireRequest) error {
 	var startLine requestStartLine
 	if err := binary.Read(d.r, binary.BigEndian, &startLine); err != nil {
@@ -298,19 +360,16 @@ func (d *messageDecoder) DecodeRequest(req *wireRequest) error {
 	req.ID = startLine.ID
 	req.Service = startLine.Service
 	req.Body.Size = startLine.BodySize
+	if err := d.limits.check("body", req.Body.Size, d.limits.bodySize); err != nil {
+		d.stat.incReadErrors()
+		return err
+	}
 
-	if req.Headers = newHeaders(startLine.HeaderType); req.Headers != nil && startLine.HeaderSize > 0 {
-		if _, err := io.CopyN(d.headerBuffer, d.r, int64(startLine.HeaderSize)); err != nil {
-			d.stat.incReadErrors()
-			return err
-		}
-		d.stat.addHeadRead(uint64(startLine.HeaderSize))
-		buf, _ := d.headerBuffer.TrySlice(int64(startLine.HeaderSize))
-		if err := req.Headers.Decode(buf); err != nil {
-			d.stat.incReadErrors()
-			return err
-		}
+	headers, err := d.decodeHeaders(startLine.HeaderType, startLine.HeaderSize)
+	if err != nil {
+		return err
 	}
+	req.Headers = headers
 
 	buf, err := d.decodeBody(int64(req.Body.Size))
 	if err != nil {
@@ -331,6 +390,16 @@ func (d *messageDecoder) DecodeResponse(resp *wireResponse) error {
 
 	resp.ID = startLine.ID
 	resp.Body.Size = startLine.BodySize
+	resp.Busy = startLine.ErrorSize&responseBusy != 0
+	startLine.ErrorSize &^= responseBusy
+	if err := d.limits.check("body", resp.Body.Size, d.limits.bodySize); err != nil {
+		d.stat.incReadErrors()
+		return err
+	}
+	if err := d.limits.check("error", uint64(startLine.ErrorSize), d.limits.errorSize); err != nil {
+		d.stat.incReadErrors()
+		return err
+	}
 
 	if startLine.ErrorSize > 0 {
 		respErr := make([]byte, startLine.ErrorSize)
@@ -342,18 +411,11 @@ func (d *messageDecoder) DecodeResponse(resp *wireResponse) error {
 		resp.Error = string(respErr)
 	}
 
-	if resp.Headers = newHeaders(startLine.HeaderType); resp.Headers != nil && startLine.HeaderSize > 0 {
-		if _, err := io.CopyN(d.headerBuffer, d.r, int64(startLine.HeaderSize)); err != nil {
-			d.stat.incReadErrors()
-			return errors.Wrapf(err, "read response headers: size(%d)", startLine.HeaderSize)
-		}
-		d.stat.addHeadRead(uint64(startLine.HeaderSize))
-		buf, _ := d.headerBuffer.TrySlice(int64(startLine.HeaderSize))
-		if err := resp.Headers.Decode(buf); err != nil {
-			d.stat.incReadErrors()
-			return err
-		}
+	headers, err := d.decodeHeaders(startLine.HeaderType, startLine.HeaderSize)
+	if err != nil {
+		return err
 	}
+	resp.Headers = headers
 
 	buf, err := d.decodeBody(int64(resp.Body.Size))
 	if err != nil {
@@ -364,10 +426,12 @@ func (d *messageDecoder) DecodeResponse(resp *wireResponse) error {
 	return nil
 }
 
-func newMessageDecoder(r io.Reader, s *ConnStats, closeBody bool) *messageDecoder {
+func newMessageDecoder(r io.Reader, s connStats, headers *HeadersRegistry, limits messageLimits, closeBody bool) *messageDecoder {
 	return &messageDecoder{
 		r:            r,
 		headerBuffer: newRingBuffer(headerBufferSize),
+		headers:      headers,
+		limits:       limits,
 		stat:         s,
 		closeBody:    closeBody,
 	}
@@ -0,0 +1,114 @@
+package iorpc
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var fuzzLimits = messageLimits{
+	headerSize: 1 << 10,
+	bodySize:   1 << 16,
+	errorSize:  1 << 10,
+}
+
+func fuzzRegistry() *HeadersRegistry {
+	r := NewHeadersRegistry()
+	r.MustRegister(1, func() Headers { return new(keyHeaders) })
+	return r
+}
+
+func encodeSeed(t testing.TB, f func(e *messageEncoder) error) []byte {
+	var stats ConnStats
+	var buf bytes.Buffer
+	e := newMessageEncoder(&buf, &stats, fuzzRegistry())
+	if err := f(e); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+func FuzzDecodeRequest(f *testing.F) {
+	f.Add(encodeSeed(f, func(e *messageEncoder) error {
+		return e.EncodeRequest(wireRequest{ID: 1, Service: 2, Headers: &keyHeaders{Key: 3}})
+	}))
+	f.Add(encodeSeed(f, func(e *messageEncoder) error {
+		body := bodyBuffer{data: []byte("hello")}
+		return e.EncodeRequest(wireRequest{ID: 1, Body: Body{Size: 5, Reader: &body}})
+	}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var stats ConnStats
+		d := newMessageDecoder(bytes.NewReader(data), &stats, fuzzRegistry(), fuzzLimits, false)
+		defer d.Close()
+		for {
+			var req wireRequest
+			if err := d.DecodeRequest(&req); err != nil {
+				return
+			}
+			req.Body.Close()
+		}
+	})
+}
+
+func FuzzDecodeResponse(f *testing.F) {
+	f.Add(encodeSeed(f, func(e *messageEncoder) error {
+		return e.EncodeResponse(wireResponse{ID: 1, Headers: &keyHeaders{Key: 3}})
+	}))
+	f.Add(encodeSeed(f, func(e *messageEncoder) error {
+		return e.EncodeResponse(wireResponse{ID: 1, Error: "failure"})
+	}))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var stats ConnStats
+		d := newMessageDecoder(bytes.NewReader(data), &stats, fuzzRegistry(), fuzzLimits, false)
+		defer d.Close()
+		for {
+			var resp wireResponse
+			if err := d.DecodeResponse(&resp); err != nil {
+				return
+			}
+			resp.Body.Close()
+		}
+	})
+}
+
+func TestDecodeOversizedMessage(t *testing.T) {
+	a := assert.New(t)
+
+	data := encodeSeed(t, func(e *messageEncoder) error {
+		body := bodyBuffer{data: make([]byte, 2<<16)}
+		return e.EncodeRequest(wireRequest{ID: 1, Body: Body{Size: 2 << 16, Reader: &body}})
+	})
+	var stats ConnStats
+	var req wireRequest
+	d := newMessageDecoder(bytes.NewReader(data), &stats, fuzzRegistry(), fuzzLimits, false)
+	a.True(errors.Is(d.DecodeRequest(&req), ErrMessageTooLarge))
+
+	data = encodeSeed(t, func(e *messageEncoder) error {
+		return e.EncodeResponse(wireResponse{ID: 1, Error: string(make([]byte, 2<<10))})
+	})
+	var resp wireResponse
+	d = newMessageDecoder(bytes.NewReader(data), &stats, fuzzRegistry(), fuzzLimits, false)
+	a.True(errors.Is(d.DecodeResponse(&resp), ErrMessageTooLarge))
+}
+
+func TestDecodeMalformedHeaders(t *testing.T) {
+	data := encodeSeed(t, func(e *messageEncoder) error {
+		return e.EncodeRequest(wireRequest{ID: 1, Headers: &keyHeaders{Key: 3}})
+	})
+	// Truncate the header size in the start line from 8 to 4 bytes,
+	// so keyHeaders.Decode sees a short buffer.
+	data[11] = 4
+	var stats ConnStats
+	var req wireRequest
+	d := newMessageDecoder(bytes.NewReader(data), &stats, fuzzRegistry(), fuzzLimits, false)
+	assert.NotNil(t, d.DecodeRequest(&req))
+}
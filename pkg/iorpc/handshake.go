@@ -0,0 +1,95 @@
+package iorpc
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Flags of the handshake byte sent by the client right after connecting.
+const (
+	handshakeCompression  = 1 << 0
+	handshakeServiceTable = 1 << 1
+)
+
+// maxServiceTableSize and maxServiceTableBytes limit the number of the
+// advertised services and the size of the table, so a broken server
+// cannot make the client allocate arbitrary amounts of memory.
+const (
+	maxServiceTableSize  = 64 << 10
+	maxServiceTableBytes = 1 << 20
+)
+
+type serviceTable struct {
+	ids   map[string]Service
+	names map[Service]string
+}
+
+func newServiceTable(ids map[string]Service) *serviceTable {
+	t := &serviceTable{
+		ids:   ids,
+		names: make(map[Service]string, len(ids)),
+	}
+	for name, svc := range ids {
+		t.names[svc] = name
+	}
+	return t
+}
+
+// writeServiceTable writes the table as
+//
+//	count uint32, count * (nameLen uint16, name, id uint32)
+func writeServiceTable(w io.Writer, services map[string]Service) error {
+	size := 4
+	for name := range services {
+		size += 2 + len(name) + 4
+	}
+	if len(services) > maxServiceTableSize || size > maxServiceTableBytes {
+		return errors.Errorf("service table is too large: %d services in %d bytes", len(services), size)
+	}
+	buf := make([]byte, 0, size)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(services)))
+	for name, svc := range services {
+		if len(name) > 0xFFFF {
+			return errors.Errorf("service name is too long: %d", len(name))
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(name)))
+		buf = append(buf, name...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(svc))
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func readServiceTable(r io.Reader) (map[string]Service, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, errors.Wrap(err, "read service count")
+	}
+	count := binary.BigEndian.Uint32(head[:])
+	if count > maxServiceTableSize {
+		return nil, errors.Errorf("too many services advertised: %d", count)
+	}
+
+	services := make(map[string]Service, count)
+	size := 4
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(r, head[:2]); err != nil {
+			return nil, errors.Wrap(err, "read service name size")
+		}
+		nameLen := int(binary.BigEndian.Uint16(head[:2]))
+		if size += 2 + nameLen + 4; size > maxServiceTableBytes {
+			return nil, errors.Errorf("service table is too large: over %d bytes", maxServiceTableBytes)
+		}
+		name := make([]byte, nameLen)
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, errors.Wrap(err, "read service name")
+		}
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return nil, errors.Wrap(err, "read service id")
+		}
+		services[string(name)] = Service(binary.BigEndian.Uint32(head[:]))
+	}
+	return services, nil
+}
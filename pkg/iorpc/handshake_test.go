@@ -0,0 +1,133 @@
+package iorpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceTableRoundTrip(t *testing.T) {
+	a := assert.New(t)
+
+	services := map[string]Service{"Noop": 0, "ReadData": 1, "ReadMemory": 7}
+	var buf bytes.Buffer
+	a.Nil(writeServiceTable(&buf, services))
+
+	got, err := readServiceTable(&buf)
+	a.Nil(err)
+	a.Equal(services, got)
+
+	_, err = readServiceTable(bytes.NewReader([]byte{0, 0, 0, 1, 0, 4, 'N'}))
+	a.NotNil(err)
+}
+
+func TestServiceTableTooLarge(t *testing.T) {
+	a := assert.New(t)
+
+	// The names fit the entry count but not the table size.
+	services := make(map[string]Service)
+	for i := 0; i < 20; i++ {
+		services[strings.Repeat(string(rune('a'+i)), 1<<16-1)] = Service(i)
+	}
+	a.NotNil(writeServiceTable(io.Discard, services))
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(services)))
+	for name, svc := range services {
+		binary.Write(&buf, binary.BigEndian, uint16(len(name)))
+		buf.WriteString(name)
+		binary.Write(&buf, binary.BigEndian, uint32(svc))
+	}
+	_, err := readServiceTable(&buf)
+	a.NotNil(err)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer ln.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			// An older server reads the handshake and never sends
+			// the service table.
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	c := NewTCPClient(ln.Addr().String())
+	c.HandshakeTimeout = 50 * time.Millisecond
+	c.Start()
+	defer c.Stop()
+
+	// The client gives up on the handshake and redials.
+	a.Eventually(func() bool { return accepted.Load() >= 2 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestClientServiceByName(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	d := NewDispatcher()
+	d.AddService("First", func(clientAddr string, request Request) (*Response, error) {
+		return &Response{}, nil
+	})
+	d.AddService("Second", func(clientAddr string, request Request) (*Response, error) {
+		return &Response{Body: Body{Size: 2, Reader: &bodyBuffer{data: []byte("ok")}}}, nil
+	})
+
+	s := NewTCPServer("127.0.0.1:0", d.HandlerFunc())
+	s.Services = d.Services()
+	a.Nil(s.Listener.Init(s.Addr))
+	a.Nil(s.Start())
+	defer s.Stop()
+
+	c := NewTCPClient(s.Listener.ListenAddr().String())
+	c.Start()
+	defer c.Stop()
+
+	svc, err := c.Service("Second")
+	a.Nil(err)
+	a.Equal(Service(1), svc)
+
+	resp, err := c.Call(Request{Service: svc})
+	a.Nil(err)
+	a.Equal(uint64(2), resp.Body.Size)
+	resp.Body.Close()
+
+	_, err = c.Service("Missing")
+	a.True(errors.Is(err, ErrUnknownService))
+}
+
+type bodyBuffer struct {
+	data []byte
+}
+
+func (b *bodyBuffer) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *bodyBuffer) Close() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package iorpc
+
+import (
+	"reflect"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownHeaders is returned when headers are encoded or decoded
+// with a type or an id missing in the HeadersRegistry.
+var ErrUnknownHeaders = errors.New("unknown headers")
+
+// HeadersRegistry maps Headers implementations to the ids sent on the wire.
+//
+// The ids are chosen explicitly on registration, so they don't depend
+// on the registration order and stay stable across builds.
+// Both ends of a connection must register the same headers under the same ids.
+//
+// It is safe calling HeadersRegistry methods from concurrently running
+// goroutines.
+type HeadersRegistry struct {
+	mu           sync.RWMutex
+	constructors map[uint32]func() Headers
+	ids          map[reflect.Type]uint32
+}
+
+// NewHeadersRegistry creates an empty registry.
+func NewHeadersRegistry() *HeadersRegistry {
+	return &HeadersRegistry{
+		constructors: make(map[uint32]func() Headers),
+		ids:          make(map[reflect.Type]uint32),
+	}
+}
+
+// Register registers headers created by the constructor under the given id.
+//
+// The id 0 is reserved for requests and responses without headers.
+// Registering the same type under the same id again is a no-op,
+// while registering another type under a taken id or the same type
+// under another id returns an error.
+func (r *HeadersRegistry) Register(id uint32, constructor func() Headers) error {
+	if id == 0 {
+		return errors.New("headers id 0 is reserved")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.register(id, constructor)
+}
+
+func (r *HeadersRegistry) register(id uint32, constructor func() Headers) error {
+	typ := reflect.TypeOf(constructor())
+	if registered, ok := r.ids[typ]; ok {
+		if registered != id {
+			return errors.Errorf("headers %s are already registered with id %d", typ, registered)
+		}
+		return nil
+	}
+	if _, ok := r.constructors[id]; ok {
+		return errors.Errorf("headers id %d is already taken", id)
+	}
+	r.constructors[id] = constructor
+	r.ids[typ] = id
+	return nil
+}
+
+// MustRegister is like Register, but panics on error.
+func (r *HeadersRegistry) MustRegister(id uint32, constructor func() Headers) {
+	if err := r.Register(id, constructor); err != nil {
+		panic(err)
+	}
+}
+
+func (r *HeadersRegistry) clone() *HeadersRegistry {
+	c := NewHeadersRegistry()
+	r.mu.RLock()
+	for id, constructor := range r.constructors {
+		c.constructors[id] = constructor
+	}
+	for typ, id := range r.ids {
+		c.ids[typ] = id
+	}
+	r.mu.RUnlock()
+	return c
+}
+
+func (r *HeadersRegistry) nextID() uint32 {
+	id := uint32(1)
+	for {
+		if _, ok := r.constructors[id]; !ok {
+			return id
+		}
+		id++
+	}
+}
+
+// newHeaders creates headers registered under the id.
+// It returns nil headers for id 0.
+func (r *HeadersRegistry) newHeaders(id uint32) (Headers, error) {
+	if id == 0 {
+		return nil, nil
+	}
+	r.mu.RLock()
+	constructor := r.constructors[id]
+	r.mu.RUnlock()
+	if constructor == nil {
+		return nil, errors.Wrapf(ErrUnknownHeaders, "id %d", id)
+	}
+	return constructor(), nil
+}
+
+// indexHeaders returns the id registered for the type of h.
+// It returns 0 for nil headers.
+func (r *HeadersRegistry) indexHeaders(h Headers) (uint32, error) {
+	if h == nil {
+		return 0, nil
+	}
+	typ := reflect.TypeOf(h)
+	r.mu.RLock()
+	id, ok := r.ids[typ]
+	r.mu.RUnlock()
+	if !ok {
+		return 0, errors.Wrapf(ErrUnknownHeaders, "type %s", typ)
+	}
+	return id, nil
+}
+
+var globalHeaders = NewHeadersRegistry()
+
+// RegisterHeaders registers headers in the process-global registry
+// under the next free id.
+//
+// Clients and servers without HeadersRegistry use a copy of the global
+// registry taken on start. Registering the same type again is a no-op.
+//
+// Deprecated: the ids depend on the registration order. Use HeadersRegistry
+// with explicit ids and assign it to Client.HeadersRegistry and
+// Server.HeadersRegistry instead.
+func RegisterHeaders(constructor func() Headers) {
+	globalHeaders.mu.Lock()
+	defer globalHeaders.mu.Unlock()
+	if _, ok := globalHeaders.ids[reflect.TypeOf(constructor())]; ok {
+		return
+	}
+	if err := globalHeaders.register(globalHeaders.nextID(), constructor); err != nil {
+		panic(err)
+	}
+}
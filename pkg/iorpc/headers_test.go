@@ -0,0 +1,96 @@
+package iorpc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type keyHeaders struct {
+	Key uint64
+}
+
+func (h *keyHeaders) Encode(w io.Writer) (int, error) {
+	return 8, binary.Write(w, binary.BigEndian, h.Key)
+}
+
+func (h *keyHeaders) Decode(b []byte) error {
+	if len(b) != 8 {
+		return errors.New("invalid key headers")
+	}
+	h.Key = binary.BigEndian.Uint64(b)
+	return nil
+}
+
+type otherHeaders struct {
+	keyHeaders
+}
+
+func TestHeadersRegistry(t *testing.T) {
+	a := assert.New(t)
+
+	r := NewHeadersRegistry()
+	a.NotNil(r.Register(0, func() Headers { return new(keyHeaders) }))
+	a.Nil(r.Register(7, func() Headers { return new(keyHeaders) }))
+	a.Nil(r.Register(7, func() Headers { return new(keyHeaders) }))
+	a.NotNil(r.Register(8, func() Headers { return new(keyHeaders) }))
+	a.NotNil(r.Register(7, func() Headers { return new(otherHeaders) }))
+
+	id, err := r.indexHeaders(&keyHeaders{})
+	a.Nil(err)
+	a.Equal(uint32(7), id)
+
+	_, err = r.indexHeaders(&otherHeaders{})
+	a.True(errors.Is(err, ErrUnknownHeaders))
+
+	h, err := r.newHeaders(0)
+	a.Nil(err)
+	a.Nil(h)
+
+	_, err = r.newHeaders(8)
+	a.True(errors.Is(err, ErrUnknownHeaders))
+}
+
+func TestHeadersRegistryConcurrent(t *testing.T) {
+	r := NewHeadersRegistry()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.MustRegister(1, func() Headers { return new(keyHeaders) })
+			_, _ = r.newHeaders(1)
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, r.constructors, 1)
+}
+
+func TestDecodeMismatchedHeaders(t *testing.T) {
+	a := assert.New(t)
+
+	sender := NewHeadersRegistry()
+	sender.MustRegister(1, func() Headers { return new(keyHeaders) })
+	receiver := NewHeadersRegistry()
+	receiver.MustRegister(2, func() Headers { return new(keyHeaders) })
+
+	var stats ConnStats
+	var buf bytes.Buffer
+	e := newMessageEncoder(&buf, &stats, sender)
+	a.Nil(e.EncodeRequest(wireRequest{ID: 1, Headers: &keyHeaders{Key: 42}}))
+	a.Nil(e.Flush())
+	data := append([]byte(nil), buf.Bytes()...)
+
+	var req wireRequest
+	d := newMessageDecoder(bytes.NewReader(data), &stats, receiver, defaultMessageLimits, false)
+	a.True(errors.Is(d.DecodeRequest(&req), ErrUnknownHeaders))
+
+	d = newMessageDecoder(bytes.NewReader(data), &stats, sender, defaultMessageLimits, false)
+	a.Nil(d.DecodeRequest(&req))
+	a.Equal(uint64(42), req.Headers.(*keyHeaders).Key)
+}
@@ -0,0 +1,149 @@
+package iorpc
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// UnaryServerInfo describes the call an UnaryServerInterceptor is invoked for.
+type UnaryServerInfo struct {
+	// Service is the id of the called service.
+	Service Service
+
+	// ServiceName is the name the service was registered with
+	// via Dispatcher.AddService.
+	ServiceName string
+
+	// ClientAddr is the address of the calling client.
+	ClientAddr string
+
+	// Start is the moment the dispatcher received the request.
+	// time.Since(info.Start) gives the call duration once the handler returns.
+	Start time.Time
+}
+
+// UnaryServerInterceptor intercepts every call dispatched by Dispatcher.
+//
+// The interceptor may inspect request.Headers and request.Body.Size,
+// call handler to continue the chain, or return an error without calling
+// handler to short-circuit the call. In the latter case the interceptor
+// is responsible for closing request.Body.
+type UnaryServerInterceptor func(info *UnaryServerInfo, request Request, handler HandlerFunc) (*Response, error)
+
+// UnaryClientInfo describes the call an UnaryClientInterceptor is invoked for.
+type UnaryClientInfo struct {
+	// Addr is the server address of the client.
+	Addr string
+
+	// Service is the id of the called service.
+	Service Service
+
+	// ServiceName is the name of the called service as advertised
+	// by the server. It is empty until the service table is obtained.
+	ServiceName string
+
+	// Timeout is the timeout the call has been issued with.
+	Timeout time.Duration
+}
+
+// UnaryInvoker sends the request to the server and waits for the response.
+type UnaryInvoker func(request Request, timeout time.Duration) (Response, error)
+
+// UnaryClientInterceptor intercepts every Client.Call / Client.CallTimeout.
+//
+// The interceptor may call invoker to continue the chain or return an error
+// without calling it to short-circuit the call.
+type UnaryClientInterceptor func(info *UnaryClientInfo, request Request, invoker UnaryInvoker) (Response, error)
+
+// DispatcherOption configures a Dispatcher created by NewDispatcher.
+type DispatcherOption func(d *Dispatcher)
+
+// UnaryInterceptor returns a DispatcherOption that sets the interceptor
+// for all the services of the dispatcher.
+//
+// Only one interceptor may be installed this way, the latter one overrides
+// the former. Use ChainUnaryInterceptor for multiple interceptors.
+func UnaryInterceptor(i UnaryServerInterceptor) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.interceptors = []UnaryServerInterceptor{i}
+	}
+}
+
+// ChainUnaryInterceptor returns a DispatcherOption that appends interceptors
+// to the dispatcher's chain.
+//
+// The first interceptor is the outermost one, the last interceptor
+// is the innermost wrapper around the service handler.
+func ChainUnaryInterceptor(interceptors ...UnaryServerInterceptor) DispatcherOption {
+	return func(d *Dispatcher) {
+		d.interceptors = append(d.interceptors, interceptors...)
+	}
+}
+
+func chainServerInterceptors(interceptors []UnaryServerInterceptor) UnaryServerInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(info *UnaryServerInfo, request Request, handler HandlerFunc) (*Response, error) {
+		return interceptors[0](info, request, chainedServerHandler(interceptors, 0, info, handler))
+	}
+}
+
+func chainedServerHandler(interceptors []UnaryServerInterceptor, curr int, info *UnaryServerInfo, final HandlerFunc) HandlerFunc {
+	if curr == len(interceptors)-1 {
+		return final
+	}
+	return func(clientAddr string, request Request) (*Response, error) {
+		// The outer interceptor may pass on another address.
+		next := *info
+		next.ClientAddr = clientAddr
+		return interceptors[curr+1](&next, request, chainedServerHandler(interceptors, curr+1, &next, final))
+	}
+}
+
+// ChainUnaryClientInterceptors chains the given interceptors into one,
+// which may be assigned to Client.Interceptor.
+//
+// The first interceptor is the outermost one, the last interceptor
+// is the innermost wrapper around the actual call.
+func ChainUnaryClientInterceptors(interceptors ...UnaryClientInterceptor) UnaryClientInterceptor {
+	switch len(interceptors) {
+	case 0:
+		return nil
+	case 1:
+		return interceptors[0]
+	}
+	return func(info *UnaryClientInfo, request Request, invoker UnaryInvoker) (Response, error) {
+		return interceptors[0](info, request, chainedClientInvoker(interceptors, 0, info, invoker))
+	}
+}
+
+func chainedClientInvoker(interceptors []UnaryClientInterceptor, curr int, info *UnaryClientInfo, final UnaryInvoker) UnaryInvoker {
+	if curr == len(interceptors)-1 {
+		return final
+	}
+	return func(request Request, timeout time.Duration) (Response, error) {
+		// The outer interceptor may shrink or extend the timeout.
+		next := *info
+		next.Timeout = timeout
+		return interceptors[curr+1](&next, request, chainedClientInvoker(interceptors, curr+1, &next, final))
+	}
+}
+
+// RecoveryInterceptor converts handler panics into errors returned
+// to the client instead of the generic panic message of Server.
+func RecoveryInterceptor(info *UnaryServerInfo, request Request, handler HandlerFunc) (response *Response, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			stackTrace := make([]byte, 1<<16)
+			n := runtime.Stack(stackTrace, false)
+			errorLogger("gorpc.Dispatcher: [%s]. Panic in service %q: %v\nStack trace: %s", info.ClientAddr, info.ServiceName, x, stackTrace[:n])
+			response, err = nil, fmt.Errorf("service %q panicked: %v", info.ServiceName, x)
+		}
+	}()
+	return handler(info.ClientAddr, request)
+}
@@ -0,0 +1,125 @@
+package iorpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDispatcherInterceptorChain(t *testing.T) {
+	a := assert.New(t)
+
+	var calls []string
+	record := func(name string) UnaryServerInterceptor {
+		return func(info *UnaryServerInfo, request Request, handler HandlerFunc) (*Response, error) {
+			calls = append(calls, name+":"+info.ServiceName+"@"+info.ClientAddr)
+			return handler(info.ClientAddr, request)
+		}
+	}
+
+	d := NewDispatcher(ChainUnaryInterceptor(record("outer"), record("inner")))
+	svc, _ := d.AddService("Echo", func(clientAddr string, request Request) (*Response, error) {
+		calls = append(calls, "handler")
+		return &Response{Body: Body{Size: request.Body.Size}}, nil
+	})
+
+	resp, err := d.HandlerFunc()("1.2.3.4:5", Request{Service: svc, Body: Body{Size: 42}})
+	a.Nil(err)
+	a.Equal(uint64(42), resp.Body.Size)
+	a.Equal([]string{"outer:Echo@1.2.3.4:5", "inner:Echo@1.2.3.4:5", "handler"}, calls)
+}
+
+func TestDispatcherInterceptorShortCircuit(t *testing.T) {
+	a := assert.New(t)
+
+	errDenied := errors.New("denied")
+	d := NewDispatcher(UnaryInterceptor(func(info *UnaryServerInfo, request Request, handler HandlerFunc) (*Response, error) {
+		return nil, errDenied
+	}))
+	svc, _ := d.AddService("Noop", func(clientAddr string, request Request) (*Response, error) {
+		t.Fatal("handler must not be called")
+		return nil, nil
+	})
+
+	_, err := d.HandlerFunc()("client", Request{Service: svc})
+	a.Equal(errDenied, err)
+
+	_, err = d.HandlerFunc()("client", Request{Service: svc + 1})
+	a.Equal(ErrUnknownService, err)
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	a := assert.New(t)
+
+	SetErrorLogger(NilErrorLogger)
+	d := NewDispatcher(UnaryInterceptor(RecoveryInterceptor))
+	svc, _ := d.AddService("Panic", func(clientAddr string, request Request) (*Response, error) {
+		panic("boom")
+	})
+
+	_, err := d.HandlerFunc()("client", Request{Service: svc})
+	a.EqualError(err, `service "Panic" panicked: boom`)
+}
+
+func TestClientInterceptorChain(t *testing.T) {
+	a := assert.New(t)
+
+	var calls []string
+	record := func(name string) UnaryClientInterceptor {
+		return func(info *UnaryClientInfo, request Request, invoker UnaryInvoker) (Response, error) {
+			calls = append(calls, name)
+			return invoker(request, info.Timeout)
+		}
+	}
+	interceptor := ChainUnaryClientInterceptors(record("outer"), record("inner"))
+
+	resp, err := interceptor(&UnaryClientInfo{Timeout: time.Second}, Request{}, func(request Request, timeout time.Duration) (Response, error) {
+		calls = append(calls, "invoker")
+		a.Equal(time.Second, timeout)
+		return Response{Body: Body{Size: 7}}, nil
+	})
+	a.Nil(err)
+	a.Equal(uint64(7), resp.Body.Size)
+	a.Equal([]string{"outer", "inner", "invoker"}, calls)
+}
+
+func TestClientInterceptorTimeout(t *testing.T) {
+	a := assert.New(t)
+
+	var seen []time.Duration
+	shrink := func(info *UnaryClientInfo, request Request, invoker UnaryInvoker) (Response, error) {
+		seen = append(seen, info.Timeout)
+		return invoker(request, info.Timeout/2)
+	}
+	interceptor := ChainUnaryClientInterceptors(shrink, shrink)
+
+	info := &UnaryClientInfo{Timeout: time.Second}
+	_, err := interceptor(info, Request{}, func(request Request, timeout time.Duration) (Response, error) {
+		seen = append(seen, timeout)
+		return Response{}, nil
+	})
+	a.Nil(err)
+	a.Equal([]time.Duration{time.Second, time.Second / 2, time.Second / 4}, seen)
+	a.Equal(time.Second, info.Timeout)
+}
+
+func TestDispatcherInterceptorClientAddr(t *testing.T) {
+	a := assert.New(t)
+
+	var seen []string
+	rewrite := func(info *UnaryServerInfo, request Request, handler HandlerFunc) (*Response, error) {
+		seen = append(seen, info.ClientAddr)
+		return handler("proxied-"+info.ClientAddr, request)
+	}
+	d := NewDispatcher(ChainUnaryInterceptor(rewrite, rewrite))
+	svc, _ := d.AddService("Echo", func(clientAddr string, request Request) (*Response, error) {
+		seen = append(seen, clientAddr)
+		return &Response{}, nil
+	})
+
+	_, err := d.HandlerFunc()("client", Request{Service: svc})
+	a.Nil(err)
+	a.Equal([]string{"client", "proxied-client", "proxied-proxied-client"}, seen)
+}
@@ -0,0 +1,230 @@
+package iorpc
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultIOUringEntries is the default size of the io_uring
+	// submission queue shared by the connections of IOUringTransport.
+	DefaultIOUringEntries = 1024
+
+	// DefaultIOUringRecvBufferSize is the default size of the provided
+	// buffers receives are completed into.
+	DefaultIOUringRecvBufferSize = 64 * 1024
+
+	// DefaultIOUringRecvBuffers is the default number of provided buffers.
+	DefaultIOUringRecvBuffers = 256
+
+	// DefaultIOUringZeroCopyMinSize is the default size from which buffer
+	// bodies are sent with IORING_OP_SENDMSG_ZC.
+	DefaultIOUringZeroCopyMinSize = 64 * 1024
+)
+
+// ErrIOUringClosed is returned by the connections of a closed IOUringTransport.
+var ErrIOUringClosed = errors.New("io_uring is closed")
+
+// IOUringStats counts the io_uring activity of IOUringTransport.
+//
+// Compare Enters with the number of messages to measure the syscalls
+// saved by batching.
+type IOUringStats struct {
+	// The number of io_uring_enter calls, both submitting and waiting.
+	Enters uint64
+
+	// The number of submitted operations.
+	SQEs uint64
+
+	// The number of reaped completions.
+	CQEs uint64
+
+	// The number of bodies sent with IORING_OP_SENDMSG_ZC.
+	ZeroCopySends uint64
+}
+
+// Snapshot returns the stats' snapshot.
+func (s *IOUringStats) Snapshot() IOUringStats {
+	return IOUringStats{
+		Enters:        atomic.LoadUint64(&s.Enters),
+		SQEs:          atomic.LoadUint64(&s.SQEs),
+		CQEs:          atomic.LoadUint64(&s.CQEs),
+		ZeroCopySends: atomic.LoadUint64(&s.ZeroCopySends),
+	}
+}
+
+func (s *IOUringStats) incEnters() {
+	atomic.AddUint64(&s.Enters, 1)
+}
+
+func (s *IOUringStats) incSQEs() {
+	atomic.AddUint64(&s.SQEs, 1)
+}
+
+func (s *IOUringStats) incCQEs() {
+	atomic.AddUint64(&s.CQEs, 1)
+}
+
+func (s *IOUringStats) incZeroCopySends() {
+	atomic.AddUint64(&s.ZeroCopySends, 1)
+}
+
+// IOUringTransport runs the connections of Client and Server over a shared
+// io_uring instead of the Go netpoller.
+//
+// Writes of concurrent connections are submitted together, receives complete
+// into a ring of provided buffers, pipe bodies are sent with
+// IORING_OP_SPLICE and large buffer bodies with IORING_OP_SENDMSG_ZC.
+//
+// The transport falls back to plain TCP connections when the kernel lacks
+// io_uring, see Err.
+type IOUringTransport struct {
+	// Entries is the size of the submission queue.
+	//
+	// DefaultIOUringEntries is used by default.
+	Entries uint32
+
+	// RecvBufferSize is the size of every provided receive buffer.
+	//
+	// DefaultIOUringRecvBufferSize is used by default.
+	RecvBufferSize int
+
+	// RecvBuffers is the number of provided receive buffers, a power of 2.
+	// Receives fall back to per-connection buffers on kernels without
+	// provided buffer rings.
+	//
+	// DefaultIOUringRecvBuffers is used by default.
+	RecvBuffers int
+
+	// ZeroCopyMinSize is the size from which buffer bodies are sent with
+	// IORING_OP_SENDMSG_ZC. Negative value disables zero-copy sends.
+	//
+	// DefaultIOUringZeroCopyMinSize is used by default.
+	ZeroCopyMinSize int
+
+	once sync.Once
+	ring *iouring
+	err  error
+}
+
+func (t *IOUringTransport) init() error {
+	t.once.Do(func() {
+		if t.Entries == 0 {
+			t.Entries = DefaultIOUringEntries
+		}
+		if t.RecvBufferSize <= 0 {
+			t.RecvBufferSize = DefaultIOUringRecvBufferSize
+		}
+		if t.RecvBuffers <= 0 {
+			t.RecvBuffers = DefaultIOUringRecvBuffers
+		}
+		if t.ZeroCopyMinSize == 0 {
+			t.ZeroCopyMinSize = DefaultIOUringZeroCopyMinSize
+		}
+		t.ring, t.err = newIOUring(t.Entries, t.RecvBufferSize, t.RecvBuffers)
+		if t.err != nil {
+			errorLogger("gorpc.IOUringTransport: falling back to the netpoller: [%s]", t.err)
+		}
+	})
+	return t.err
+}
+
+// Err returns the reason the transport falls back to plain connections,
+// or nil if io_uring is used.
+func (t *IOUringTransport) Err() error {
+	return t.init()
+}
+
+// Stats returns the snapshot of the io_uring stats.
+func (t *IOUringTransport) Stats() IOUringStats {
+	if t.init() != nil {
+		return IOUringStats{}
+	}
+	return t.ring.stats.Snapshot()
+}
+
+// Close releases the io_uring. The clients and servers using the transport
+// must be stopped before.
+func (t *IOUringTransport) Close() error {
+	if t.init() != nil {
+		return nil
+	}
+	return t.ring.Close()
+}
+
+// wrap hands the connection over to the io_uring.
+func (t *IOUringTransport) wrap(c net.Conn) (io.ReadWriteCloser, error) {
+	if t.init() != nil {
+		return c, nil
+	}
+	return t.ring.newConn(c, t.ZeroCopyMinSize)
+}
+
+// Dial is a DialFunc connecting over TCP.
+func (t *IOUringTransport) Dial(addr string) (io.ReadWriteCloser, error) {
+	c, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(c)
+}
+
+// Listener returns a Listener accepting TCP connections.
+func (t *IOUringTransport) Listener() Listener {
+	return &iouringListener{t: t}
+}
+
+type iouringListener struct {
+	defaultListener
+	t *IOUringTransport
+}
+
+func (ln *iouringListener) Accept() (conn io.ReadWriteCloser, clientAddr string, err error) {
+	c, err := ln.L.Accept()
+	if err != nil {
+		return nil, "", err
+	}
+	if err = setupKeepalive(c); err != nil {
+		c.Close()
+		return nil, "", err
+	}
+	clientAddr = c.RemoteAddr().String()
+	if conn, err = ln.t.wrap(c); err != nil {
+		return nil, "", err
+	}
+	return conn, clientAddr, nil
+}
+
+// NewIOUringClient creates a client connecting over TCP to the server
+// listening to the given addr, running the connections over the transport.
+//
+// The returned client must be started after optional settings' adjustment.
+//
+// The corresponding server may be created with either NewIOUringServer()
+// or NewTCPServer().
+func NewIOUringClient(addr string, t *IOUringTransport) *Client {
+	return &Client{
+		Addr: addr,
+		Dial: t.Dial,
+	}
+}
+
+// NewIOUringServer creates a server listening for TCP connections
+// on the given addr and processing incoming requests
+// with the given HandlerFunc, running the connections over the transport.
+//
+// The returned server must be started after optional settings' adjustment.
+//
+// The corresponding client may be created with either NewIOUringClient()
+// or NewTCPClient().
+func NewIOUringServer(addr string, handler HandlerFunc, t *IOUringTransport) *Server {
+	return &Server{
+		Addr:     addr,
+		Handler:  handler,
+		Listener: t.Listener(),
+	}
+}
@@ -0,0 +1,348 @@
+package iorpc
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// iouringConn is a TCP connection driven by the io_uring.
+//
+// It takes the socket over from the netpoller and switches it to blocking
+// mode, so the kernel completes the operations when the socket is ready
+// instead of returning EAGAIN.
+type iouringConn struct {
+	ring   *iouring
+	fd     int
+	zcMin  int
+	local  net.Addr
+	remote net.Addr
+
+	// rbuf is the received data not read yet, held in the provided
+	// buffer rbid or in own.
+	rbuf []byte
+	rbid int
+	own  []byte
+
+	mu     sync.Mutex
+	refs   int
+	closed bool
+}
+
+func (r *iouring) newConn(c net.Conn, zcMin int) (*iouringConn, error) {
+	sc, ok := c.(syscall.Conn)
+	if !ok {
+		return nil, errors.Errorf("%T isn't a syscall.Conn", c)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, errors.Wrap(err, "get raw conn")
+	}
+	fd := -1
+	cerr := raw.Control(func(s uintptr) {
+		fd, err = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if cerr == nil {
+		cerr = err
+	}
+	local, remote := c.LocalAddr(), c.RemoteAddr()
+	// Closing the original fd detaches the socket from the netpoller.
+	c.Close()
+	if cerr != nil {
+		return nil, errors.Wrap(cerr, "dup socket")
+	}
+	if err = unix.SetNonblock(fd, false); err != nil {
+		unix.Close(fd)
+		return nil, errors.Wrap(err, "set blocking")
+	}
+	return &iouringConn{
+		ring:   r,
+		fd:     fd,
+		zcMin:  zcMin,
+		local:  local,
+		remote: remote,
+		rbid:   -1,
+	}, nil
+}
+
+func (c *iouringConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *iouringConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// acquire keeps the fd open until release.
+func (c *iouringConn) acquire() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.refs++
+	return nil
+}
+
+func (c *iouringConn) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refs--
+	if c.closed && c.refs == 0 {
+		unix.Close(c.fd)
+	}
+}
+
+// Close shuts the socket down, which completes the pending operations,
+// and closes it once they complete.
+func (c *iouringConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.closed = true
+	unix.Shutdown(c.fd, unix.SHUT_RDWR)
+	if c.refs == 0 {
+		unix.Close(c.fd)
+	}
+	return nil
+}
+
+func (c *iouringConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(c.rbuf) == 0 {
+		if err := c.fill(len(p)); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	if len(c.rbuf) == 0 && c.rbid >= 0 {
+		c.ring.buffers.recycle(uint16(c.rbid))
+		c.rbid = -1
+	}
+	return n, nil
+}
+
+// fill receives into rbuf.
+func (c *iouringConn) fill(want int) error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	br := c.ring.buffers
+	if br != nil && want < br.size {
+		res, flags, err := c.ring.do(iouringSqe{
+			Opcode:   iouringOpRecv,
+			Flags:    iouringSqeBufferSelect,
+			Fd:       int32(c.fd),
+			Len:      uint32(br.size),
+			BufGroup: br.group,
+		})
+		if flags&iouringCqeFBuffer != 0 {
+			id := uint16(flags >> iouringCqeBufShift)
+			if res <= 0 {
+				br.recycle(id)
+			} else {
+				c.rbuf, c.rbid = br.buffer(id)[:res], int(id)
+				return nil
+			}
+		}
+		if err != syscall.ENOBUFS {
+			return recvError(res, err)
+		}
+		// All the provided buffers are held by the readers.
+	}
+
+	if len(c.own) < want {
+		size := DefaultBufferSize
+		if want > size {
+			size = want
+		}
+		c.own = make([]byte, size)
+	}
+	res, _, err := c.ring.do(iouringSqe{
+		Opcode: iouringOpRecv,
+		Fd:     int32(c.fd),
+		Addr:   uint64(uintptr(unsafe.Pointer(&c.own[0]))),
+		Len:    uint32(len(c.own)),
+	}, c.own)
+	if res <= 0 {
+		return recvError(res, err)
+	}
+	c.rbuf = c.own[:res]
+	return nil
+}
+
+func recvError(res int32, err error) error {
+	if err != nil {
+		return err
+	}
+	if res == 0 {
+		return io.EOF
+	}
+	return nil
+}
+
+func (c *iouringConn) Write(p []byte) (int, error) {
+	if err := c.acquire(); err != nil {
+		return 0, err
+	}
+	defer c.release()
+
+	written := 0
+	for written < len(p) {
+		b := p[written:]
+		res, _, err := c.ring.do(iouringSqe{
+			Opcode:  iouringOpSend,
+			Fd:      int32(c.fd),
+			Addr:    uint64(uintptr(unsafe.Pointer(&b[0]))),
+			Len:     uint32(len(b)),
+			OpFlags: unix.MSG_NOSIGNAL,
+		}, b)
+		if err != nil {
+			return written, err
+		}
+		written += int(res)
+	}
+	return written, nil
+}
+
+// writeBody sends the body with the io_uring.
+func (c *iouringConn) writeBody(b *Body) (bool, error) {
+	switch reader := b.Reader.(type) {
+	case IsPipe:
+		return true, c.splice(reader, int(b.Size))
+	case IsFile:
+		pipe, err := PipeFile(reader, int64(b.Offset), int(b.Size))
+		if err != nil {
+			return false, nil
+		}
+		defer pipe.Close()
+		return true, c.splice(pipe, int(b.Size))
+	case IsConn:
+		pipe, err := PipeConn(reader, int(b.Size))
+		if err != nil {
+			return false, nil
+		}
+		defer pipe.Close()
+		return true, c.splice(pipe, int(b.Size))
+	case IsBuffer:
+		if c.zcMin >= 0 && int(b.Size) >= c.zcMin && !b.NotClose && !c.ring.noZC.Load() {
+			// The buffer is closed once the kernel releases it,
+			// not by the caller right after writeBody returns.
+			b.NotClose = true
+			return true, c.sendZC(reader)
+		}
+		return true, c.sendmsg(reader.Iovec(), int(b.Size))
+	default:
+		return false, nil
+	}
+}
+
+// splice sends size bytes of the pipe with IORING_OP_SPLICE.
+func (c *iouringConn) splice(pipe IsPipe, size int) error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	for size > 0 {
+		res, _, err := c.ring.do(iouringSqe{
+			Opcode:     iouringOpSplice,
+			Fd:         int32(c.fd),
+			Off:        ^uint64(0),
+			Addr:       ^uint64(0),
+			Len:        uint32(size),
+			SpliceFdIn: int32(pipe.ReadFd()),
+		}, pipe)
+		if err != nil {
+			return err
+		}
+		if res == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		size -= int(res)
+	}
+	return nil
+}
+
+// sendmsg sends size bytes of the iovec with IORING_OP_SENDMSG.
+func (c *iouringConn) sendmsg(iovec [][]byte, size int) error {
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	iovec = append([][]byte(nil), iovec...)
+	for size > 0 {
+		iovs := iovecs(iovec)
+		msg := &unix.Msghdr{Iov: &iovs[0]}
+		msg.SetIovlen(len(iovs))
+		res, _, err := c.ring.do(iouringSqe{
+			Opcode:  iouringOpSendmsg,
+			Fd:      int32(c.fd),
+			Addr:    uint64(uintptr(unsafe.Pointer(msg))),
+			Len:     1,
+			OpFlags: unix.MSG_NOSIGNAL,
+		}, msg, iovs, iovec)
+		if err != nil {
+			return err
+		}
+		size -= int(res)
+		iovec = skipIovec(iovec, int(res))
+	}
+	return nil
+}
+
+// sendZC sends the buffer with IORING_OP_SENDMSG_ZC and closes it
+// once the kernel doesn't reference its pages anymore.
+func (c *iouringConn) sendZC(buffer IsBuffer) error {
+	// The writer holds a reference too, so the buffer survives
+	// the fallback to sendmsg.
+	refs := int32(1)
+	release := func() {
+		if atomic.AddInt32(&refs, -1) == 0 {
+			buffer.Close()
+		}
+	}
+	defer release()
+
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+
+	iovec := append([][]byte(nil), buffer.Iovec()...)
+	sent := false
+	for len(iovec) > 0 {
+		atomic.AddInt32(&refs, 1)
+		n, err := c.ring.sendmsgZC(c.fd, iovec, release)
+		if !sent && (err == syscall.EINVAL || err == syscall.EOPNOTSUPP) {
+			// The kernel lacks IORING_OP_SENDMSG_ZC (Linux 6.1).
+			c.ring.noZC.Store(true)
+			size := 0
+			for _, b := range iovec {
+				size += len(b)
+			}
+			return c.sendmsg(iovec, size)
+		}
+		if err != nil {
+			return err
+		}
+		sent = true
+		iovec = skipIovec(iovec, n)
+	}
+	c.ring.stats.incZeroCopySends()
+	return nil
+}
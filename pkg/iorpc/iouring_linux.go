@@ -0,0 +1,509 @@
+package iorpc
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The subset of <linux/io_uring.h> used by the ring.
+const (
+	iouringOpNop       = 0
+	iouringOpSendmsg   = 9
+	iouringOpSplice    = 30
+	iouringOpSend      = 26
+	iouringOpRecv      = 27
+	iouringOpSendmsgZC = 48
+
+	iouringSqeBufferSelect = 1 << 5
+
+	iouringCqeFBuffer  = 1 << 0
+	iouringCqeFMore    = 1 << 1
+	iouringCqeFNotif   = 1 << 3
+	iouringCqeBufShift = 16
+
+	iouringEnterGetEvents = 1 << 0
+
+	iouringRegisterPbufRing = 22
+
+	iouringOffSqRing = 0
+	iouringOffCqRing = 0x8000000
+	iouringOffSqes   = 0x10000000
+
+	iouringSqeSize = 64
+	iouringCqeSize = 16
+)
+
+type iouringSqringOffsets struct {
+	Head, Tail, RingMask, RingEntries, Flags, Dropped, Array, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type iouringCqringOffsets struct {
+	Head, Tail, RingMask, RingEntries, Overflow, Cqes, Flags, Resv1 uint32
+	UserAddr                                                        uint64
+}
+
+type iouringParams struct {
+	SqEntries, CqEntries, Flags, SqThreadCPU, SqThreadIdle, Features, WqFd uint32
+	Resv                                                                   [3]uint32
+	SqOff                                                                  iouringSqringOffsets
+	CqOff                                                                  iouringCqringOffsets
+}
+
+type iouringSqe struct {
+	Opcode      uint8
+	Flags       uint8
+	Ioprio      uint16
+	Fd          int32
+	Off         uint64
+	Addr        uint64
+	Len         uint32
+	OpFlags     uint32
+	UserData    uint64
+	BufGroup    uint16
+	Personality uint16
+	SpliceFdIn  int32
+	Addr3       uint64
+	_           uint64
+}
+
+type iouringCqe struct {
+	UserData uint64
+	Res      int32
+	Flags    uint32
+}
+
+type iouringBufReg struct {
+	RingAddr    uint64
+	RingEntries uint32
+	Bgid        uint16
+	Pad         uint16
+	Resv        [3]uint64
+}
+
+// iouringOp is an in-flight submission. The memory the kernel reads or
+// writes must stay referenced by the op until its last completion.
+type iouringOp struct {
+	sqe iouringSqe
+
+	// keep references the memory passed to the kernel.
+	keep []any
+
+	// complete is called on every completion of the op; the op is done
+	// unless more is set.
+	complete func(res int32, flags uint32)
+}
+
+// iouringBufferRing is a ring of provided buffers the kernel picks from
+// for receives with IOSQE_BUFFER_SELECT.
+type iouringBufferRing struct {
+	mu      sync.Mutex
+	ring    []byte
+	slab    []byte
+	size    int
+	entries uint16
+	tail    uint16
+	group   uint16
+}
+
+// buffer returns the provided buffer picked by the kernel.
+func (br *iouringBufferRing) buffer(id uint16) []byte {
+	off := int(id) * br.size
+	return br.slab[off : off+br.size : off+br.size]
+}
+
+// recycle returns the provided buffer to the kernel.
+func (br *iouringBufferRing) recycle(id uint16) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.add(id)
+	br.publish()
+}
+
+// publish makes the added buffers visible to the kernel. The 16-bit tail
+// aliases the reserved field of the first entry, it's stored together with
+// the buffer id preceding it since there are no 16-bit atomics.
+func (br *iouringBufferRing) publish() {
+	bid := uint32(*(*uint16)(unsafe.Pointer(&br.ring[12])))
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&br.ring[12])), uint32(br.tail)<<16|bid)
+}
+
+func (br *iouringBufferRing) add(id uint16) {
+	entry := br.ring[int(br.tail&(br.entries-1))*16:]
+	*(*uint64)(unsafe.Pointer(&entry[0])) = uint64(uintptr(unsafe.Pointer(&br.slab[int(id)*br.size])))
+	*(*uint32)(unsafe.Pointer(&entry[8])) = uint32(br.size)
+	*(*uint16)(unsafe.Pointer(&entry[12])) = id
+	br.tail++
+}
+
+// iouring is a submission/completion queue pair shared by many connections.
+//
+// Submissions are group-committed: a goroutine queueing an SQE while another
+// one is in io_uring_enter leaves it to be submitted by that goroutine's next
+// enter, so concurrent connections share the syscalls. Completions are reaped
+// by a dedicated goroutine.
+type iouring struct {
+	fd int
+
+	sqRing, cqRing, sqes []byte
+
+	sqTail, sqMask, sqArray unsafe.Pointer
+	cqHead, cqTail, cqMask  unsafe.Pointer
+	cqes                    unsafe.Pointer
+	sqEntries               uint32
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queued   uint32
+	flushing bool
+	closed   bool
+	nextID   uint64
+	ops      map[uint64]*iouringOp
+
+	buffers *iouringBufferRing
+	noZC    atomic.Bool
+
+	stats IOUringStats
+	done  chan struct{}
+}
+
+const iouringWakeID = ^uint64(0)
+
+func newIOUring(entries uint32, bufSize, bufEntries int) (*iouring, error) {
+	var p iouringParams
+	fd, _, errno := syscall.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "io_uring_setup")
+	}
+	r := &iouring{
+		fd:        int(fd),
+		sqEntries: p.SqEntries,
+		ops:       make(map[uint64]*iouringOp),
+		done:      make(chan struct{}),
+	}
+	r.cond = sync.NewCond(&r.mu)
+
+	var err error
+	defer func() {
+		if err != nil {
+			r.unmap()
+		}
+	}()
+	sqSize := int(p.SqOff.Array + p.SqEntries*4)
+	if r.sqRing, err = unix.Mmap(r.fd, iouringOffSqRing, sqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return nil, errors.Wrap(err, "mmap sq ring")
+	}
+	cqSize := int(p.CqOff.Cqes + p.CqEntries*iouringCqeSize)
+	if r.cqRing, err = unix.Mmap(r.fd, iouringOffCqRing, cqSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return nil, errors.Wrap(err, "mmap cq ring")
+	}
+	if r.sqes, err = unix.Mmap(r.fd, iouringOffSqes, int(p.SqEntries*iouringSqeSize), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE); err != nil {
+		return nil, errors.Wrap(err, "mmap sqes")
+	}
+	r.sqTail = unsafe.Pointer(&r.sqRing[p.SqOff.Tail])
+	r.sqMask = unsafe.Pointer(&r.sqRing[p.SqOff.RingMask])
+	r.sqArray = unsafe.Pointer(&r.sqRing[p.SqOff.Array])
+	r.cqHead = unsafe.Pointer(&r.cqRing[p.CqOff.Head])
+	r.cqTail = unsafe.Pointer(&r.cqRing[p.CqOff.Tail])
+	r.cqMask = unsafe.Pointer(&r.cqRing[p.CqOff.RingMask])
+	r.cqes = unsafe.Pointer(&r.cqRing[p.CqOff.Cqes])
+
+	// Provided buffer rings need Linux 5.19, receives fall back to
+	// the buffers of the connections without them.
+	if bufEntries > 0 {
+		r.buffers, _ = r.registerBuffers(bufSize, bufEntries)
+	}
+
+	go r.reap()
+	return r, nil
+}
+
+func (r *iouring) registerBuffers(size, entries int) (*iouringBufferRing, error) {
+	if entries&(entries-1) != 0 || entries > 1<<15 {
+		return nil, errors.Errorf("invalid number of provided buffers %d", entries)
+	}
+	ring, err := unix.Mmap(-1, 0, entries*16, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		return nil, errors.Wrap(err, "mmap buffer ring")
+	}
+	slab, err := unix.Mmap(-1, 0, entries*size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+	if err != nil {
+		unix.Munmap(ring)
+		return nil, errors.Wrap(err, "mmap provided buffers")
+	}
+	br := &iouringBufferRing{ring: ring, slab: slab, size: size, entries: uint16(entries)}
+	reg := iouringBufReg{
+		RingAddr:    uint64(uintptr(unsafe.Pointer(&ring[0]))),
+		RingEntries: uint32(entries),
+		Bgid:        br.group,
+	}
+	_, _, errno := syscall.Syscall6(unix.SYS_IO_URING_REGISTER, uintptr(r.fd), iouringRegisterPbufRing, uintptr(unsafe.Pointer(&reg)), 1, 0, 0)
+	if errno != 0 {
+		unix.Munmap(ring)
+		unix.Munmap(slab)
+		return nil, errors.Wrap(errno, "register buffer ring")
+	}
+	br.mu.Lock()
+	for id := 0; id < entries; id++ {
+		br.add(uint16(id))
+	}
+	br.publish()
+	br.mu.Unlock()
+	return br, nil
+}
+
+// submit queues the op and submits it together with the ops queued
+// concurrently. The op completes with an error if the ring fails.
+func (r *iouring) submit(op *iouringOp) error {
+	r.mu.Lock()
+	for !r.closed && r.queued >= r.sqEntries {
+		r.cond.Wait()
+	}
+	if r.closed {
+		r.mu.Unlock()
+		return ErrIOUringClosed
+	}
+	r.nextID++
+	if r.nextID == iouringWakeID {
+		r.nextID = 1
+	}
+	id := r.nextID
+	op.sqe.UserData = id
+	r.ops[id] = op
+
+	tail := atomic.LoadUint32((*uint32)(r.sqTail))
+	mask := *(*uint32)(r.sqMask)
+	idx := tail & mask
+	*(*iouringSqe)(unsafe.Pointer(&r.sqes[idx*iouringSqeSize])) = op.sqe
+	*(*uint32)(unsafe.Add(r.sqArray, idx*4)) = idx
+	atomic.StoreUint32((*uint32)(r.sqTail), tail+1)
+	r.queued++
+	r.stats.incSQEs()
+
+	if r.flushing {
+		r.mu.Unlock()
+		return nil
+	}
+	r.flushing = true
+	for r.queued > 0 {
+		n := r.queued
+		r.queued = 0
+		r.cond.Broadcast()
+		r.mu.Unlock()
+		submitted, err := r.enter(n, 0, 0)
+		if err != nil && err != syscall.EAGAIN && err != syscall.EBUSY {
+			// The queued ops complete with the error.
+			r.fail(err)
+			return nil
+		}
+		r.mu.Lock()
+		if submitted < n {
+			// Let the reaper free up the completion queue.
+			r.mu.Unlock()
+			runtime.Gosched()
+			r.mu.Lock()
+		}
+		r.queued += n - submitted
+	}
+	r.flushing = false
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *iouring) enter(submit, wait, flags uint32) (uint32, error) {
+	for {
+		r.stats.incEnters()
+		n, _, errno := syscall.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(submit), uintptr(wait), uintptr(flags), 0, 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return uint32(n), errno
+		}
+		return uint32(n), nil
+	}
+}
+
+// reap dispatches completions until the ring is closed.
+func (r *iouring) reap() {
+	defer close(r.done)
+	stop := false
+	for {
+		head := atomic.LoadUint32((*uint32)(r.cqHead))
+		tail := atomic.LoadUint32((*uint32)(r.cqTail))
+		if head == tail {
+			if _, err := r.enter(0, 1, iouringEnterGetEvents); err != nil && err != syscall.EAGAIN && err != syscall.EBUSY {
+				r.fail(err)
+				return
+			}
+			continue
+		}
+		mask := *(*uint32)(r.cqMask)
+		for ; head != tail; head++ {
+			cqe := *(*iouringCqe)(unsafe.Add(r.cqes, (head&mask)*iouringCqeSize))
+			r.stats.incCQEs()
+			if cqe.UserData == iouringWakeID {
+				stop = true
+				continue
+			}
+			r.mu.Lock()
+			op := r.ops[cqe.UserData]
+			if op != nil && cqe.Flags&iouringCqeFMore == 0 {
+				delete(r.ops, cqe.UserData)
+			}
+			r.mu.Unlock()
+			if op != nil {
+				op.complete(cqe.Res, cqe.Flags)
+			}
+		}
+		atomic.StoreUint32((*uint32)(r.cqHead), head)
+		if stop {
+			r.mu.Lock()
+			idle := len(r.ops) == 0
+			r.mu.Unlock()
+			if idle {
+				return
+			}
+		}
+	}
+}
+
+// fail completes all the in-flight ops with the error.
+func (r *iouring) fail(err error) {
+	errno, _ := err.(syscall.Errno)
+	r.mu.Lock()
+	r.closed = true
+	ops := r.ops
+	r.ops = map[uint64]*iouringOp{}
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	for _, op := range ops {
+		op.complete(-int32(errno), 0)
+	}
+}
+
+// Close stops the ring once the in-flight ops complete. The connections
+// using the ring must be closed before.
+func (r *iouring) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	// Submit the wakeup bypassing submit(), which refuses closed rings.
+	r.mu.Lock()
+	tail := atomic.LoadUint32((*uint32)(r.sqTail))
+	idx := tail & *(*uint32)(r.sqMask)
+	*(*iouringSqe)(unsafe.Pointer(&r.sqes[idx*iouringSqeSize])) = iouringSqe{Opcode: iouringOpNop, UserData: iouringWakeID}
+	*(*uint32)(unsafe.Add(r.sqArray, idx*4)) = idx
+	atomic.StoreUint32((*uint32)(r.sqTail), tail+1)
+	r.queued++
+	n := r.queued
+	r.queued = 0
+	r.mu.Unlock()
+	if _, err := r.enter(n, 0, 0); err != nil {
+		return errors.Wrap(err, "io_uring_enter")
+	}
+	<-r.done
+	r.unmap()
+	return nil
+}
+
+func (r *iouring) unmap() {
+	if r.buffers != nil {
+		unix.Munmap(r.buffers.ring)
+		unix.Munmap(r.buffers.slab)
+	}
+	for _, m := range [][]byte{r.sqes, r.cqRing, r.sqRing} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+// do submits the op and waits for its completion.
+func (r *iouring) do(sqe iouringSqe, keep ...any) (res int32, flags uint32, err error) {
+	done := make(chan struct{})
+	op := &iouringOp{sqe: sqe, keep: keep}
+	op.complete = func(r int32, f uint32) {
+		res, flags = r, f
+		close(done)
+	}
+	if err = r.submit(op); err != nil {
+		return 0, 0, err
+	}
+	<-done
+	if res < 0 {
+		return res, flags, syscall.Errno(-res)
+	}
+	return res, flags, nil
+}
+
+func iovecs(iovec [][]byte) []unix.Iovec {
+	iovs := make([]unix.Iovec, 0, len(iovec))
+	for _, b := range iovec {
+		if len(b) == 0 {
+			continue
+		}
+		v := unix.Iovec{Base: &b[0]}
+		v.SetLen(len(b))
+		iovs = append(iovs, v)
+	}
+	return iovs
+}
+
+// sendmsgZC sends the iovec with IORING_OP_SENDMSG_ZC. release is called
+// once the kernel doesn't reference the iovec memory anymore, which may be
+// long after sendmsgZC returns.
+func (r *iouring) sendmsgZC(fd int, iovec [][]byte, release func()) (int, error) {
+	iovs := iovecs(iovec)
+	msg := &unix.Msghdr{Iov: &iovs[0]}
+	msg.SetIovlen(len(iovs))
+
+	done := make(chan struct{})
+	var res int32
+	var notified bool
+	op := &iouringOp{
+		sqe: iouringSqe{
+			Opcode:  iouringOpSendmsgZC,
+			Fd:      int32(fd),
+			Addr:    uint64(uintptr(unsafe.Pointer(msg))),
+			Len:     1,
+			OpFlags: unix.MSG_NOSIGNAL,
+		},
+		keep: []any{msg, iovs, iovec},
+	}
+	op.complete = func(r int32, flags uint32) {
+		if flags&iouringCqeFNotif != 0 {
+			release()
+			return
+		}
+		res = r
+		notified = flags&iouringCqeFMore == 0
+		close(done)
+	}
+	if err := r.submit(op); err != nil {
+		release()
+		return 0, err
+	}
+	<-done
+	if notified {
+		// No notification follows a failed send.
+		release()
+	}
+	if res < 0 {
+		return 0, syscall.Errno(-res)
+	}
+	return int(res), nil
+}
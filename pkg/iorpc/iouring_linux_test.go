@@ -0,0 +1,167 @@
+package iorpc
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestIOUringTransport(t *testing.T) *IOUringTransport {
+	tr := &IOUringTransport{Entries: 64, RecvBuffers: 16, RecvBufferSize: 4 << 10}
+	if err := tr.Err(); err != nil {
+		t.Skip(err)
+	}
+	return tr
+}
+
+func TestIOUringConnBodies(t *testing.T) {
+	tr := newTestIOUringTransport(t)
+	defer tr.Close()
+
+	for _, size := range []int{4 << 10, DefaultIOUringZeroCopyMinSize, 256 << 10} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			a := assert.New(t)
+
+			client, server := tcpPair(t)
+			conn, err := tr.wrap(client)
+			a.Nil(err)
+			defer conn.Close()
+			defer server.Close()
+
+			buf := newIovecBuffer(size, 4)
+			received := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(io.LimitReader(server, int64(size)))
+				received <- b
+			}()
+
+			body := Body{Size: uint64(size), Reader: buf}
+			spliced, err := body.spliceTo(conn)
+			a.True(spliced)
+			a.Nil(err)
+			body.Close()
+
+			a.Equal(buf.bytes(), <-received)
+			select {
+			case <-buf.closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the buffer hasn't been released")
+			}
+			a.Equal(int32(1), buf.closes.Load())
+			if size >= DefaultIOUringZeroCopyMinSize && !tr.ring.noZC.Load() {
+				a.NotZero(tr.Stats().ZeroCopySends)
+			}
+
+			// The pipe bodies are spliced.
+			pipe, err := PipeBuffer(buf, size)
+			a.Nil(err)
+			go func() {
+				b, _ := io.ReadAll(io.LimitReader(server, int64(size)))
+				received <- b
+			}()
+			body = Body{Size: uint64(size), Reader: pipe}
+			spliced, err = body.spliceTo(conn)
+			a.True(spliced)
+			a.Nil(err)
+			body.Close()
+			a.Equal(buf.bytes(), <-received)
+
+			// Receives larger than the provided buffers.
+			go server.Write(buf.bytes())
+			got := make([]byte, size)
+			_, err = io.ReadFull(conn, got)
+			a.Nil(err)
+			a.Equal(buf.bytes(), got)
+		})
+	}
+}
+
+func TestIOUringConnClose(t *testing.T) {
+	a := assert.New(t)
+	tr := newTestIOUringTransport(t)
+	defer tr.Close()
+
+	client, server := tcpPair(t)
+	defer server.Close()
+	conn, err := tr.wrap(client)
+	a.Nil(err)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	a.Nil(conn.Close())
+	select {
+	case err = <-readErr:
+		a.NotNil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending read hasn't been completed by Close")
+	}
+
+	_, err = conn.Write([]byte("x"))
+	a.NotNil(err)
+}
+
+func TestIOUringClientServer(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+	tr := newTestIOUringTransport(t)
+	defer tr.Close()
+
+	payload := newIovecBuffer(256<<10, 4).bytes()
+	d := NewDispatcher()
+	d.AddService("Echo", func(clientAddr string, request Request) (*Response, error) {
+		b, err := io.ReadAll(request.Body.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{Body: Body{Size: uint64(len(b)), Reader: &bodyBuffer{data: b}}}, nil
+	})
+
+	s := NewIOUringServer("127.0.0.1:0", d.HandlerFunc(), tr)
+	s.Services = d.Services()
+	a.Nil(s.Listener.Init(s.Addr))
+	a.Nil(s.Start())
+	defer s.Stop()
+
+	c := NewIOUringClient(s.Listener.ListenAddr().String(), tr)
+	c.Conns = 2
+	c.Start()
+	defer c.Stop()
+
+	svc, err := c.Service("Echo")
+	a.Nil(err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			size := (i + 1) * len(payload) / 16
+			for j := 0; j < 10; j++ {
+				resp, err := c.Call(Request{Service: svc, Body: Body{
+					Size:   uint64(size),
+					Reader: &bodyBuffer{data: payload[:size]},
+				}})
+				if !a.Nil(err) {
+					return
+				}
+				got, err := io.ReadAll(resp.Body.Reader)
+				resp.Body.Close()
+				a.Nil(err)
+				a.Equal(payload[:size], got)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	stats := tr.Stats()
+	a.NotZero(stats.Enters)
+	a.NotZero(stats.SQEs)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package iorpc
+
+import (
+	"io"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+type iouring struct {
+	stats IOUringStats
+}
+
+func newIOUring(entries uint32, bufSize, bufEntries int) (*iouring, error) {
+	return nil, errors.New("io_uring is only supported on linux")
+}
+
+func (r *iouring) newConn(c net.Conn, zcMin int) (io.ReadWriteCloser, error) {
+	return c, nil
+}
+
+func (r *iouring) Close() error {
+	return nil
+}
@@ -0,0 +1,82 @@
+package iorpc
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Reserved message ids of the keepalive frames.
+//
+// A ping may be sent by both sides: the client sends it as a request,
+// the server sends it as a response. The peer answers with a pong
+// of the opposite direction. Pings and pongs never reach handlers
+// and never complete AsyncResults.
+const (
+	pingID = ^uint64(0)
+	pongID = ^uint64(0) - 1
+
+	// maxMessageID is the largest id usable by regular requests.
+	maxMessageID = pongID - 1
+)
+
+func isControlID(id uint64) bool {
+	return id == pingID || id == pongID
+}
+
+// keepalive detects dead peers on a single connection.
+//
+// The reader must call touch on every received message.
+// If nothing has been received during interval, a ping is sent.
+// If nothing has been received during timeout, the peer is declared dead.
+type keepalive struct {
+	interval, timeout time.Duration
+	lastRead          atomic.Int64
+}
+
+func newKeepalive(interval, timeout time.Duration) *keepalive {
+	if interval <= 0 {
+		return nil
+	}
+	if timeout <= 0 {
+		timeout = 3 * interval
+	}
+	k := &keepalive{
+		interval: interval,
+		timeout:  timeout,
+	}
+	k.touch()
+	return k
+}
+
+func (k *keepalive) touch() {
+	if k != nil {
+		k.lastRead.Store(time.Now().UnixNano())
+	}
+}
+
+// run sends pings via ping until stopChan is closed.
+// It closes dead and returns once the peer is declared dead.
+func (k *keepalive) run(stopChan <-chan struct{}, ping func(), dead chan<- struct{}) {
+	tick := k.interval / 2
+	if tick > k.timeout/4 {
+		tick = k.timeout / 4
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stopChan:
+			return
+		case now := <-t.C:
+			idle := now.Sub(time.Unix(0, k.lastRead.Load()))
+			if idle >= k.timeout {
+				close(dead)
+				return
+			}
+			if idle >= k.interval {
+				ping()
+			}
+		}
+	}
+}
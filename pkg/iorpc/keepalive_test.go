@@ -0,0 +1,86 @@
+package iorpc
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepaliveIdleConnection(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	d := NewDispatcher()
+	d.AddService("Noop", func(clientAddr string, request Request) (*Response, error) {
+		return &Response{}, nil
+	})
+
+	s := NewTCPServer("127.0.0.1:0", d.HandlerFunc())
+	s.PingInterval = 10 * time.Millisecond
+	s.PingTimeout = 50 * time.Millisecond
+	a.Nil(s.Listener.Init(s.Addr))
+	a.Nil(s.Start())
+	defer s.Stop()
+
+	c := NewTCPClient(s.Listener.ListenAddr().String())
+	c.PingInterval = 10 * time.Millisecond
+	c.PingTimeout = 50 * time.Millisecond
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.Call(Request{})
+	a.Nil(err)
+
+	time.Sleep(200 * time.Millisecond)
+
+	_, err = c.Call(Request{})
+	a.Nil(err)
+	a.Equal(uint64(1), c.Stats.DialCalls)
+	a.Equal(uint64(2), s.Stats.RPCCalls)
+}
+
+func TestKeepaliveDeadServer(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	a.Nil(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// Complete the handshake with an empty service table,
+			// then read everything and never answer.
+			go func() {
+				var handshake [1]byte
+				if _, err := io.ReadFull(conn, handshake[:]); err != nil {
+					return
+				}
+				if err := writeServiceTable(conn, nil); err != nil {
+					return
+				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+
+	c := NewTCPClient(ln.Addr().String())
+	c.PingInterval = 10 * time.Millisecond
+	c.PingTimeout = 50 * time.Millisecond
+	c.Start()
+	defer c.Stop()
+
+	start := time.Now()
+	_, err = c.CallTimeout(Request{}, 5*time.Second)
+	var clientErr *ClientError
+	a.True(errors.As(err, &clientErr))
+	a.True(clientErr.Connection)
+	a.Less(time.Since(start), time.Second)
+}
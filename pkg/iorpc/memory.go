@@ -0,0 +1,425 @@
+package iorpc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMemoryConnRefused is returned by MemoryNetwork.Dial if nothing listens
+// to the address.
+var ErrMemoryConnRefused = errors.New("connection refused")
+
+// MemoryOpKind is the kind of MemoryOp.
+type MemoryOpKind int
+
+const (
+	// MemoryDial is a MemoryNetwork.Dial call.
+	MemoryDial MemoryOpKind = iota
+
+	// MemoryRead is a Read call of a connection.
+	MemoryRead
+
+	// MemoryWrite is a Write call of a connection.
+	MemoryWrite
+)
+
+// MemoryOp is an operation of MemoryNetwork passed to MemoryNetwork.Fault.
+type MemoryOp struct {
+	Kind MemoryOpKind
+
+	// Addr is the address dialed.
+	Addr string
+
+	// Conn is the number of the connection, starting from 1.
+	Conn uint64
+
+	// Server is set for the operations of the accepted end.
+	Server bool
+
+	// Offset is the number of bytes read or written by the end before.
+	Offset int64
+
+	// Size is the size of the buffer passed to Read or Write.
+	Size int
+}
+
+// MemoryNetwork connects Client and Server within the process without
+// sockets.
+//
+// The written data is delivered after Latency at Bandwidth, and Fault fails
+// the operations at the chosen points, so protocol tests run fast and
+// reproducibly, including under the race detector.
+type MemoryNetwork struct {
+	// Latency is the delay of delivering the written data.
+	Latency time.Duration
+
+	// Bandwidth is the number of bytes per second every direction
+	// of a connection delivers.
+	//
+	// Zero value means unlimited bandwidth.
+	Bandwidth int64
+
+	// BufferSize is the number of bytes written to every direction
+	// of a connection and not read yet, after which writes block.
+	//
+	// DefaultBufferSize is used by default.
+	BufferSize int
+
+	// Fault is called before every operation. The non-nil error fails
+	// the operation, failed reads and writes close the connection.
+	//
+	// By default nothing fails.
+	Fault func(op MemoryOp) error
+
+	mu        sync.Mutex
+	listeners map[string]*memoryListener
+	conns     uint64
+}
+
+// Dial is a DialFunc connecting to the MemoryNetwork listener of addr.
+func (n *MemoryNetwork) Dial(addr string) (io.ReadWriteCloser, error) {
+	id := atomic.AddUint64(&n.conns, 1)
+	if err := n.fault(MemoryOp{Kind: MemoryDial, Addr: addr, Conn: id}); err != nil {
+		return nil, err
+	}
+
+	n.mu.Lock()
+	ln := n.listeners[addr]
+	n.mu.Unlock()
+	if ln == nil {
+		return nil, errors.Wrapf(ErrMemoryConnRefused, "dial %s", addr)
+	}
+
+	toServer, toClient := n.newPipe(), n.newPipe()
+	clientAddr := memoryAddr(fmt.Sprintf("%s#%d", addr, id))
+	client := &memoryConn{
+		n: n, addr: addr, id: id,
+		r: toClient, w: toServer,
+		local: clientAddr, remote: memoryAddr(addr),
+	}
+	server := &memoryConn{
+		n: n, addr: addr, id: id, server: true,
+		r: toServer, w: toClient,
+		local: memoryAddr(addr), remote: clientAddr,
+	}
+	select {
+	case ln.accept <- server:
+		return client, nil
+	case <-ln.done:
+		return nil, errors.Wrapf(ErrMemoryConnRefused, "dial %s", addr)
+	}
+}
+
+// Listener returns a Listener accepting the connections dialed
+// with MemoryNetwork.Dial.
+//
+// Listener.Init picks an unused address if Server.Addr is empty.
+func (n *MemoryNetwork) Listener() Listener {
+	return &memoryListener{n: n}
+}
+
+func (n *MemoryNetwork) fault(op MemoryOp) error {
+	if n.Fault == nil {
+		return nil
+	}
+	return n.Fault(op)
+}
+
+func (n *MemoryNetwork) newPipe() *memoryPipe {
+	size := n.BufferSize
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	return &memoryPipe{
+		latency:   n.Latency,
+		bandwidth: n.Bandwidth,
+		size:      size,
+		changed:   make(chan struct{}),
+	}
+}
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+type memoryListener struct {
+	n      *MemoryNetwork
+	addr   string
+	accept chan *memoryConn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (ln *memoryListener) Init(addr string) error {
+	ln.n.mu.Lock()
+	defer ln.n.mu.Unlock()
+	if ln.n.listeners == nil {
+		ln.n.listeners = make(map[string]*memoryListener)
+	}
+	for i := 1; addr == ""; i++ {
+		if name := fmt.Sprintf("memory-%d", i); ln.n.listeners[name] == nil {
+			addr = name
+		}
+	}
+	if ln.n.listeners[addr] != nil {
+		return errors.Errorf("listen %s: address already in use", addr)
+	}
+	ln.addr = addr
+	ln.accept = make(chan *memoryConn)
+	ln.done = make(chan struct{})
+	ln.n.listeners[addr] = ln
+	return nil
+}
+
+func (ln *memoryListener) ListenAddr() net.Addr {
+	if ln.accept == nil {
+		return nil
+	}
+	return memoryAddr(ln.addr)
+}
+
+func (ln *memoryListener) Accept() (io.ReadWriteCloser, string, error) {
+	select {
+	case c := <-ln.accept:
+		return c, c.remote.String(), nil
+	case <-ln.done:
+		return nil, "", net.ErrClosed
+	}
+}
+
+func (ln *memoryListener) Close() error {
+	ln.once.Do(func() {
+		ln.n.mu.Lock()
+		delete(ln.n.listeners, ln.addr)
+		ln.n.mu.Unlock()
+		close(ln.done)
+	})
+	return nil
+}
+
+// memoryConn is an end of a MemoryNetwork connection.
+type memoryConn struct {
+	n      *MemoryNetwork
+	addr   string
+	id     uint64
+	server bool
+
+	r, w          *memoryPipe
+	local, remote memoryAddr
+
+	read, written int64
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) op(kind MemoryOpKind, offset int64, size int) MemoryOp {
+	return MemoryOp{
+		Kind:   kind,
+		Addr:   c.addr,
+		Conn:   c.id,
+		Server: c.server,
+		Offset: offset,
+		Size:   size,
+	}
+}
+
+func (c *memoryConn) Read(p []byte) (int, error) {
+	if err := c.n.fault(c.op(MemoryRead, atomic.LoadInt64(&c.read), len(p))); err != nil {
+		c.Close()
+		return 0, err
+	}
+	n, err := c.r.read(p)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *memoryConn) Write(p []byte) (int, error) {
+	if err := c.n.fault(c.op(MemoryWrite, atomic.LoadInt64(&c.written), len(p))); err != nil {
+		c.Close()
+		return 0, err
+	}
+	n, err := c.w.write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// Close closes both directions. The peer reads the data written before
+// and then io.EOF.
+func (c *memoryConn) Close() error {
+	c.r.closeRead()
+	c.w.closeWrite()
+	return nil
+}
+
+// memoryPipe is a direction of a MemoryNetwork connection.
+type memoryPipe struct {
+	latency   time.Duration
+	bandwidth int64
+	size      int
+
+	mu       sync.Mutex
+	chunks   []memoryChunk
+	buffered int
+	// busy is the time the data written so far is transmitted at.
+	busy time.Time
+	// changed is closed on every change of the state.
+	changed     chan struct{}
+	readClosed  bool
+	writeClosed bool
+}
+
+// memoryChunk is the written data delivered at the given time.
+type memoryChunk struct {
+	data []byte
+	at   time.Time
+}
+
+// notify wakes the waiters up. It must be called with p.mu held.
+func (p *memoryPipe) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *memoryPipe) read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		p.mu.Lock()
+		if p.readClosed {
+			p.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		changed := p.changed
+		if len(p.chunks) > 0 {
+			c := &p.chunks[0]
+			if wait := time.Until(c.at); wait > 0 {
+				p.mu.Unlock()
+				t := acquireTimer(wait)
+				select {
+				case <-t.C:
+				case <-changed:
+				}
+				releaseTimer(t)
+				continue
+			}
+			n := copy(b, c.data)
+			if c.data = c.data[n:]; len(c.data) == 0 {
+				p.chunks[0] = memoryChunk{}
+				p.chunks = p.chunks[1:]
+			}
+			p.buffered -= n
+			p.notify()
+			p.mu.Unlock()
+			return n, nil
+		}
+		if p.writeClosed {
+			p.mu.Unlock()
+			return 0, io.EOF
+		}
+		p.mu.Unlock()
+		<-changed
+	}
+}
+
+func (p *memoryPipe) write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		p.mu.Lock()
+		if p.readClosed || p.writeClosed {
+			p.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		free := p.size - p.buffered
+		if free <= 0 {
+			changed := p.changed
+			p.mu.Unlock()
+			<-changed
+			continue
+		}
+		n := len(b) - written
+		if n > free {
+			n = free
+		}
+		now := time.Now()
+		at := now
+		if p.bandwidth > 0 {
+			if p.busy.Before(now) {
+				p.busy = now
+			}
+			p.busy = p.busy.Add(time.Duration(int64(n) * int64(time.Second) / p.bandwidth))
+			at = p.busy
+		}
+		p.chunks = append(p.chunks, memoryChunk{
+			data: append([]byte(nil), b[written:written+n]...),
+			at:   at.Add(p.latency),
+		})
+		p.buffered += n
+		p.notify()
+		p.mu.Unlock()
+		written += n
+	}
+	return written, nil
+}
+
+func (p *memoryPipe) closeRead() {
+	p.mu.Lock()
+	p.readClosed = true
+	p.chunks = nil
+	p.buffered = 0
+	p.notify()
+	p.mu.Unlock()
+}
+
+func (p *memoryPipe) closeWrite() {
+	p.mu.Lock()
+	p.writeClosed = true
+	p.notify()
+	p.mu.Unlock()
+}
+
+// NewMemoryClient creates a client connecting to the server listening
+// to the given addr of the MemoryNetwork.
+//
+// The returned client must be started after optional settings' adjustment.
+//
+// The corresponding server must be created with NewMemoryServer().
+func NewMemoryClient(addr string, n *MemoryNetwork) *Client {
+	return &Client{
+		Addr: addr,
+		Dial: n.Dial,
+	}
+}
+
+// NewMemoryServer creates a server listening to the given addr
+// of the MemoryNetwork and processing incoming requests
+// with the given HandlerFunc.
+//
+// The returned server must be started after optional settings' adjustment.
+//
+// The corresponding client must be created with NewMemoryClient().
+func NewMemoryServer(addr string, handler HandlerFunc, n *MemoryNetwork) *Server {
+	return &Server{
+		Addr:     addr,
+		Handler:  handler,
+		Listener: n.Listener(),
+	}
+}
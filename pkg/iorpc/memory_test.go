@@ -0,0 +1,147 @@
+package iorpc
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryEcho(t *testing.T, n *MemoryNetwork) (*Server, Service) {
+	d := NewDispatcher()
+	svc, _ := d.AddService("Echo", func(clientAddr string, request Request) (*Response, error) {
+		b, err := io.ReadAll(request.Body.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{Body: Body{Size: uint64(len(b)), Reader: &bodyBuffer{data: b}}}, nil
+	})
+	s := NewMemoryServer("", d.HandlerFunc(), n)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s, svc
+}
+
+func echoCall(c *Client, svc Service, data []byte) ([]byte, error) {
+	resp, err := c.Call(Request{Service: svc, Body: Body{
+		Size:   uint64(len(data)),
+		Reader: &bodyBuffer{data: data},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body.Reader)
+}
+
+func TestMemoryNetwork(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	n := &MemoryNetwork{Latency: 20 * time.Millisecond}
+	s, svc := newMemoryEcho(t, n)
+	defer s.Stop()
+
+	c := NewMemoryClient(s.Listener.ListenAddr().String(), n)
+	c.Start()
+	defer c.Stop()
+
+	// Connect first, the handshake takes the round trips too.
+	_, err := echoCall(c, svc, nil)
+	a.Nil(err)
+
+	data := bytes.Repeat([]byte("memory"), 10<<10)
+	start := time.Now()
+	got, err := echoCall(c, svc, data)
+	a.Nil(err)
+	a.Equal(data, got)
+	a.GreaterOrEqual(time.Since(start), 2*n.Latency)
+
+	_, err = NewMemoryClient("missing", n).Dial("missing")
+	a.True(errors.Is(err, ErrMemoryConnRefused))
+}
+
+func TestMemoryNetworkBandwidth(t *testing.T) {
+	a := assert.New(t)
+
+	n := &MemoryNetwork{Bandwidth: 10 << 20}
+	ln := n.Listener()
+	a.Nil(ln.Init(""))
+	defer ln.Close()
+
+	accepted := make(chan io.ReadWriteCloser, 1)
+	go func() {
+		conn, _, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := n.Dial(ln.ListenAddr().String())
+	a.Nil(err)
+	server := <-accepted
+
+	data := make([]byte, 1<<20)
+	start := time.Now()
+	go client.Write(data)
+	got, err := io.ReadAll(io.LimitReader(server, int64(len(data))))
+	a.Nil(err)
+	a.Equal(len(data), len(got))
+	a.GreaterOrEqual(time.Since(start), 100*time.Millisecond-time.Millisecond)
+
+	// The peer reads the data written before closing and then io.EOF.
+	client.Write([]byte("tail"))
+	client.Close()
+	got, err = io.ReadAll(server)
+	a.Nil(err)
+	a.Equal([]byte("tail"), got)
+	_, err = server.Write([]byte("x"))
+	a.Equal(io.ErrClosedPipe, err)
+}
+
+func TestMemoryNetworkFault(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	errInjected := errors.New("injected")
+	n := &MemoryNetwork{
+		Fault: func(op MemoryOp) error {
+			// The first connection breaks once the server sends 1KiB.
+			if op.Conn == 1 && op.Server && op.Kind == MemoryWrite && op.Offset >= 1<<10 {
+				return errInjected
+			}
+			return nil
+		},
+	}
+	s, svc := newMemoryEcho(t, n)
+	defer s.Stop()
+
+	c := NewMemoryClient(s.Listener.ListenAddr().String(), n)
+	c.Start()
+	defer c.Stop()
+
+	data := bytes.Repeat([]byte("x"), 4<<10)
+	_, err := echoCall(c, svc, data)
+	a.Nil(err)
+
+	_, err = echoCall(c, svc, data)
+	var clientErr *ClientError
+	if a.True(errors.As(err, &clientErr)) {
+		a.True(clientErr.Connection)
+	}
+
+	// The client reconnects over a healthy connection.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := echoCall(c, svc, data)
+		if err == nil {
+			a.Equal(data, got)
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
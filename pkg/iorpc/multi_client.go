@@ -0,0 +1,431 @@
+package iorpc
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxFailures is the default number of consecutive connection
+	// or timeout errors after which MultiClient ejects an endpoint.
+	DefaultMaxFailures = 3
+
+	// DefaultProbeInterval is the default interval between probes
+	// of the ejected endpoints.
+	DefaultProbeInterval = time.Second
+
+	// DefaultHashReplicas is the default number of points per endpoint
+	// on the consistent hashing ring.
+	DefaultHashReplicas = 128
+)
+
+// ErrNoEndpoints is returned by MultiClient when it has no endpoints.
+var ErrNoEndpoints = errors.New("no endpoints")
+
+// BalancePolicy selects the endpoint for every MultiClient call.
+type BalancePolicy int
+
+const (
+	// RoundRobin sends requests to the endpoints in turn.
+	RoundRobin BalancePolicy = iota
+
+	// LeastPending sends requests to the endpoint with the minimum
+	// Client.PendingRequestsCount.
+	LeastPending
+
+	// PowerOfTwoChoices picks two random endpoints and sends requests
+	// to the one with less pending requests.
+	PowerOfTwoChoices
+
+	// ConsistentHash sends requests with the same key to the same endpoint
+	// while it is healthy. Only the keys of an ejected endpoint move
+	// to other endpoints.
+	ConsistentHash
+)
+
+var balancePolicyNames = []string{
+	RoundRobin:        "roundrobin",
+	LeastPending:      "leastpending",
+	PowerOfTwoChoices: "p2c",
+	ConsistentHash:    "hash",
+}
+
+func (p BalancePolicy) String() string {
+	if p < 0 || int(p) >= len(balancePolicyNames) {
+		return "BalancePolicy(" + strconv.Itoa(int(p)) + ")"
+	}
+	return balancePolicyNames[p]
+}
+
+// ParseBalancePolicy returns the policy with the given name:
+// roundrobin, leastpending, p2c or hash.
+func ParseBalancePolicy(name string) (BalancePolicy, error) {
+	for p, n := range balancePolicyNames {
+		if n == name {
+			return BalancePolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown balance policy %q", name)
+}
+
+// MultiClient balances requests between servers listening on Addrs.
+//
+// Every address is served by its own Client. Endpoints returning
+// MaxFailures connection or timeout errors in a row are ejected and
+// receive no requests until a probe connection to them succeeds.
+// If all the endpoints are ejected, requests are sent to all of them.
+type MultiClient struct {
+	// Server addresses to connect to.
+	Addrs []string
+
+	// Policy for choosing the endpoint of every request.
+	// Default is RoundRobin.
+	Policy BalancePolicy
+
+	// NewClient creates a client for the given address.
+	// The client is started by MultiClient.
+	//
+	// By default NewTCPClient is used.
+	NewClient func(addr string) *Client
+
+	// The number of consecutive connection or timeout errors
+	// after which the endpoint is ejected.
+	// Default is DefaultMaxFailures.
+	MaxFailures int
+
+	// Interval between probes of the ejected endpoints.
+	// Default is DefaultProbeInterval.
+	ProbeInterval time.Duration
+
+	// The number of points per endpoint on the ConsistentHash ring.
+	// Default is DefaultHashReplicas.
+	HashReplicas int
+
+	// LogError is used for error logging.
+	//
+	// By default the function set via SetErrorLogger() is used.
+	LogError LoggerFunc
+
+	endpoints []*endpoint
+	ring      []ringPoint
+	next      atomic.Uint64
+
+	stopChan chan struct{}
+	stopWg   sync.WaitGroup
+}
+
+type endpoint struct {
+	client   *Client
+	failures atomic.Int32
+	ejected  atomic.Bool
+}
+
+type ringPoint struct {
+	hash     uint64
+	endpoint int
+}
+
+// EndpointStatus describes a MultiClient endpoint.
+type EndpointStatus struct {
+	Addr            string
+	Healthy         bool
+	PendingRequests int
+}
+
+// Start starts clients for all the Addrs.
+func (mc *MultiClient) Start() {
+	if mc.LogError == nil {
+		mc.LogError = errorLogger
+	}
+	if mc.stopChan != nil {
+		panic("gorpc.MultiClient: the given client is already started. Call MultiClient.Stop() before calling MultiClient.Start() again!")
+	}
+	if mc.NewClient == nil {
+		mc.NewClient = NewTCPClient
+	}
+	if mc.MaxFailures <= 0 {
+		mc.MaxFailures = DefaultMaxFailures
+	}
+	if mc.ProbeInterval <= 0 {
+		mc.ProbeInterval = DefaultProbeInterval
+	}
+	if mc.HashReplicas <= 0 {
+		mc.HashReplicas = DefaultHashReplicas
+	}
+
+	mc.endpoints = make([]*endpoint, len(mc.Addrs))
+	for i, addr := range mc.Addrs {
+		c := mc.NewClient(addr)
+		c.Start()
+		mc.endpoints[i] = &endpoint{client: c}
+	}
+
+	mc.ring = mc.ring[:0]
+	if mc.Policy == ConsistentHash {
+		for i, addr := range mc.Addrs {
+			for j := 0; j < mc.HashReplicas; j++ {
+				mc.ring = append(mc.ring, ringPoint{
+					hash:     hashKey(addr + "#" + strconv.Itoa(j)),
+					endpoint: i,
+				})
+			}
+		}
+		sort.Slice(mc.ring, func(i, j int) bool { return mc.ring[i].hash < mc.ring[j].hash })
+	}
+
+	mc.stopChan = make(chan struct{})
+	mc.stopWg.Add(1)
+	go mc.probeLoop()
+}
+
+// Stop stops all the clients.
+func (mc *MultiClient) Stop() {
+	if mc.stopChan == nil {
+		panic("gorpc.MultiClient: the client must be started before stopping it")
+	}
+	close(mc.stopChan)
+	mc.stopWg.Wait()
+	mc.stopChan = nil
+	for _, ep := range mc.endpoints {
+		ep.client.Stop()
+	}
+}
+
+// Endpoints returns the instant status of all the endpoints.
+func (mc *MultiClient) Endpoints() []EndpointStatus {
+	s := make([]EndpointStatus, len(mc.endpoints))
+	for i, ep := range mc.endpoints {
+		s[i] = EndpointStatus{
+			Addr:            ep.client.Addr,
+			Healthy:         !ep.ejected.Load(),
+			PendingRequests: ep.client.PendingRequestsCount(),
+		}
+	}
+	return s
+}
+
+// Stats returns the sum of statistics' snapshots of all the endpoints.
+func (mc *MultiClient) Stats() *ConnStats {
+	var sum ConnStats
+	for _, ep := range mc.endpoints {
+		s := ep.client.Stats.Snapshot()
+		sum.RPCCalls += s.RPCCalls
+		sum.RPCTime += s.RPCTime
+		sum.HeadWritten += s.HeadWritten
+		sum.BodyWritten += s.BodyWritten
+		sum.HeadRead += s.HeadRead
+		sum.BodyRead += s.BodyRead
+		sum.ReadCalls += s.ReadCalls
+		sum.ReadErrors += s.ReadErrors
+		sum.WriteCalls += s.WriteCalls
+		sum.WriteErrors += s.WriteErrors
+		sum.DialCalls += s.DialCalls
+		sum.DialErrors += s.DialErrors
+		sum.Retries += s.Retries
+		sum.Hedges += s.Hedges
+		sum.HedgeWins += s.HedgeWins
+		sum.Rejected += s.Rejected
+	}
+	return &sum
+}
+
+// Call sends the request to the endpoint chosen by Policy.
+// The key is used by ConsistentHash and ignored by other policies.
+//
+// The returned error can be casted to ClientError.
+func (mc *MultiClient) Call(key string, request Request) (Response, error) {
+	ep, err := mc.pick(key)
+	if err != nil {
+		return Response{}, err
+	}
+	resp, err := ep.client.Call(request)
+	mc.observe(ep, err)
+	return resp, err
+}
+
+// CallTimeout is like Call, but with the given timeout.
+func (mc *MultiClient) CallTimeout(key string, request Request, timeout time.Duration) (Response, error) {
+	ep, err := mc.pick(key)
+	if err != nil {
+		return Response{}, err
+	}
+	resp, err := ep.client.CallTimeout(request, timeout)
+	mc.observe(ep, err)
+	return resp, err
+}
+
+// CallByName is like Call, but resolves request.Service by the service name
+// on the chosen endpoint. Servers may register the services in different
+// order, so the ids must not be shared between endpoints.
+func (mc *MultiClient) CallByName(key, service string, request Request) (Response, error) {
+	ep, err := mc.pick(key)
+	if err != nil {
+		return Response{}, err
+	}
+	if request.Service, err = ep.client.Service(service); err != nil {
+		mc.observe(ep, err)
+		return Response{}, err
+	}
+	resp, err := ep.client.Call(request)
+	mc.observe(ep, err)
+	return resp, err
+}
+
+func (mc *MultiClient) pick(key string) (*endpoint, error) {
+	n := len(mc.endpoints)
+	if n == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	// Fail open: with all the endpoints ejected, use all of them.
+	healthy := func(ep *endpoint) bool { return !ep.ejected.Load() }
+	if !mc.anyHealthy() {
+		healthy = func(*endpoint) bool { return true }
+	}
+
+	switch mc.Policy {
+	case LeastPending:
+		var best *endpoint
+		bestPending := 0
+		for _, ep := range mc.endpoints {
+			if !healthy(ep) {
+				continue
+			}
+			if pending := ep.client.PendingRequestsCount(); best == nil || pending < bestPending {
+				best, bestPending = ep, pending
+			}
+		}
+		return best, nil
+	case PowerOfTwoChoices:
+		a := mc.randomEndpoint(healthy)
+		b := mc.randomEndpoint(healthy)
+		if b.client.PendingRequestsCount() < a.client.PendingRequestsCount() {
+			a = b
+		}
+		return a, nil
+	case ConsistentHash:
+		h := hashKey(key)
+		i := sort.Search(len(mc.ring), func(i int) bool { return mc.ring[i].hash >= h })
+		for j := 0; j < len(mc.ring); j++ {
+			ep := mc.endpoints[mc.ring[(i+j)%len(mc.ring)].endpoint]
+			if healthy(ep) {
+				return ep, nil
+			}
+		}
+		return mc.endpoints[0], nil
+	default:
+		for j := 0; j < n; j++ {
+			ep := mc.endpoints[mc.next.Add(1)%uint64(n)]
+			if healthy(ep) {
+				return ep, nil
+			}
+		}
+		return mc.endpoints[0], nil
+	}
+}
+
+func (mc *MultiClient) anyHealthy() bool {
+	for _, ep := range mc.endpoints {
+		if !ep.ejected.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+func (mc *MultiClient) randomEndpoint(healthy func(*endpoint) bool) *endpoint {
+	n := len(mc.endpoints)
+	start := rand.Intn(n)
+	for j := 0; j < n; j++ {
+		if ep := mc.endpoints[(start+j)%n]; healthy(ep) {
+			return ep
+		}
+	}
+	return mc.endpoints[start]
+}
+
+// observe tracks consecutive failures of the endpoint.
+// Server errors and overflows don't count, since the endpoint is reachable.
+func (mc *MultiClient) observe(ep *endpoint, err error) {
+	var clientErr *ClientError
+	if err == nil || !errors.As(err, &clientErr) || !(clientErr.Connection || clientErr.Timeout) {
+		if err == nil {
+			ep.failures.Store(0)
+		}
+		return
+	}
+	if int(ep.failures.Add(1)) >= mc.MaxFailures && ep.ejected.CompareAndSwap(false, true) {
+		mc.LogError("gorpc.MultiClient: [%s]. Ejecting endpoint after %d consecutive failures: [%s]", ep.client.Addr, mc.MaxFailures, err)
+	}
+}
+
+func (mc *MultiClient) probeLoop() {
+	defer mc.stopWg.Done()
+
+	t := time.NewTicker(mc.ProbeInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-mc.stopChan:
+			return
+		case <-t.C:
+		}
+		for _, ep := range mc.endpoints {
+			if !ep.ejected.Load() {
+				continue
+			}
+			if err := probeEndpoint(ep.client, mc.ProbeInterval); err != nil {
+				continue
+			}
+			ep.failures.Store(0)
+			ep.ejected.Store(false)
+			mc.LogError("gorpc.MultiClient: [%s]. Endpoint is healthy again", ep.client.Addr)
+		}
+	}
+}
+
+// probeEndpoint dials the server of c and completes the handshake,
+// so the server is not only listening, but also serving connections.
+func probeEndpoint(c *Client, timeout time.Duration) error {
+	conn, err := c.Dial(c.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if dc, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		dc.SetDeadline(time.Now().Add(timeout))
+	}
+	if c.OnConnect != nil {
+		if conn, err = c.OnConnect(c.Addr, conn); err != nil {
+			return err
+		}
+		defer conn.Close()
+	}
+	if _, err = conn.Write([]byte{handshakeServiceTable}); err != nil {
+		return err
+	}
+	_, err = readServiceTable(conn)
+	return err
+}
+
+// hashKey spreads FNV-1a hashes with the splitmix64 finalizer,
+// since FNV alone clusters short and similar keys on the ring.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
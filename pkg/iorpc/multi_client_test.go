@@ -0,0 +1,149 @@
+package iorpc
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func startEchoAddrServer(t *testing.T, addr string) *Server {
+	d := NewDispatcher()
+	var s *Server
+	d.AddService("Addr", func(clientAddr string, request Request) (*Response, error) {
+		name := []byte(s.Addr)
+		return &Response{Body: Body{Size: uint64(len(name)), Reader: &bodyBuffer{data: name}}}, nil
+	})
+	s = NewTCPServer(addr, d.HandlerFunc())
+	s.Services = d.Services()
+	if err := s.Listener.Init(s.Addr); err != nil {
+		t.Fatal(err)
+	}
+	s.Addr = s.Listener.ListenAddr().String()
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func callAddr(t *testing.T, mc *MultiClient, key string) (string, error) {
+	resp, err := mc.CallByName(key, "Addr", Request{})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(io.LimitReader(resp.Body.Reader, int64(resp.Body.Size)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), nil
+}
+
+func TestParseBalancePolicy(t *testing.T) {
+	a := assert.New(t)
+	for _, p := range []BalancePolicy{RoundRobin, LeastPending, PowerOfTwoChoices, ConsistentHash} {
+		got, err := ParseBalancePolicy(p.String())
+		a.Nil(err)
+		a.Equal(p, got)
+	}
+	_, err := ParseBalancePolicy("random")
+	a.NotNil(err)
+}
+
+func TestMultiClientRoundRobin(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	s1 := startEchoAddrServer(t, "127.0.0.1:0")
+	defer s1.Stop()
+	s2 := startEchoAddrServer(t, "127.0.0.1:0")
+	defer s2.Stop()
+
+	mc := &MultiClient{Addrs: []string{s1.Addr, s2.Addr}}
+	mc.Start()
+	defer mc.Stop()
+
+	hits := make(map[string]int)
+	for i := 0; i < 10; i++ {
+		addr, err := callAddr(t, mc, "")
+		a.Nil(err)
+		hits[addr]++
+	}
+	a.Equal(map[string]int{s1.Addr: 5, s2.Addr: 5}, hits)
+}
+
+func TestMultiClientConsistentHash(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	s1 := startEchoAddrServer(t, "127.0.0.1:0")
+	defer s1.Stop()
+	s2 := startEchoAddrServer(t, "127.0.0.1:0")
+	defer s2.Stop()
+
+	mc := &MultiClient{Addrs: []string{s1.Addr, s2.Addr}, Policy: ConsistentHash}
+	mc.Start()
+	defer mc.Stop()
+
+	owners := make(map[string]bool)
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		first, err := callAddr(t, mc, key)
+		a.Nil(err)
+		for i := 0; i < 3; i++ {
+			addr, err := callAddr(t, mc, key)
+			a.Nil(err)
+			a.Equal(first, addr)
+		}
+		owners[first] = true
+	}
+	a.Len(owners, 2)
+}
+
+func TestMultiClientEjectAndProbe(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	s1 := startEchoAddrServer(t, "127.0.0.1:0")
+	defer s1.Stop()
+	s2 := startEchoAddrServer(t, "127.0.0.1:0")
+	addr2 := s2.Addr
+
+	mc := &MultiClient{
+		Addrs:         []string{s1.Addr, addr2},
+		MaxFailures:   1,
+		ProbeInterval: 20 * time.Millisecond,
+		NewClient: func(addr string) *Client {
+			c := NewTCPClient(addr)
+			c.RequestTimeout = 200 * time.Millisecond
+			return c
+		},
+	}
+	mc.Start()
+	defer mc.Stop()
+
+	for i := 0; i < 2; i++ {
+		_, err := callAddr(t, mc, "")
+		a.Nil(err)
+	}
+
+	s2.Stop()
+	// The first call to the stopped endpoint fails and ejects it.
+	for i := 0; i < 2; i++ {
+		callAddr(t, mc, "")
+	}
+	a.False(mc.Endpoints()[1].Healthy)
+	for i := 0; i < 4; i++ {
+		addr, err := callAddr(t, mc, "")
+		a.Nil(err)
+		a.Equal(s1.Addr, addr)
+	}
+
+	s2 = startEchoAddrServer(t, addr2)
+	defer s2.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for !mc.Endpoints()[1].Healthy && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.True(mc.Endpoints()[1].Healthy)
+}
@@ -0,0 +1,354 @@
+package iorpc
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultRetryMaxAttempts is the default number of attempts
+	// made by RetryPolicy, including the first one.
+	DefaultRetryMaxAttempts = 3
+
+	// DefaultRetryInitialBackoff is the default delay before the first retry.
+	DefaultRetryInitialBackoff = 10 * time.Millisecond
+
+	// DefaultRetryMaxBackoff is the default upper bound for retry delays.
+	DefaultRetryMaxBackoff = time.Second
+
+	// DefaultRetryJitter is the default fraction of retry delays
+	// randomized by RetryPolicy.
+	DefaultRetryJitter = 0.2
+
+	// DefaultHedgePercentile is the default percentile of recent call
+	// latencies used as the hedging delay.
+	DefaultHedgePercentile = 0.95
+
+	// DefaultHedgeMinDelay is the default lower bound for the hedging delay.
+	DefaultHedgeMinDelay = time.Millisecond
+)
+
+// RetryPolicy repeats failed calls to idempotent services.
+//
+// Requests with a body are never retried, since the body reader
+// can be consumed only once.
+type RetryPolicy struct {
+	// The maximum number of attempts, including the first one.
+	// Default is DefaultRetryMaxAttempts.
+	MaxAttempts int
+
+	// The timeout of every attempt. The whole call, including backoffs,
+	// never exceeds the timeout passed to Client.CallTimeout.
+	//
+	// By default every attempt may take the rest of the call timeout,
+	// so timed out calls are not retried.
+	AttemptTimeout time.Duration
+
+	// The delay before the first retry.
+	// Default is DefaultRetryInitialBackoff.
+	InitialBackoff time.Duration
+
+	// The upper bound for the delay between retries.
+	// Default is DefaultRetryMaxBackoff.
+	MaxBackoff time.Duration
+
+	// The factor the delay grows by after every retry.
+	// Default is 2.
+	Multiplier float64
+
+	// The fraction of the delay randomized in both directions,
+	// so clients failed at the same time don't retry at the same time.
+	// Default is DefaultRetryJitter. Negative value disables jitter.
+	Jitter float64
+
+	// RetryOn reports whether the call failed with err may be retried.
+	// Default is IsRetriable.
+	RetryOn func(err error) bool
+
+	// Idempotent reports whether the request may be sent more than once.
+	// By default all the requests without a body are idempotent.
+	Idempotent func(request Request) bool
+}
+
+// HedgePolicy sends a copy of slow calls to idempotent services
+// and uses the first successful response. A copy failing while the other
+// one is in flight doesn't fail the call.
+//
+// The other copy is abandoned: it isn't sent if it's still queued,
+// otherwise the server handles it and its response is dropped.
+//
+// Requests with a body are never hedged, since the body reader
+// can be consumed only once. Headers of hedged requests may be encoded
+// concurrently, so Headers.Encode mustn't modify the headers.
+type HedgePolicy struct {
+	// The delay before sending the copy.
+	//
+	// By default the delay is the Percentile of recent call latencies.
+	// No copies are sent until enough latencies are collected.
+	Delay time.Duration
+
+	// The percentile of recent call latencies used as the delay.
+	// Default is DefaultHedgePercentile.
+	Percentile float64
+
+	// The lower bound for the delay derived from latencies.
+	// Default is DefaultHedgeMinDelay.
+	MinDelay time.Duration
+
+	// Idempotent reports whether the request may be sent more than once.
+	// By default all the requests without a body are idempotent.
+	Idempotent func(request Request) bool
+}
+
+// IsRetriable reports whether the call failed with err may succeed
+// when repeated: the error is a connection, timeout, overflow or busy
+// ClientError.
+func IsRetriable(err error) bool {
+	var clientErr *ClientError
+	if !errors.As(err, &clientErr) {
+		return false
+	}
+	return clientErr.Connection || clientErr.Timeout || clientErr.Overflow || clientErr.Busy
+}
+
+func isIdempotent(idempotent func(Request) bool, request Request) bool {
+	if request.Body.Size > 0 && request.Body.Reader != nil {
+		return false
+	}
+	return idempotent == nil || idempotent(request)
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultRetryMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryOn(err error) bool {
+	if p.RetryOn == nil {
+		return IsRetriable(err)
+	}
+	return p.RetryOn(err)
+}
+
+// backoff returns the delay before the retry following the given attempt.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	d, max, mult, jitter := p.InitialBackoff, p.MaxBackoff, p.Multiplier, p.Jitter
+	if d <= 0 {
+		d = DefaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	if jitter == 0 {
+		jitter = DefaultRetryJitter
+	}
+
+	f := float64(d)
+	for i := 0; i < attempt && f < float64(max); i++ {
+		f *= mult
+	}
+	if f > float64(max) {
+		f = float64(max)
+	}
+	if jitter > 0 {
+		f *= 1 + jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(f)
+}
+
+func (p *HedgePolicy) delay(latency *latencyTracker) time.Duration {
+	if p.Delay > 0 {
+		return p.Delay
+	}
+	d := latency.value()
+	if d <= 0 {
+		return 0
+	}
+	min := p.MinDelay
+	if min <= 0 {
+		min = DefaultHedgeMinDelay
+	}
+	if d < min {
+		d = min
+	}
+	return d
+}
+
+const (
+	latencySamples      = 1024
+	latencyMinSamples   = 64
+	latencyRecalcPeriod = 64
+)
+
+// latencyTracker keeps the given percentile of recent call latencies.
+type latencyTracker struct {
+	percentile float64
+
+	mu      sync.Mutex
+	samples [latencySamples]time.Duration
+	n       int
+
+	cached atomic.Int64
+}
+
+func newLatencyTracker(percentile float64) *latencyTracker {
+	if percentile <= 0 || percentile >= 1 {
+		percentile = DefaultHedgePercentile
+	}
+	return &latencyTracker{percentile: percentile}
+}
+
+func (lt *latencyTracker) record(d time.Duration) {
+	lt.mu.Lock()
+	lt.samples[lt.n%latencySamples] = d
+	lt.n++
+	if lt.n >= latencyMinSamples && lt.n%latencyRecalcPeriod == 0 {
+		n := lt.n
+		if n > latencySamples {
+			n = latencySamples
+		}
+		sorted := make([]time.Duration, n)
+		copy(sorted, lt.samples[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		lt.cached.Store(int64(sorted[int(lt.percentile*float64(n-1))]))
+	}
+	lt.mu.Unlock()
+}
+
+// value returns the percentile or 0 if not enough latencies are recorded.
+func (lt *latencyTracker) value() time.Duration {
+	return time.Duration(lt.cached.Load())
+}
+
+// callWithPolicies performs the call according to c.Retry and c.Hedge.
+func (c *Client) callWithPolicies(request Request, timeout time.Duration) (response Response, err error) {
+	deadline := time.Now().Add(timeout)
+	hedged := c.Hedge != nil && isIdempotent(c.Hedge.Idempotent, request)
+	attempts := 1
+	if c.Retry != nil && isIdempotent(c.Retry.Idempotent, request) {
+		attempts = c.Retry.maxAttempts()
+	}
+
+	for attempt := 0; ; attempt++ {
+		attemptTimeout := time.Until(deadline)
+		if c.Retry != nil && c.Retry.AttemptTimeout > 0 && c.Retry.AttemptTimeout < attemptTimeout {
+			attemptTimeout = c.Retry.AttemptTimeout
+		}
+
+		if hedged {
+			response, err = c.callHedged(request, attemptTimeout)
+		} else {
+			response, err = c.callTimeout(request, attemptTimeout)
+		}
+		if err == nil || attempt+1 >= attempts || !c.Retry.retryOn(err) {
+			return response, err
+		}
+
+		backoff := c.Retry.backoff(attempt)
+		if backoff >= time.Until(deadline) {
+			return response, err
+		}
+		time.Sleep(backoff)
+		c.Stats.incRetries()
+	}
+}
+
+// callHedged sends a copy of the request if no response arrives
+// during the hedging delay and returns the first successful response,
+// or the error of the original if both copies fail.
+func (c *Client) callHedged(request Request, timeout time.Duration) (response Response, err error) {
+	start := time.Now()
+	var m *AsyncResult
+	if m, err = c.callAsync(request, false, true); err != nil {
+		return Response{}, err
+	}
+
+	t := acquireTimer(timeout)
+	defer releaseTimer(t)
+
+	var hedgeChan <-chan time.Time
+	if delay := c.Hedge.delay(c.latency); delay > 0 && delay < timeout {
+		ht := acquireTimer(delay)
+		defer releaseTimer(ht)
+		hedgeChan = ht.C
+	}
+
+	done := m.Done
+	var hedge *AsyncResult
+	var hedgeDone <-chan struct{}
+	var hedgeStart time.Time
+	for {
+		select {
+		case <-done:
+			response, err = m.Response, m.Error
+			releaseAsyncResult(m)
+			m, done = nil, nil
+			if err != nil && hedge != nil {
+				// The copy in flight may still succeed.
+				continue
+			}
+			if hedge != nil {
+				abandonAsyncResult(hedge)
+			}
+			if err == nil {
+				c.latency.record(time.Since(start))
+			}
+			return response, err
+		case <-hedgeDone:
+			hedgeResponse, hedgeErr := hedge.Response, hedge.Error
+			releaseAsyncResult(hedge)
+			hedge, hedgeDone = nil, nil
+			if hedgeErr != nil {
+				if m != nil {
+					// The original in flight may still succeed.
+					continue
+				}
+				return Response{}, err
+			}
+			if m != nil {
+				abandonAsyncResult(m)
+			}
+			c.Stats.incHedgeWins()
+			c.latency.record(time.Since(hedgeStart))
+			return hedgeResponse, nil
+		case <-hedgeChan:
+			hedgeChan = nil
+			// The copy is best effort: on overflow keep waiting for the original.
+			if h, hedgeErr := c.callAsync(request, false, true); hedgeErr == nil {
+				hedge, hedgeDone, hedgeStart = h, h.Done, time.Now()
+				c.Stats.incHedges()
+			}
+		case <-t.C:
+			if m != nil {
+				abandonAsyncResult(m)
+			}
+			if hedge != nil {
+				abandonAsyncResult(hedge)
+			}
+			return Response{}, getClientTimeoutError(c, timeout)
+		}
+	}
+}
+
+// abandonAsyncResult cancels the call and releases its response
+// once it completes. The cancellation only stops the calls not sent yet,
+// the server still handles the request it has received.
+func abandonAsyncResult(m *AsyncResult) {
+	m.Cancel()
+	go func() {
+		<-m.Done
+		if m.Error == nil {
+			m.Response.Body.Close()
+		}
+		releaseAsyncResult(m)
+	}()
+}
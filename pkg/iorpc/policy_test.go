@@ -0,0 +1,137 @@
+package iorpc
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	a := assert.New(t)
+
+	p := &RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Jitter: -1}
+	a.Equal(10*time.Millisecond, p.backoff(0))
+	a.Equal(20*time.Millisecond, p.backoff(1))
+	a.Equal(40*time.Millisecond, p.backoff(2))
+	a.Equal(50*time.Millisecond, p.backoff(3))
+	a.Equal(50*time.Millisecond, p.backoff(100))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(0)
+		a.GreaterOrEqual(d, 5*time.Millisecond)
+		a.LessOrEqual(d, 15*time.Millisecond)
+	}
+}
+
+func TestLatencyTrackerPercentile(t *testing.T) {
+	a := assert.New(t)
+
+	lt := newLatencyTracker(0.95)
+	for i := 1; i < latencyMinSamples; i++ {
+		lt.record(time.Duration(i) * time.Millisecond)
+	}
+	a.Equal(time.Duration(0), lt.value())
+
+	for i := 0; i < latencySamples; i++ {
+		lt.record(time.Duration(i%100+1) * time.Millisecond)
+	}
+	a.InDelta(float64(95*time.Millisecond), float64(lt.value()), float64(2*time.Millisecond))
+}
+
+// startSlowFirstServer starts a server, which delays its first response.
+func startSlowFirstServer(t *testing.T, delay time.Duration) *Server {
+	var calls atomic.Int32
+	return startPolicyServer(t, func(clientAddr string, request Request) (*Response, error) {
+		if calls.Add(1) == 1 {
+			time.Sleep(delay)
+		}
+		return &Response{}, nil
+	})
+}
+
+func startPolicyServer(t *testing.T, handler HandlerFunc) *Server {
+	d := NewDispatcher()
+	d.AddService("Slow", handler)
+	s := NewTCPServer("127.0.0.1:0", d.HandlerFunc())
+	if err := s.Listener.Init(s.Addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestClientRetryOnTimeout(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	s := startSlowFirstServer(t, 300*time.Millisecond)
+	defer s.Stop()
+
+	c := NewTCPClient(s.Listener.ListenAddr().String())
+	c.Retry = &RetryPolicy{AttemptTimeout: 50 * time.Millisecond, InitialBackoff: time.Millisecond}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.CallTimeout(Request{}, time.Second)
+	a.Nil(err)
+	a.Equal(uint64(1), c.Stats.Snapshot().Retries)
+
+	// Requests with a body are never retried.
+	a.False(isIdempotent(nil, Request{Body: Body{Size: 1, Reader: &bodyBuffer{data: []byte{1}}}}))
+}
+
+func TestClientHedge(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	s := startSlowFirstServer(t, 300*time.Millisecond)
+	defer s.Stop()
+
+	c := NewTCPClient(s.Listener.ListenAddr().String())
+	c.Hedge = &HedgePolicy{Delay: 20 * time.Millisecond}
+	c.Start()
+	defer c.Stop()
+
+	start := time.Now()
+	_, err := c.CallTimeout(Request{}, time.Second)
+	a.Nil(err)
+	a.Less(time.Since(start), 200*time.Millisecond)
+
+	stats := c.Stats.Snapshot()
+	a.Equal(uint64(1), stats.Hedges)
+	a.Equal(uint64(1), stats.HedgeWins)
+}
+
+func TestClientHedgeOriginalFails(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	// The original fails while the copy is in flight.
+	var calls atomic.Int32
+	s := startPolicyServer(t, func(clientAddr string, request Request) (*Response, error) {
+		if calls.Add(1) == 1 {
+			time.Sleep(50 * time.Millisecond)
+			return nil, errors.New("failing replica")
+		}
+		time.Sleep(100 * time.Millisecond)
+		return &Response{}, nil
+	})
+	defer s.Stop()
+
+	c := NewTCPClient(s.Listener.ListenAddr().String())
+	c.Hedge = &HedgePolicy{Delay: 20 * time.Millisecond}
+	c.Start()
+	defer c.Stop()
+
+	_, err := c.CallTimeout(Request{}, time.Second)
+	a.Nil(err)
+	stats := c.Stats.Snapshot()
+	a.Equal(uint64(1), stats.Hedges)
+	a.Equal(uint64(1), stats.HedgeWins)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -62,10 +63,43 @@ type Server struct {
 	// Hint: use Dispatcher for HandlerFunc construction.
 	Handler HandlerFunc
 
+	// Services is the name->id table advertised to clients on connect.
+	//
+	// Clients resolve services by name via Client.Service using this table.
+	//
+	// Hint: use Dispatcher.Services for the table construction.
+	//
+	// The calls of the services missing from the table are counted
+	// together in the stats of UnknownService.
+	Services map[string]Service
+
 	// The maximum number of concurrent rpc calls the server may perform.
 	// Default is DefaultConcurrency.
+	//
+	// The calls are shared between the client connections in round-robin
+	// order, see Weight and MaxConnConcurrency.
 	Concurrency int
 
+	// The maximum number of concurrent rpc calls of a single client
+	// connection.
+	//
+	// By default a connection may take all the Concurrency.
+	MaxConnConcurrency int
+
+	// Weight returns the share of Concurrency the client connection gets
+	// relative to the others while the server is overloaded: a connection
+	// of weight w is granted up to w calls in a row.
+	//
+	// By default all the connections have weight 1.
+	Weight func(clientAddr string) int
+
+	// The maximum time a request waits for one of Concurrency calls.
+	// The request is rejected afterwards, so the client gets a ClientError
+	// with Busy set.
+	//
+	// By default requests wait until the call is available.
+	QueueTimeout time.Duration
+
 	// The maximum delay between response flushes to clients.
 	//
 	// Negative values lead to immediate requests' sending to the client
@@ -87,6 +121,13 @@ type Server struct {
 	// Default is DefaultBufferSize.
 	RecvBufferSize int
 
+	// Buffer bodies of at least ZeroCopyMinSize bytes are sent to TCP
+	// connections with MSG_ZEROCOPY and closed once the kernel completes
+	// the send. Smaller bodies are copied.
+	//
+	// Zero-copy sends are disabled by default.
+	ZeroCopyMinSize int
+
 	// OnConnect is called whenever connection from client is accepted.
 	// The callback can be used for authentication/authorization/encryption
 	// and/or for custom transport wrapping.
@@ -110,6 +151,34 @@ type Server struct {
 	// By default it returns TCP connections accepted from Server.Addr.
 	Listener Listener
 
+	// The maximum size of headers accepted from the client.
+	// Default is DefaultMaxHeaderSize.
+	MaxHeaderSize int
+
+	// The maximum size of a body accepted from the client.
+	// Larger messages are treated as protocol errors and close the connection.
+	// Default is DefaultMaxBodySize.
+	MaxBodySize int
+
+	// Interval of application-level pings sent to the client on idle
+	// connections.
+	//
+	// Zero value disables pings.
+	PingInterval time.Duration
+
+	// The connection is closed if nothing has been received from
+	// the client during PingTimeout.
+	//
+	// PingTimeout must exceed the time of receiving the largest request.
+	// Default value is 3*PingInterval.
+	PingTimeout time.Duration
+
+	// HeadersRegistry maps request and response headers to their wire ids.
+	//
+	// By default a copy of the headers registered via RegisterHeaders()
+	// is taken on start.
+	HeadersRegistry *HeadersRegistry
+
 	// LogError is used for error logging.
 	//
 	// By default the function set via SetErrorLogger() is used.
@@ -125,6 +194,13 @@ type Server struct {
 	// This is useful for save memory when you don't need the body.
 	CloseBody bool
 
+	serviceStats  serviceStatsSet
+	knownServices map[Service]string
+	admission     *admission
+
+	connsLock sync.Mutex
+	conns     map[*serverConn]struct{}
+
 	serverStopChan chan struct{}
 	stopWg         sync.WaitGroup
 }
@@ -163,6 +239,18 @@ func (s *Server) Start() error {
 	if s.RecvBufferSize <= 0 {
 		s.RecvBufferSize = DefaultBufferSize
 	}
+	if s.MaxHeaderSize <= 0 {
+		s.MaxHeaderSize = DefaultMaxHeaderSize
+	}
+	if s.MaxBodySize <= 0 {
+		s.MaxBodySize = DefaultMaxBodySize
+	}
+	if s.HeadersRegistry == nil {
+		s.HeadersRegistry = globalHeaders.clone()
+	}
+	if s.PingInterval > 0 && s.PingTimeout <= 0 {
+		s.PingTimeout = 3 * s.PingInterval
+	}
 
 	if s.Listener == nil {
 		s.Listener = &defaultListener{}
@@ -176,9 +264,10 @@ func (s *Server) Start() error {
 		}
 	}
 
-	workersCh := make(chan struct{}, s.Concurrency)
+	s.admission = newAdmission(s.Concurrency)
+	s.knownServices = serviceNames(s.Services)
 	s.stopWg.Add(1)
-	go serverHandler(s, workersCh)
+	go serverHandler(s)
 	return nil
 }
 
@@ -201,7 +290,7 @@ func (s *Server) Serve() error {
 	return nil
 }
 
-func serverHandler(s *Server, workersCh chan struct{}) {
+func serverHandler(s *Server) {
 	defer s.stopWg.Done()
 
 	var conn io.ReadWriteCloser
@@ -241,11 +330,11 @@ func serverHandler(s *Server, workersCh chan struct{}) {
 		}
 
 		s.stopWg.Add(1)
-		go serverHandleConnection(s, conn, clientAddr, workersCh)
+		go serverHandleConnection(s, conn, clientAddr)
 	}
 }
 
-func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr string, workersCh chan struct{}) {
+func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr string) {
 	defer s.stopWg.Done()
 
 	if s.OnConnect != nil {
@@ -257,12 +346,13 @@ func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr strin
 		}
 		conn = newConn
 	}
+	conn = withZeroCopy(conn, s.ZeroCopyMinSize)
 
-	var enabledCompression bool
+	var handshake byte
 	var err error
 	var stopping atomic.Value
 
-	zChan := make(chan bool, 1)
+	zChan := make(chan byte, 1)
 	go func() {
 		var buf [1]byte
 		if _, err = conn.Read(buf[:]); err != nil {
@@ -270,10 +360,10 @@ func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr strin
 				s.LogError("gorpc.Server: [%s]->[%s]. Error when reading handshake from client: [%s]", clientAddr, s.Addr, err)
 			}
 		}
-		zChan <- (buf[0] != 0)
+		zChan <- buf[0]
 	}()
 	select {
-	case enabledCompression = <-zChan:
+	case handshake = <-zChan:
 		if err != nil {
 			conn.Close()
 			return
@@ -288,16 +378,59 @@ func serverHandleConnection(s *Server, conn io.ReadWriteCloser, clientAddr strin
 		return
 	}
 
+	enabledCompression := handshake&handshakeCompression != 0
+	if handshake&handshakeServiceTable != 0 {
+		if err = writeServiceTable(conn, s.Services); err != nil {
+			s.LogError("gorpc.Server: [%s]->[%s]. Error when writing service table to client: [%s]", clientAddr, s.Addr, err)
+			conn.Close()
+			return
+		}
+	}
+
 	responsesChan := make(chan *serverMessage, s.PendingResponses)
 	stopChan := make(chan struct{})
 
+	weight := 1
+	if s.Weight != nil {
+		weight = s.Weight(clientAddr)
+	}
+	sc := &serverConn{
+		clientAddr: clientAddr,
+		since:      time.Now(),
+		responses:  responsesChan,
+		admission:  newAdmissionConn(weight, s.MaxConnConcurrency),
+	}
+	s.addConn(sc)
+	defer s.removeConn(sc)
+
+	sendCtrl := func(id uint64) {
+		m := serverMessagePool.Get().(*serverMessage)
+		m.ID = id
+		select {
+		case responsesChan <- m:
+		default:
+			serverMessagePool.Put(m)
+		}
+	}
+	deadChan := make(chan struct{})
+	ka := newKeepalive(s.PingInterval, s.PingTimeout)
+	if ka != nil {
+		go ka.run(stopChan, func() { sendCtrl(pingID) }, deadChan)
+	}
+
 	readerDone := make(chan struct{})
-	go serverReader(s, conn, clientAddr, responsesChan, stopChan, readerDone, enabledCompression, workersCh)
+	go serverReader(s, sc, conn, clientAddr, responsesChan, stopChan, readerDone, enabledCompression, ka, sendCtrl)
 
 	writerDone := make(chan struct{})
-	go serverWriter(s, conn, clientAddr, responsesChan, stopChan, writerDone, enabledCompression)
+	go serverWriter(s, sc, conn, clientAddr, responsesChan, stopChan, writerDone, enabledCompression)
 
 	select {
+	case <-deadChan:
+		s.LogError("gorpc.Server: [%s]->[%s]. Client hasn't responded during PingTimeout=%s", clientAddr, s.Addr, s.PingTimeout)
+		close(stopChan)
+		conn.Close()
+		<-readerDone
+		<-writerDone
 	case <-readerDone:
 		close(stopChan)
 		conn.Close()
@@ -319,6 +452,7 @@ type serverMessage struct {
 	Request    *Request
 	Response   *Response
 	Error      string
+	Busy       bool
 	ClientAddr string
 }
 
@@ -328,6 +462,122 @@ var serverMessagePool = &sync.Pool{
 	},
 }
 
+// serverConn is a client connection listed by Server.Conns.
+type serverConn struct {
+	// inFlight is the number of requests being handled.
+	inFlight int64
+
+	clientAddr string
+	since      time.Time
+	stats      ConnStats
+	responses  chan *serverMessage
+	admission  *admissionConn
+}
+
+func (s *Server) addConn(sc *serverConn) {
+	s.connsLock.Lock()
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]struct{})
+	}
+	s.conns[sc] = struct{}{}
+	s.connsLock.Unlock()
+}
+
+func (s *Server) removeConn(sc *serverConn) {
+	s.connsLock.Lock()
+	delete(s.conns, sc)
+	s.connsLock.Unlock()
+}
+
+// ConnInfo describes a client connection of the Server.
+type ConnInfo struct {
+	// ClientAddr is the address returned by Listener.Accept().
+	ClientAddr string
+
+	// Since is the time the connection was accepted.
+	Since time.Time
+
+	// Stats are the connection statistics. Dial and Accept counters
+	// are always zero.
+	Stats *ConnStats
+
+	// InFlight is the number of requests being handled.
+	InFlight int
+
+	// QueueDepth is the number of responses waiting to be written.
+	QueueDepth int
+}
+
+// Conns returns the client connections, ordered by the time they were
+// accepted.
+func (s *Server) Conns() []ConnInfo {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	return s.connsLocked()
+}
+
+func (s *Server) connsLocked() []ConnInfo {
+	conns := make([]ConnInfo, 0, len(s.conns))
+	for sc := range s.conns {
+		conns = append(conns, ConnInfo{
+			ClientAddr: sc.clientAddr,
+			Since:      sc.since,
+			Stats:      sc.stats.Snapshot(),
+			InFlight:   int(atomic.LoadInt64(&sc.inFlight)),
+			QueueDepth: len(sc.responses),
+		})
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].Since.Before(conns[j].Since) })
+	return conns
+}
+
+// ServiceStats returns the snapshot of the per-service statistics
+// of the handled requests, ordered by service.
+//
+// The stats doesn't reset automatically, see Server.ResetServiceStats.
+func (s *Server) ServiceStats() []ServiceStats {
+	names := serviceNames(s.Services)
+	names[UnknownService] = "unknown"
+	return s.serviceStats.snapshot(names)
+}
+
+// ResetServiceStats resets the per-service statistics.
+func (s *Server) ResetServiceStats() {
+	s.serviceStats.reset()
+}
+
+// ServerSnapshot is the view of the Server statistics returned
+// by Server.Snapshot.
+type ServerSnapshot struct {
+	// Time is the time the snapshot was taken at.
+	Time time.Time
+
+	// Stats is the snapshot of Server.Stats.
+	Stats *ConnStats
+
+	// Services is the snapshot of the per-service statistics.
+	Services []ServiceStats
+
+	// Conns are the client connections.
+	Conns []ConnInfo
+}
+
+// Snapshot returns the aggregate, per-service and per-connection statistics
+// taken together.
+//
+// Connections are neither registered nor unregistered while the snapshot
+// is taken, so Conns matches the connections served at Time.
+func (s *Server) Snapshot() *ServerSnapshot {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+	return &ServerSnapshot{
+		Time:     time.Now(),
+		Stats:    s.Stats.Snapshot(),
+		Services: s.ServiceStats(),
+		Conns:    s.connsLocked(),
+	}
+}
+
 func isClientDisconnect(err error) bool {
 	return err == io.ErrUnexpectedEOF || err == io.EOF
 }
@@ -341,8 +591,9 @@ func isServerStop(stopChan <-chan struct{}) bool {
 	}
 }
 
-func serverReader(s *Server, r io.Reader, clientAddr string, responsesChan chan<- *serverMessage,
-	stopChan <-chan struct{}, done chan<- struct{}, enabledCompression bool, workersCh chan struct{}) {
+func serverReader(s *Server, sc *serverConn, r io.Reader, clientAddr string, responsesChan chan<- *serverMessage,
+	stopChan <-chan struct{}, done chan<- struct{}, enabledCompression bool,
+	ka *keepalive, sendCtrl func(id uint64)) {
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -351,7 +602,11 @@ func serverReader(s *Server, r io.Reader, clientAddr string, responsesChan chan<
 		close(done)
 	}()
 
-	d := newMessageDecoder(r, &s.Stats, s.CloseBody)
+	d := newMessageDecoder(r, connStatsTee{conn: &sc.stats, total: &s.Stats}, s.HeadersRegistry, messageLimits{
+		headerSize: uint64(s.MaxHeaderSize),
+		bodySize:   uint64(s.MaxBodySize),
+		errorSize:  uint64(DefaultMaxErrorSize),
+	}, s.CloseBody)
 	defer d.Close()
 
 	var wr wireRequest
@@ -362,6 +617,19 @@ func serverReader(s *Server, r io.Reader, clientAddr string, responsesChan chan<
 			}
 			return
 		}
+		ka.touch()
+
+		if isControlID(wr.ID) {
+			if wr.ID == pingID {
+				sendCtrl(pongID)
+			}
+			wr.Body.Close()
+			wr.ID = 0
+			wr.Service = 0
+			wr.Headers = nil
+			wr.Body.Reset()
+			continue
+		}
 
 		m := serverMessagePool.Get().(*serverMessage)
 		m.ID = wr.ID
@@ -377,20 +645,34 @@ func serverReader(s *Server, r io.Reader, clientAddr string, responsesChan chan<
 		wr.Headers = nil
 		wr.Body.Reset()
 
-		select {
-		case workersCh <- struct{}{}:
-		default:
+		if err := s.admission.acquire(sc.admission, s.QueueTimeout, stopChan); err != nil {
+			m.Request.Body.Close()
+			m.Request = nil
+			m.ClientAddr = ""
+			if err == errAdmissionStopped {
+				serverMessagePool.Put(m)
+				return
+			}
+			s.Stats.incRejected()
+			sc.stats.incRejected()
+			if m.ID == 0 {
+				serverMessagePool.Put(m)
+				continue
+			}
+			m.Busy = true
 			select {
-			case workersCh <- struct{}{}:
+			case responsesChan <- m:
 			case <-stopChan:
 				return
 			}
+			continue
 		}
-		go serveRequest(s, responsesChan, stopChan, m, workersCh)
+		atomic.AddInt64(&sc.inFlight, 1)
+		go serveRequest(s, sc, responsesChan, stopChan, m)
 	}
 }
 
-func serveRequest(s *Server, responsesChan chan<- *serverMessage, stopChan <-chan struct{}, m *serverMessage, workersCh <-chan struct{}) {
+func serveRequest(s *Server, sc *serverConn, responsesChan chan<- *serverMessage, stopChan <-chan struct{}, m *serverMessage) {
 	request := m.Request
 	m.Request = nil
 	clientAddr := m.ClientAddr
@@ -401,12 +683,23 @@ func serveRequest(s *Server, responsesChan chan<- *serverMessage, stopChan <-cha
 		m.Response = nil
 		m.Error = ""
 		s.Stats.incRPCCalls()
+		sc.stats.incRPCCalls()
 		serverMessagePool.Put(m)
 	}
 
 	t := time.Now()
 	response, err := callHandlerWithRecover(s.LogError, s.Handler, clientAddr, s.Addr, *request)
-	s.Stats.incRPCTime(uint64(time.Since(t).Seconds() * 1000))
+	dt := time.Since(t)
+	s.Stats.incRPCTime(uint64(dt.Microseconds()))
+	sc.stats.incRPCTime(uint64(dt.Microseconds()))
+	svc := request.Service
+	if _, ok := s.knownServices[svc]; !ok {
+		// The ids come from the clients, so the unknown ones share
+		// an entry rather than growing the stats without a bound.
+		svc = UnknownService
+	}
+	s.serviceStats.record(svc, dt, err != "")
+	atomic.AddInt64(&sc.inFlight, -1)
 
 	if !skipResponse {
 		m.Response = response
@@ -424,7 +717,7 @@ func serveRequest(s *Server, responsesChan chan<- *serverMessage, stopChan <-cha
 		}
 	}
 
-	<-workersCh
+	s.admission.release(sc.admission)
 }
 
 func callHandlerWithRecover(logErrorFunc LoggerFunc, handler HandlerFunc, clientAddr, serverAddr string, request Request) (response *Response, errStr string) {
@@ -443,12 +736,17 @@ func callHandlerWithRecover(logErrorFunc LoggerFunc, handler HandlerFunc, client
 	return response, ""
 }
 
-func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-chan *serverMessage, stopChan <-chan struct{}, done chan<- struct{}, enabledCompression bool) {
+func serverWriter(s *Server, sc *serverConn, w io.Writer, clientAddr string, responsesChan <-chan *serverMessage, stopChan <-chan struct{}, done chan<- struct{}, enabledCompression bool) {
 	defer func() { close(done) }()
 
-	e := newMessageEncoder(w, &s.Stats)
+	e := newMessageEncoder(w, connStatsTee{conn: &sc.stats, total: &s.Stats}, s.HeadersRegistry)
 	defer e.Close()
 
+	// The encoder buffers the response headers until the next body or
+	// a full buffer. The timer flushes the responses without a body,
+	// such as pongs and errors, after FlushDelay.
+	t := time.NewTimer(s.FlushDelay)
+	var flushChan <-chan time.Time
 	var wr wireResponse
 	for {
 		var m *serverMessage
@@ -463,11 +761,23 @@ func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-cha
 			case <-stopChan:
 				return
 			case m = <-responsesChan:
+			case <-flushChan:
+				if err := e.Flush(); err != nil {
+					s.LogError("gorpc.Server: [%s]->[%s]. Cannot flush responses to underlying stream: [%s]", clientAddr, s.Addr, err)
+					return
+				}
+				flushChan = nil
+				continue
 			}
 		}
 
+		if flushChan == nil {
+			flushChan = getFlushChan(t, s.FlushDelay)
+		}
+
 		wr.ID = m.ID
 		wr.Error = m.Error
+		wr.Busy = m.Busy
 		if m.Response != nil {
 			wr.Body = m.Response.Body
 			wr.Headers = m.Response.Headers
@@ -475,6 +785,7 @@ func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-cha
 
 		m.Response = nil
 		m.Error = ""
+		m.Busy = false
 		serverMessagePool.Put(m)
 
 		if err := e.EncodeResponse(wr); err != nil {
@@ -484,6 +795,9 @@ func serverWriter(s *Server, w io.Writer, clientAddr string, responsesChan <-cha
 		wr.Body.Reset()
 		wr.Headers = nil
 
-		s.Stats.incRPCCalls()
+		if !isControlID(wr.ID) && !wr.Busy {
+			s.Stats.incRPCCalls()
+			sc.stats.incRPCCalls()
+		}
 	}
 }
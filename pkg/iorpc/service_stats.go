@@ -0,0 +1,167 @@
+package iorpc
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+// UnknownService is the service of the server stats of the calls
+// of the services missing from Server.Services.
+const UnknownService Service = 1<<32 - 1
+
+// LatencyBuckets is the number of buckets of LatencyHistogram.
+const LatencyBuckets = 32
+
+// LatencyHistogram counts latencies in power of 2 microsecond buckets.
+//
+// Buckets[0] counts the latencies below 1µs, Buckets[i] the ones
+// in [2^(i-1), 2^i)µs. The last bucket counts all the longer latencies too.
+type LatencyHistogram struct {
+	Buckets [LatencyBuckets]uint64
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	i := bits.Len64(uint64(d / time.Microsecond))
+	if i >= LatencyBuckets {
+		i = LatencyBuckets - 1
+	}
+	h.Buckets[i]++
+}
+
+// Count returns the number of observed latencies.
+func (h *LatencyHistogram) Count() uint64 {
+	var n uint64
+	for _, c := range h.Buckets {
+		n += c
+	}
+	return n
+}
+
+// Quantile returns the upper bound of the bucket holding the q-quantile,
+// 0 < q <= 1, or 0 if nothing is observed.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(n))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, c := range h.Buckets {
+		seen += c
+		if seen >= rank {
+			return time.Duration(uint64(1)<<i) * time.Microsecond
+		}
+	}
+	return time.Duration(uint64(1)<<(LatencyBuckets-1)) * time.Microsecond
+}
+
+// ServiceStats provides the statistics of a single service.
+//
+// Use stats returned from Client.ServiceStats() and Server.ServiceStats(),
+// the original stats are updated by concurrently running goroutines.
+type ServiceStats struct {
+	Service Service
+
+	// Name is the service name from the service table, if any.
+	Name string
+
+	// The number of calls performed.
+	Calls uint64
+
+	// The number of calls failed with an error.
+	Errors uint64
+
+	// The total aggregate time of all the calls.
+	Time time.Duration
+
+	// The distribution of the call times.
+	Latency LatencyHistogram
+}
+
+// AvgTime returns the average call time.
+func (ss *ServiceStats) AvgTime() time.Duration {
+	if ss.Calls == 0 {
+		return 0
+	}
+	return ss.Time / time.Duration(ss.Calls)
+}
+
+type serviceStatsEntry struct {
+	mu    sync.Mutex
+	stats ServiceStats
+}
+
+// serviceStatsSet keeps the stats of every called service.
+type serviceStatsSet struct {
+	mu      sync.RWMutex
+	entries map[Service]*serviceStatsEntry
+}
+
+func (set *serviceStatsSet) entry(svc Service) *serviceStatsEntry {
+	set.mu.RLock()
+	e := set.entries[svc]
+	set.mu.RUnlock()
+	if e != nil {
+		return e
+	}
+
+	set.mu.Lock()
+	defer set.mu.Unlock()
+	if e = set.entries[svc]; e == nil {
+		if set.entries == nil {
+			set.entries = make(map[Service]*serviceStatsEntry)
+		}
+		e = &serviceStatsEntry{stats: ServiceStats{Service: svc}}
+		set.entries[svc] = e
+	}
+	return e
+}
+
+func (set *serviceStatsSet) record(svc Service, dt time.Duration, failed bool) {
+	e := set.entry(svc)
+	e.mu.Lock()
+	e.stats.Calls++
+	if failed {
+		e.stats.Errors++
+	}
+	e.stats.Time += dt
+	e.stats.Latency.observe(dt)
+	e.mu.Unlock()
+}
+
+// snapshot returns the stats ordered by service, naming the services
+// found in names.
+func (set *serviceStatsSet) snapshot(names map[Service]string) []ServiceStats {
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	stats := make([]ServiceStats, 0, len(set.entries))
+	for _, e := range set.entries {
+		e.mu.Lock()
+		ss := e.stats
+		e.mu.Unlock()
+		ss.Name = names[ss.Service]
+		stats = append(stats, ss)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Service < stats[j].Service })
+	return stats
+}
+
+func (set *serviceStatsSet) reset() {
+	set.mu.Lock()
+	set.entries = nil
+	set.mu.Unlock()
+}
+
+// serviceNames returns the id->name map of the service table.
+func serviceNames(services map[string]Service) map[Service]string {
+	names := make(map[Service]string, len(services))
+	for name, svc := range services {
+		names[svc] = name
+	}
+	return names
+}
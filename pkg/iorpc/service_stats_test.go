@@ -0,0 +1,114 @@
+package iorpc
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	a := assert.New(t)
+
+	var h LatencyHistogram
+	a.Equal(time.Duration(0), h.Quantile(0.5))
+
+	h.observe(500 * time.Nanosecond)
+	for i := 0; i < 8; i++ {
+		h.observe(100 * time.Microsecond)
+	}
+	h.observe(3 * time.Millisecond)
+
+	a.Equal(uint64(10), h.Count())
+	a.Equal(uint64(1), h.Buckets[0])
+	a.Equal(uint64(8), h.Buckets[7])
+	a.Equal(time.Microsecond, h.Quantile(0.1))
+	a.Equal(128*time.Microsecond, h.Quantile(0.5))
+	a.Equal(4096*time.Microsecond, h.Quantile(1))
+
+	h.observe(time.Hour)
+	a.Equal(uint64(1), h.Buckets[LatencyBuckets-1])
+}
+
+func TestServiceStats(t *testing.T) {
+	a := assert.New(t)
+	SetErrorLogger(NilErrorLogger)
+
+	d := NewDispatcher()
+	echo, _ := d.AddService("Echo", func(clientAddr string, request Request) (*Response, error) {
+		return &Response{}, nil
+	})
+	fail, _ := d.AddService("Fail", func(clientAddr string, request Request) (*Response, error) {
+		return nil, errors.New("failed")
+	})
+
+	s := NewTCPServer("127.0.0.1:0", d.HandlerFunc())
+	s.Services = d.Services()
+	a.Nil(s.Listener.Init(s.Addr))
+	a.Nil(s.Start())
+	defer s.Stop()
+
+	c := NewTCPClient(s.Listener.ListenAddr().String())
+	c.Start()
+
+	for i := 0; i < 5; i++ {
+		_, err := c.Call(Request{Service: echo})
+		a.Nil(err)
+	}
+	_, err := c.Call(Request{Service: fail})
+	a.NotNil(err)
+
+	for _, stats := range [][]ServiceStats{c.ServiceStats(), s.ServiceStats()} {
+		if !a.Len(stats, 2) {
+			continue
+		}
+		a.Equal("Echo", stats[0].Name)
+		a.Equal(uint64(5), stats[0].Calls)
+		a.Equal(uint64(0), stats[0].Errors)
+		a.Equal(uint64(5), stats[0].Latency.Count())
+		a.Equal("Fail", stats[1].Name)
+		a.Equal(uint64(1), stats[1].Calls)
+		a.Equal(uint64(1), stats[1].Errors)
+	}
+
+	// The server counts the calls once the responses are written.
+	snapshot := s.Snapshot()
+	for deadline := time.Now().Add(5 * time.Second); snapshot.Stats.RPCCalls < 6 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		snapshot = s.Snapshot()
+	}
+	a.Equal(uint64(6), snapshot.Stats.RPCCalls)
+	a.Len(snapshot.Services, 2)
+	if a.Len(snapshot.Conns, 1) {
+		conn := snapshot.Conns[0]
+		a.Equal(uint64(6), conn.Stats.RPCCalls)
+		a.Equal(snapshot.Stats.HeadRead, conn.Stats.HeadRead)
+		a.Equal(snapshot.Stats.HeadWritten, conn.Stats.HeadWritten)
+		a.Equal(0, conn.InFlight)
+		a.Equal(0, conn.QueueDepth)
+	}
+
+	// The ids missing from the service table share an entry.
+	for svc := Service(100); svc < 110; svc++ {
+		_, err = c.Call(Request{Service: svc})
+		a.NotNil(err)
+	}
+	stats := s.ServiceStats()
+	if a.Len(stats, 3) {
+		a.Equal(UnknownService, stats[2].Service)
+		a.Equal("unknown", stats[2].Name)
+		a.Equal(uint64(10), stats[2].Calls)
+		a.Equal(uint64(10), stats[2].Errors)
+	}
+
+	c.ResetServiceStats()
+	a.Empty(c.ServiceStats())
+
+	c.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Conns()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Empty(s.Conns())
+}
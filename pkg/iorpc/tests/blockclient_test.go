@@ -0,0 +1,102 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/iorpc"
+	netiorpc "github.com/codingpoeta/net-model-bench/pkg/net/iorpc"
+	"github.com/stretchr/testify/assert"
+)
+
+// fileGen serves every key from a single file.
+type fileGen struct {
+	path  string
+	sizes map[string]int
+}
+
+func newFileGen(t *testing.T, sizes map[string]int) *fileGen {
+	size := 0
+	for _, s := range sizes {
+		if s > size {
+			size = s
+		}
+	}
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, randomData(size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &fileGen{path: path, sizes: sizes}
+}
+
+func (g *fileGen) Get(key string) []byte {
+	b, err := os.ReadFile(g.path)
+	if err != nil {
+		panic(err)
+	}
+	return b[:g.sizes[key]]
+}
+
+func (g *fileGen) GetReadCloser(key string) io.ReadCloser {
+	f, err := os.Open(g.path)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func (g *fileGen) GetSize(key string) int {
+	return g.sizes[key]
+}
+
+func TestBlockClient(t *testing.T) {
+	a := assert.New(t)
+	iorpc.SetErrorLogger(iorpc.NilErrorLogger)
+
+	network := &iorpc.MemoryNetwork{Latency: time.Millisecond}
+	sizes := map[string]int{"key0": 4 << 10, "key1": 64 << 10, "key2": 128 << 10}
+	server := netiorpc.NewMemoryServer(network, newFileGen(t, sizes))
+	go server.Serve()
+
+	// Wait for the listener, so the client doesn't back off from
+	// a refused dial.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := network.Dial(server.Addr())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var client common.BlockClient
+	client, err := netiorpc.NewClient(server.Addr(), netiorpc.ClientOptions{Conns: 2, Memory: network})
+	a.Nil(err)
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for cmd := uint32(0); cmd < 3; cmd++ {
+		wg.Add(1)
+		go func(cmd uint32) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				resp, err := client.Get(common.Request{CMD: cmd, Key: "key"})
+				if !a.Nil(err) {
+					return
+				}
+				a.Equal(uint32(sizes[fmt.Sprintf("key%d", cmd)]), resp.Size)
+			}
+		}(cmd)
+	}
+	wg.Wait()
+}
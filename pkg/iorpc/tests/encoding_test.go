@@ -13,14 +13,16 @@ import (
 	"testing"
 	"time"
 
-	"jfs/pkg/iorpc"
-
+	"github.com/codingpoeta/net-model-bench/pkg/iorpc"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/sync/errgroup"
 )
 
 var (
+	// Network connects the clients and servers of the tests in memory.
+	Network = &iorpc.MemoryNetwork{}
+
 	Dispatcher  = iorpc.NewDispatcher()
 	ServiceEcho iorpc.Service
 	ServiceFile iorpc.Service
@@ -152,9 +154,8 @@ func init() {
 }
 
 func NewServer() *iorpc.Server {
-	addr := ":0"
-	server := iorpc.NewTCPServer(addr, Dispatcher.HandlerFunc())
-	server.Listener.Init(addr)
+	server := iorpc.NewMemoryServer("", Dispatcher.HandlerFunc(), Network)
+	server.Listener.Init(server.Addr)
 	return server
 }
 
@@ -186,7 +187,7 @@ func (b *buffer) Read(p []byte) (n int, err error) {
 }
 
 func NewClient(addr string, conns int) *iorpc.Client {
-	c := iorpc.NewTCPClient(addr)
+	c := iorpc.NewMemoryClient(addr, Network)
 	c.Conns = conns
 	c.DisableCompression = true
 	c.Start()
@@ -0,0 +1,48 @@
+package iorpc
+
+import (
+	"io"
+	"net"
+
+	"github.com/codingpoeta/net-model-bench/pkg/zerocopy"
+)
+
+// zeroCopyConn sends the buffer bodies of a TCP connection
+// with MSG_ZEROCOPY.
+type zeroCopyConn struct {
+	*net.TCPConn
+	zc *zerocopy.Conn
+}
+
+// withZeroCopy enables zero-copy sends of TCP connections
+// if minSize is positive.
+func withZeroCopy(conn io.ReadWriteCloser, minSize int) io.ReadWriteCloser {
+	if minSize <= 0 {
+		return conn
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn
+	}
+	zc, err := zerocopy.New(tc, minSize)
+	if err != nil {
+		return conn
+	}
+	return &zeroCopyConn{TCPConn: tc, zc: zc}
+}
+
+func (c *zeroCopyConn) writeBody(b *Body) (bool, error) {
+	buf, ok := b.Reader.(IsBuffer)
+	if !ok || b.NotClose || b.Size < uint64(c.zc.MinSize()) {
+		return false, nil
+	}
+	// The buffer is closed once the kernel completes the send,
+	// not by the caller right after writeBody returns.
+	b.NotClose = true
+	return true, c.zc.Writev(buf.Iovec(), func() { buf.Close() })
+}
+
+func (c *zeroCopyConn) Close() error {
+	c.zc.Close()
+	return c.TCPConn.Close()
+}
@@ -7,23 +7,36 @@ import (
 	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/codingpoeta/net-model-bench/utils"
 )
 
 type Client struct {
 	sync.Mutex
-	addr       string
-	compressOn bool
-	crcOn      bool
-	conns      chan net.Conn
+	addr  string
+	crcOn bool
+	conns chan net.Conn
+
+	// Framing is the request header format, frame.V2 by default.
+	Framing frame.Version
+
+	// Codec compresses the response bodies, LZ4 if compressOn.
+	// The codecs other than LZ4 need frame.V2.
+	Codec codec.Spec
 }
 
 func NewClient(addr string, cons int, compressOn, crcOn bool) common.BlockClient {
-	return &Client{
-		addr:       addr,
-		compressOn: compressOn,
-		crcOn:      crcOn,
-		conns:      make(chan net.Conn, cons),
+	c := &Client{
+		Framing: frame.V2,
+		addr:    addr,
+		crcOn:   crcOn,
+		conns:   make(chan net.Conn, cons),
 	}
+	if compressOn {
+		c.Codec = codec.Spec{ID: codec.LZ4}
+	}
+	return c
 }
 
 func (c *Client) getConn() (net.Conn, error) {
@@ -35,7 +48,7 @@ func (c *Client) getConn() (net.Conn, error) {
 		c.Lock()
 		defer c.Unlock()
 		dialer := &net.Dialer{Timeout: time.Second + time.Millisecond*100, KeepAlive: time.Minute}
-		c, err := dialer.Dial("tcp", c.addr)
+		c, err := utils.Dial(dialer, c.addr)
 		if err != nil {
 			return nil, err
 		}
@@ -51,6 +64,8 @@ func (c *Client) withConn(f func(conn net.Conn) error) error {
 	}
 	err = f(conn)
 	if err != nil {
+		// The rest of the response may be left unread.
+		_ = conn.Close()
 		return err
 	}
 	select {
@@ -68,21 +83,29 @@ func (c *Client) Close() {
 func (c *Client) Get(req_ common.Request) (*common.Response, error) {
 	var res response
 
-	err := c.withConn(func(conn net.Conn) error {
-		req := request{Request: req_, compressOn: c.compressOn, crcOn: c.crcOn}
+	// Encoded first, so the requests the framing can't hold fail
+	// without taking a connection.
+	req := request{frame.NewHeader(c.Framing, &req_, c.Codec, c.crcOn)}
+	head, err := req.Append(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = c.withConn(func(conn net.Conn) error {
 		// fmt.Println("CMD:", req.CMD, "Key:", req.Key)
-		if err := req.Write(conn); err != nil {
+		if _, err := conn.Write(head); err != nil {
 			fmt.Println("write error:", err)
 			return err
 		}
-		if err := res.Read(conn); err != nil {
+		if err := res.Read(conn, c.Framing); err != nil {
 			fmt.Println("read error:", err)
 			return err
-		} else if res.Err != nil {
-			fmt.Println("response error:", res.Err)
-			return res.Err
 		}
 		return nil
 	})
+	if err == nil && res.Err != nil {
+		// The connection is reusable after an error response.
+		fmt.Println("response error:", res.Err)
+		err = res.Err
+	}
 	return &(res.Response), err
 }
@@ -1,97 +1,144 @@
 package gonet
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"net"
-	"sync"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
 	"github.com/codingpoeta/net-model-bench/utils"
 	"github.com/panjf2000/gnet"
+	gerrors "github.com/panjf2000/gnet/pkg/errors"
 )
 
 var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
 type request struct {
-	common.Request
-	compressOn bool
-	crcOn      bool
-	Buf        [256]byte
+	frame.Header
 }
 
-func (r *request) Write(w io.Writer) error {
-	buf := r.Buf[:]
-	buf[0] = r.CMD & 0xF
-	buf[1] = byte(len(r.Key))
-	buf[2] = 0
-	if r.compressOn {
-		buf[2] |= 0x01
-	}
-	if r.crcOn {
-		buf[2] |= 0x02
-	}
-	if len(r.Key) > 255 {
-		buf[0] += byte(len(r.Key)>>8) << 4
-	}
-	copy(buf[3:], r.Key)
-	if _, err := w.Write(buf[:len(r.Key)+3]); err != nil {
-		return err
-	}
-	return nil
+// frameCodec splits the inbound stream into request frames of either version.
+type frameCodec struct{}
+
+func (frameCodec) Encode(c gnet.Conn, buf []byte) ([]byte, error) {
+	return buf, nil
 }
 
-func (r *request) decode(buf []byte) {
-	r.CMD = buf[0] & 0x0F
-	size := int(buf[1]) + int(buf[0]>>4)<<8
-	if buf[2]&0x01 != 0 {
-		r.compressOn = true
+func (frameCodec) Decode(c gnet.Conn) ([]byte, error) {
+	var h frame.Header
+	buf := c.Read()
+	n, err := frame.Decode(buf, &h)
+	if err == frame.ErrShort {
+		return nil, gerrors.ErrIncompletePacket
 	}
-	if buf[2]&0x02 != 0 {
-		r.crcOn = true
+	if err != nil {
+		// gnet drops the errors of Decode, React fails to decode
+		// the rest and closes the connection.
+		n = len(buf)
 	}
-	r.Key = string(buf[3 : 3+size])
+	// ShiftN may put buf back to its pool, so the frame is copied.
+	packet := append([]byte(nil), buf[:n]...)
+	c.ShiftN(n)
+	return packet, nil
 }
 
+// respHeaderLen is the size of the response header: the compressed and
+// the original size, the checksum, the flags and the codec of the body.
+// The responses to the frame.V1 requests have the v1RespHeaderLen bytes
+// before the flags only, and the error messages no original size.
+const (
+	respHeaderLen   = 14
+	v1RespHeaderLen = 12
+)
+
+// respFlagError marks the responses whose body is an error message.
+const respFlagError = 0x01
+
 type response struct {
 	common.Response
-	Header [13]byte
+	Header [respHeaderLen]byte
 	Err    error
 	tsz    int
+	comp   codec.Codec // compresses the body, nil to send it as is
 }
 
-func (r *response) encode(buf []byte, comp, crc bool) {
-	header := buf[:12]
+// encode returns the buffers of the response to a request of the framing
+// version, with the body compressed by r.comp, or as is if it doesn't
+// shrink, and the buffer holding the compressed body. The checksum is of
+// the original body.
+func (r *response) encode(v frame.Version, crc bool) ([][]byte, *common.BodyBuffer) {
+	header := make([]byte, respHeaderLen)
+	if v == frame.V1 {
+		header = header[:v1RespHeaderLen]
+	}
 	if r.Err != nil {
 		msg := r.Err.Error()
-		binary.BigEndian.PutUint32(header[:4], uint32(len(msg)))
-		binary.BigEndian.PutUint32(header[4:8], 0)
-		binary.BigEndian.PutUint32(header[8:12], 0)
-		copy(buf[12:], string(msg))
-		return
+		if v == frame.V1 {
+			binary.BigEndian.PutUint32(header[:4], uint32(len(msg)))
+			return [][]byte{header, []byte(msg)}, nil
+		}
+		binary.BigEndian.PutUint32(header[4:8], uint32(len(msg)))
+		header[12] = respFlagError
+		return [][]byte{header, []byte(msg)}, nil
 	}
-	binary.BigEndian.PutUint32(header[:4], 0)
 	binary.BigEndian.PutUint32(header[4:8], uint32(len(r.Body)))
-	binary.BigEndian.PutUint32(header[8:12], 0)
-	copy(buf[12:], r.Body)
+	if crc {
+		binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(r.Body, crcTable))
+	}
+	if r.comp == nil {
+		return [][]byte{header, r.Body}, nil
+	}
+	// The bodies the codec fails on are sent as is too, the codec
+	// counts the failures in its report.
+	bb, comp, _ := codec.CompressBody(r.comp, r.Body)
+	if bb == nil {
+		return [][]byte{header, r.Body}, nil
+	}
+	binary.BigEndian.PutUint32(header[:4], uint32(len(comp)))
+	if v != frame.V1 {
+		// The V1 requests ask for LZ4 only.
+		header[13] = byte(r.comp.Spec().ID)
+	}
+	return [][]byte{header, comp}, bb
 }
 
-func (r *response) Read(conn net.Conn) error {
-	if _, err := io.ReadFull(conn, r.Header[:12]); err != nil {
+// Read reads the response to a request of the framing version.
+func (r *response) Read(conn net.Conn, v frame.Version) error {
+	header := r.Header[:]
+	if v == frame.V1 {
+		header = r.Header[:v1RespHeaderLen]
+	}
+	if _, err := io.ReadFull(conn, header); err != nil {
 		return err
 	}
 	compsize := binary.BigEndian.Uint32(r.Header[:4])
 	osize := binary.BigEndian.Uint32(r.Header[4:8])
-	if compsize > 20<<20 {
-		return fmt.Errorf("payload is too big: %d", compsize)
+	if compsize > 20<<20 || osize > 20<<20 {
+		return fmt.Errorf("payload is too big: %d", max(compsize, osize))
+	}
+	id := codec.ID(r.Header[13])
+	failed := r.Header[12]&respFlagError != 0
+	if v == frame.V1 {
+		// The error messages have no original size, the other
+		// compressed bodies are LZ4.
+		failed = osize == 0
+		if failed {
+			osize, compsize = compsize, 0
+		}
+		if compsize != 0 {
+			id = codec.LZ4
+		}
 	}
 
-	r.tsz = int(compsize)
-	if r.tsz == 0 {
-		r.tsz = int(osize)
+	r.tsz = int(osize)
+	if id != codec.None {
+		r.tsz = int(compsize)
 	}
 	// fmt.Println("size:", size)
 	payload := make([]byte, r.tsz)
@@ -114,15 +161,19 @@ func (r *response) Read(conn net.Conn) error {
 	if cnt > 0 {
 		//fmt.Println("read count:", cnt)
 	}
-	if osize == 0 {
+	if failed {
 		r.Err = errors.New(string(payload))
 		return nil
 	}
-	if compsize == 0 {
+	if id == codec.None {
 		r.Body = payload
 	} else {
+		c, err := codec.Spec{ID: id}.Codec()
+		if err != nil {
+			return err
+		}
 		r.Body = make([]byte, osize)
-		n, err := utils.LZ4_decompress_fast(payload, r.Body)
+		n, err := c.Decompress(r.Body, payload)
 		if err != nil {
 			return err
 		}
@@ -130,7 +181,7 @@ func (r *response) Read(conn net.Conn) error {
 			return fmt.Errorf("unexpected size: %d != %d", n, osize)
 		}
 	}
-	r.CRCSum = binary.BigEndian.Uint32(r.Header[8:])
+	r.CRCSum = binary.BigEndian.Uint32(r.Header[8:12])
 	if r.CRCSum != 0 {
 		if s := crc32.Checksum(r.Body, crcTable); s != r.CRCSum {
 			return fmt.Errorf("checksum %d != %d", s, r.CRCSum)
@@ -147,7 +198,7 @@ type server struct {
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
-	ip, err := utils.FindLocalIP(ip, iname)
+	ip, err := utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
@@ -158,40 +209,66 @@ func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error)
 }
 
 func (s *server) Addr() string {
-	return fmt.Sprintf("%s:8000", s.ip)
+	return utils.JoinHostPort(s.ip, 8000)
+}
+
+// connState holds the responses of a connection queued to AsyncWritev.
+// gnet runs the writes in order on the event loop of the connection,
+// calling AfterWrite for every buffer, so the oldest response is the
+// one written.
+type connState struct {
+	queue []pendingWrite
 }
 
-//	func (hc *server) Decode(c gnet.Conn) (out []byte, err error) {
-//		buf := c.Read()
-//		c.ResetBuffer()
-//		req := &request{}
-//		req.decode(buf)
-//	}
-//
-// func (s *server) Encode(c gnet.Conn, buf []byte) (out []byte, err error) {
-// }
+type pendingWrite struct {
+	left int                // buffers not written yet
+	bb   *common.BodyBuffer // of the compressed body, if any
+}
 
-var pool *sync.Pool
+func (s *server) OnOpened(c gnet.Conn) (out []byte, action gnet.Action) {
+	c.SetContext(&connState{})
+	return nil, gnet.None
+}
 
-func init() {
-	pool = &sync.Pool{
-		New: func() any {
-			return make([]byte, 4096*1024+12)
-		},
+// OnClosed releases the responses not written. The writes queued after
+// it are dropped by gnet.
+func (s *server) OnClosed(c gnet.Conn, err error) (action gnet.Action) {
+	st := c.Context().(*connState)
+	for _, p := range st.queue {
+		if p.bb != nil {
+			p.bb.Dec()
+		}
 	}
+	st.queue = nil
+	return gnet.None
 }
 
 func (s *server) AfterWrite(c gnet.Conn, b []byte) {
-	pool.Put(b)
+	// A failed write closes the connection before AfterWrite.
+	st, ok := c.Context().(*connState)
+	if !ok || len(st.queue) == 0 {
+		return
+	}
+	p := &st.queue[0]
+	if p.left--; p.left > 0 {
+		return
+	}
+	if p.bb != nil {
+		p.bb.Dec()
+	}
+	st.queue = st.queue[1:]
 }
 
-func (s *server) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Action) {
+func (s *server) React(packet []byte, c gnet.Conn) (out []byte, action gnet.Action) {
 	req := &request{}
-	req.decode(frame)
-	if len(frame) != len(req.Key)+3 {
-		panic(fmt.Sprintf("frame len is %d, expect %d", len(frame), len(req.Key)+3))
+	if _, err := frame.Decode(packet, &req.Header); err != nil {
+		fmt.Println(err)
+		return nil, gnet.Close
 	}
 	var res response
+	if req.Op != common.OpGet {
+		res.Err = fmt.Errorf("unsupported op %s", req.Op)
+	}
 	switch req.CMD {
 	case 0:
 		res.Body = s.dataGen.Get("key0")
@@ -206,17 +283,39 @@ func (s *server) React(frame []byte, c gnet.Conn) (out []byte, action gnet.Actio
 	default:
 		res.Err = errors.New("invalid command")
 	}
-	buf := pool.Get().([]byte)
-	res.encode(buf[:], false, false)
-	return buf[:12+len(res.Body)], action
+	if res.Err == nil {
+		res.Body, res.Err = req.Range(res.Body)
+	}
+	if res.Err == nil && req.Codec.ID != codec.None {
+		res.comp, res.Err = req.Codec.Codec()
+	}
+	// The header and the body are written by one writev without
+	// copying the body, AfterWrite releases the compressed ones.
+	bufs, bb := res.encode(req.Version, req.CRC)
+	st := c.Context().(*connState)
+	st.queue = append(st.queue, pendingWrite{left: len(bufs), bb: bb})
+	if err := c.AsyncWritev(bufs); err != nil {
+		fmt.Println(err)
+		return nil, gnet.Close
+	}
+	return nil, gnet.None
 }
 
 func (s *server) Serve() (err error) {
-	addr := fmt.Sprintf("%s:8000", s.ip)
+	addr := s.Addr()
 	fmt.Printf("start listen on gnet %s\n", addr)
-	err = gnet.Serve(s, fmt.Sprintf("tcp://%s", addr), gnet.WithMulticore(true))
+	utils.RemoveStaleSocket(addr)
+	err = gnet.Serve(s, s.protoAddr(), gnet.WithMulticore(true), gnet.WithCodec(frameCodec{}))
 	return err
 }
 
+// protoAddr is the address of the server in gnet.
+func (s *server) protoAddr() string {
+	network, address := utils.ParseAddr(s.Addr())
+	return fmt.Sprintf("%s://%s", network, address)
+}
+
 func (s *server) Close() {
+	// Fails if it isn't serving.
+	_ = gnet.Stop(context.Background(), s.protoAddr())
 }
@@ -0,0 +1,63 @@
+package gonet
+
+import (
+	"testing"
+
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/panjf2000/gnet"
+	gerrors "github.com/panjf2000/gnet/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+// bufConn is the inbound buffer of a gnet connection, the other methods
+// aren't used by frameCodec.Decode.
+type bufConn struct {
+	gnet.Conn
+	buf []byte
+}
+
+func (c *bufConn) Read() []byte {
+	return c.buf
+}
+
+func (c *bufConn) ShiftN(n int) int {
+	c.buf = c.buf[n:]
+	return n
+}
+
+func TestDecodePartialFrames(t *testing.T) {
+	a := assert.New(t)
+
+	headers := []frame.Header{
+		{Version: frame.V1, CMD: 3, Key: "key", CRC: true},
+		{Version: frame.V2, CMD: 4, Key: "key", Offset: 1 << 40, Length: 4096,
+			Codec: codec.Spec{ID: codec.LZ4}, CRC: true},
+	}
+	next, err := headers[0].Append(nil)
+	a.NoError(err)
+	for _, h := range headers {
+		b, err := h.Append(nil)
+		a.NoError(err)
+		for i := 0; i < len(b); i++ {
+			// The frame arrives split at byte i.
+			c := &bufConn{buf: append([]byte(nil), b[:i]...)}
+			packet, err := frameCodec{}.Decode(c)
+			a.Equal(gerrors.ErrIncompletePacket, err, "%v split at %d", h.Version, i)
+			a.Nil(packet)
+			a.Len(c.buf, i)
+
+			// The rest of the frame and the next one arrive.
+			c.buf = append(append(c.buf, b[i:]...), next...)
+			packet, err = frameCodec{}.Decode(c)
+			a.NoError(err)
+			a.Equal(b, packet, "%v split at %d", h.Version, i)
+			a.Equal(next, c.buf)
+
+			var got frame.Header
+			_, err = frame.Decode(packet, &got)
+			a.NoError(err)
+			a.Equal(h, got)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package gorpc
 
 import (
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/utils"
 	"github.com/valyala/gorpc"
 	"sync"
 )
@@ -26,8 +27,13 @@ func (c *Client) getGorpcClient() (*gorpc.Client, error) {
 	select {
 	case cli = <-c.gorpcClis:
 	default:
-		cli = &gorpc.Client{
-			Addr: c.addr,
+		if utils.IsUnixAddr(c.addr) {
+			_, address := utils.ParseAddr(c.addr)
+			cli = gorpc.NewUnixClient(address)
+		} else {
+			cli = &gorpc.Client{
+				Addr: c.addr,
+			}
 		}
 		cli.Start()
 	}
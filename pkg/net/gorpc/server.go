@@ -16,7 +16,7 @@ type Server struct {
 }
 
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.ip, s.port)
+	return utils.JoinHostPort(s.ip, s.port)
 }
 
 func (s *Server) handle(clientAddr string, request interface{}) interface{} {
@@ -33,6 +33,11 @@ func (s *Server) Serve() error {
 		Addr:    s.Addr(),
 		Handler: s.handle,
 	}
+	if utils.IsUnixAddr(s.s.Addr) {
+		utils.RemoveStaleSocket(s.s.Addr)
+		_, address := utils.ParseAddr(s.s.Addr)
+		s.s = gorpc.NewUnixServer(address, s.handle)
+	}
 	if err := s.s.Serve(); err != nil {
 		log.Fatalf("Cannot start rpc server: %s", err)
 	}
@@ -44,7 +49,7 @@ func (s *Server) Close() {
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
-	ip, err := utils.FindLocalIP(ip, iname)
+	ip, err := utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
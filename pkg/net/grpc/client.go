@@ -3,12 +3,14 @@ package grpc
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
 	pb "github.com/codingpoeta/net-model-bench/pkg/net/grpc/proto"
+	"github.com/codingpoeta/net-model-bench/utils"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
@@ -103,9 +105,22 @@ func (c *client) Close() {
 	close(c.grpcClis)
 }
 
+// target converts the unix addresses to the grpc unix and unix-abstract
+// name resolver schemes.
+func target(addr string) string {
+	switch {
+	case strings.HasPrefix(addr, utils.UnixScheme):
+		return "unix:" + strings.TrimPrefix(addr, utils.UnixScheme)
+	case strings.HasPrefix(addr, utils.UnixAbstractScheme):
+		return "unix-abstract:" + strings.TrimPrefix(addr, utils.UnixAbstractScheme)
+	default:
+		return addr
+	}
+}
+
 func NewClient(addr string, threadsPerCons, cons int) common.BlockClient {
 	return &client{
-		addr:           addr,
+		addr:           target(addr),
 		threadsPerCons: threadsPerCons,
 		grpcClis:       make(chan *grpcClient, cons*threadsPerCons),
 	}
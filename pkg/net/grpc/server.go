@@ -20,7 +20,7 @@ type Server struct {
 }
 
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.ip, s.port)
+	return utils.JoinHostPort(s.ip, s.port)
 }
 
 func (s *Server) Get(ctx context.Context, in *pb.BlockTransferRequest) (*pb.BlockTransferResponse, error) {
@@ -47,12 +47,8 @@ func (s *Server) Get(ctx context.Context, in *pb.BlockTransferRequest) (*pb.Bloc
 }
 
 func (s *Server) Serve() (err error) {
-	for {
-		s.listener, err = net.Listen("tcp", s.Addr())
-		if err == nil {
-			break
-		}
-		s.port++
+	if s.listener, err = utils.ListenPort(s.ip, &s.port); err != nil {
+		return err
 	}
 	fmt.Println("listening on", s.Addr())
 	svr := grpc.NewServer()
@@ -70,7 +66,7 @@ func (s *Server) Close() {
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
-	ip, err := utils.FindLocalIP(ip, iname)
+	ip, err := utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
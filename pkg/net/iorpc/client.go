@@ -2,38 +2,124 @@ package iorpc
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
 	"github.com/codingpoeta/net-model-bench/pkg/iorpc"
+	"github.com/codingpoeta/net-model-bench/utils"
 )
 
 type Client struct {
-	addr string
-	cli  *iorpc.Client
+	addr    string
+	opts    ClientOptions
+	cli     *iorpc.MultiClient
+	iouring *iorpc.IOUringTransport
 }
 
-func NewClient(addr string, conns int) *Client {
-	NewDispatcherForClient()
-	iorpc.RegisterHeaders(func() iorpc.Headers {
-		return new(ReadHeaders)
-	})
-	c := iorpc.NewTCPClient(addr)
-	c.DisableCompression = true
-	c.Conns = conns
-	// c.CloseBody = true
-	c.FlushDelay = time.Microsecond * 10
-	c.Start()
-	return &Client{
-		addr: addr,
-		cli:  c,
+// ClientOptions configures Client.
+type ClientOptions struct {
+	// The number of connections to every server.
+	Conns int
+
+	// The name of iorpc.BalancePolicy for comma-separated server addresses.
+	// Requests are hashed by common.Request.Key for the "hash" policy.
+	Balance string
+
+	// The number of retries of failed reads. Zero disables retries.
+	Retries int
+
+	// The timeout of every read attempt. Zero disables retries of timed out reads.
+	AttemptTimeout time.Duration
+
+	// Hedge sends a copy of reads slower than the recent p95 latency.
+	Hedge bool
+
+	// IOUring runs the connections over io_uring.
+	IOUring bool
+
+	// Memory runs the connections over the in-memory network instead
+	// of TCP, see NewMemoryServer.
+	Memory *iorpc.MemoryNetwork
+}
+
+// NewClient connects to the comma-separated list of server addresses.
+func NewClient(addr string, opts ClientOptions) (*Client, error) {
+	policy := iorpc.RoundRobin
+	if opts.Balance != "" {
+		var err error
+		if policy, err = iorpc.ParseBalancePolicy(opts.Balance); err != nil {
+			return nil, err
+		}
+	}
+	var iouring *iorpc.IOUringTransport
+	if opts.IOUring {
+		for _, a := range strings.Split(addr, ",") {
+			if utils.IsUnixAddr(a) {
+				return nil, errIOUringUnix
+			}
+		}
+		iouring = &iorpc.IOUringTransport{}
+	}
+	mc := &iorpc.MultiClient{
+		Addrs:  strings.Split(addr, ","),
+		Policy: policy,
+		NewClient: func(addr string) *iorpc.Client {
+			c := iorpc.NewTCPClient(addr)
+			if utils.IsUnixAddr(addr) {
+				_, address := utils.ParseAddr(addr)
+				c = iorpc.NewUnixClient(address)
+			}
+			if iouring != nil {
+				c = iorpc.NewIOUringClient(addr, iouring)
+			}
+			if opts.Memory != nil {
+				c = iorpc.NewMemoryClient(addr, opts.Memory)
+			}
+			c.HeadersRegistry = newHeadersRegistry()
+			c.DisableCompression = true
+			c.Conns = opts.Conns
+			// c.CloseBody = true
+			c.FlushDelay = time.Microsecond * 10
+			c.RequestTimeout = time.Hour
+			c.PingInterval = pingInterval
+			c.PingTimeout = pingTimeout
+			if opts.Retries > 0 {
+				c.Retry = &iorpc.RetryPolicy{
+					MaxAttempts:    opts.Retries + 1,
+					AttemptTimeout: opts.AttemptTimeout,
+				}
+			}
+			if opts.Hedge {
+				c.Hedge = &iorpc.HedgePolicy{}
+			}
+			return c
+		},
 	}
+	mc.Start()
+	return &Client{
+		addr:    addr,
+		opts:    opts,
+		cli:     mc,
+		iouring: iouring,
+	}, nil
 }
 
 func (c *Client) Close() {
+	if c.opts.Retries > 0 || c.opts.Hedge {
+		stats := c.cli.Stats()
+		fmt.Printf("calls: %d, retries: %d, hedges: %d, hedge wins: %d\n",
+			stats.RPCCalls, stats.Retries, stats.Hedges, stats.HedgeWins)
+	}
 	c.cli.Stop()
+	if c.iouring != nil {
+		stats := c.iouring.Stats()
+		fmt.Printf("io_uring enters: %d, sqes: %d, cqes: %d, zero-copy sends: %d\n",
+			stats.Enters, stats.SQEs, stats.CQEs, stats.ZeroCopySends)
+		c.iouring.Close()
+	}
 }
 
 var payloadBufPool = &sync.Pool{
@@ -54,14 +140,13 @@ func (c *Client) Get(req_ common.Request) (*common.Response, error) {
 	}
 
 	req := iorpc.Request{
-		Service: ServiceReadData,
 		Headers: &ReadHeaders{
 			CMD: uint64(req_.CMD),
 			ID:  nextID.Add(1),
 		},
 	}
 	// fmt.Println("----------reqID:  ", req.Headers.(*ReadHeaders).ID)
-	resp, err := c.cli.CallTimeout(req, time.Hour)
+	resp, err := c.cli.CallByName(req_.Key, ServiceReadData, req)
 	if err != nil {
 		fmt.Printf("call error: %v\n", err)
 		return nil, err
@@ -2,25 +2,40 @@ package iorpc
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
+
+	"github.com/codingpoeta/net-model-bench/pkg/iorpc"
 )
 
+// ReadHeadersID is the wire id of ReadHeaders.
+const ReadHeadersID = 1
+
+func newHeadersRegistry() *iorpc.HeadersRegistry {
+	r := iorpc.NewHeadersRegistry()
+	r.MustRegister(ReadHeadersID, func() iorpc.Headers {
+		return new(ReadHeaders)
+	})
+	return r
+}
+
 type ReadHeaders struct {
 	CMD, Offset, Size, ID uint64
-	encodeBuf             [32]byte
 }
 
+// Encode doesn't modify h, since hedged requests may be encoded concurrently.
 func (h *ReadHeaders) Encode(w io.Writer) (int, error) {
-	binary.BigEndian.PutUint64(h.encodeBuf[0:8], h.CMD)
-	binary.BigEndian.PutUint64(h.encodeBuf[8:16], h.Offset)
-	binary.BigEndian.PutUint64(h.encodeBuf[16:24], h.Size)
-	binary.BigEndian.PutUint64(h.encodeBuf[24:32], h.ID)
-	return w.Write(h.encodeBuf[:])
+	var buf [32]byte
+	binary.BigEndian.PutUint64(buf[0:8], h.CMD)
+	binary.BigEndian.PutUint64(buf[8:16], h.Offset)
+	binary.BigEndian.PutUint64(buf[16:24], h.Size)
+	binary.BigEndian.PutUint64(buf[24:32], h.ID)
+	return w.Write(buf[:])
 }
 
 func (h *ReadHeaders) Decode(b []byte) error {
 	if len(b) != 32 {
-		panic("")
+		return fmt.Errorf("invalid read headers size: %d != 32", len(b))
 	}
 	h.CMD = binary.BigEndian.Uint64(b[0:8])
 	h.Offset = binary.BigEndian.Uint64(b[8:16])
@@ -1,6 +1,7 @@
 package iorpc
 
 import (
+	"errors"
 	"fmt"
 	"time"
 
@@ -13,6 +14,8 @@ type Server struct {
 	s *iorpc.Server
 
 	dispatcher *iorpc.Dispatcher
+	iouring    *iorpc.IOUringTransport
+	memory     *iorpc.MemoryNetwork
 
 	ip      string
 	port    int
@@ -20,16 +23,38 @@ type Server struct {
 }
 
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.ip, s.port)
+	return utils.JoinHostPort(s.ip, s.port)
 }
 
 func (s *Server) Serve() error {
 	s.s = &iorpc.Server{
 		FlushDelay: time.Microsecond * 10,
 		Handler:    s.dispatcher.HandlerFunc(),
+		Services:   s.dispatcher.Services(),
+
+		PingInterval: pingInterval,
+		PingTimeout:  pingTimeout,
+
+		HeadersRegistry: newHeadersRegistry(),
 	}
 	s.s.Addr = s.Addr()
+	if utils.IsUnixAddr(s.s.Addr) {
+		utils.RemoveStaleSocket(s.s.Addr)
+		_, s.s.Addr = utils.ParseAddr(s.s.Addr)
+		s.s.Listener = iorpc.NewUnixServer(s.s.Addr, nil).Listener
+	}
+	if s.iouring != nil {
+		s.s.Listener = s.iouring.Listener()
+	}
+	if s.memory != nil {
+		s.s.Listener = s.memory.Listener()
+	}
 	fmt.Println("listening on", s.Addr())
+	if s.memory != nil {
+		fmt.Println("zero-copy: not probed, the in-memory network has no sockets")
+	} else {
+		fmt.Println("zero-copy:", utils.ProbeZeroCopy(s.Addr()))
+	}
 
 	return s.s.Serve()
 }
@@ -39,7 +64,7 @@ func (s *Server) Close() {
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
-	ip, err := utils.FindLocalIP(ip, iname)
+	ip, err := utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
@@ -48,11 +73,40 @@ func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error)
 		port:       8000,
 		dispatcher: NewDispatcher(),
 	}
-	iorpc.RegisterHeaders(func() iorpc.Headers {
-		return new(ReadHeaders)
-	})
 	addServiceNoop(svr.dispatcher)
 	addServiceReadData(svr.dispatcher, dg)
 	addServiceReadMemory(svr.dispatcher)
 	return svr, nil
 }
+
+// errIOUringUnix rejects the unix sockets the io_uring transport
+// doesn't dial or listen to.
+var errIOUringUnix = errors.New("io_uring runs over TCP only, not unix sockets")
+
+// NewIOUringServer is NewServer running the connections over io_uring.
+func NewIOUringServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
+	svr, err := NewServer(ip, iname, dg)
+	if err != nil {
+		return nil, err
+	}
+	if utils.IsUnixAddr(svr.Addr()) {
+		return nil, errIOUringUnix
+	}
+	svr.(*Server).iouring = &iorpc.IOUringTransport{}
+	return svr, nil
+}
+
+// NewMemoryServer is NewServer listening to the in-memory network
+// at the address "memory:8000", for tests of the clients without sockets.
+func NewMemoryServer(n *iorpc.MemoryNetwork, dg common.DataGen) common.BlockServer {
+	svr := &Server{
+		ip:         "memory",
+		port:       8000,
+		dispatcher: NewDispatcher(),
+		memory:     n,
+	}
+	addServiceNoop(svr.dispatcher)
+	addServiceReadData(svr.dispatcher, dg)
+	addServiceReadMemory(svr.dispatcher)
+	return svr
+}
@@ -3,38 +3,40 @@ package iorpc
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
 	"github.com/codingpoeta/net-model-bench/pkg/iorpc"
 )
 
-var (
-	ServiceNoop       iorpc.Service
-	ServiceReadData   iorpc.Service
-	ServiceReadMemory iorpc.Service
+// Names of the services advertised by Server.
+// Clients resolve them via iorpc.Client.Service.
+const (
+	ServiceNoop       = "Noop"
+	ServiceReadData   = "ReadData"
+	ServiceReadMemory = "ReadMemory"
+)
+
+// Keepalive settings shared by Client and Server, so a silently dead peer
+// fails pending requests instead of hanging them until RequestTimeout.
+const (
+	pingInterval = time.Second
+	pingTimeout  = 5 * time.Second
 )
 
 func NewDispatcher() *iorpc.Dispatcher {
 	return iorpc.NewDispatcher()
 }
 
-func NewDispatcherForClient() *iorpc.Dispatcher {
-	d := iorpc.NewDispatcher()
-	addServiceNoop(d)
-	addServiceReadData(d, nil)
-	addServiceReadMemory(d)
-	return nil
-}
-
 func addServiceNoop(dispatcher *iorpc.Dispatcher) {
-	ServiceNoop, _ = dispatcher.AddService("Noop", func(clientAddr string, request iorpc.Request) (response *iorpc.Response, err error) {
+	dispatcher.AddService(ServiceNoop, func(clientAddr string, request iorpc.Request) (response *iorpc.Response, err error) {
 		return &iorpc.Response{}, nil
 	})
 }
 
 func addServiceReadData(dispatcher *iorpc.Dispatcher, dg common.DataGen) {
-	ServiceReadData, _ = dispatcher.AddService(
-		"ReadData",
+	dispatcher.AddService(
+		ServiceReadData,
 		func(clientAddr string, request iorpc.Request) (*iorpc.Response, error) {
 			request.Body.Close()
 			cmd := uint64(4)
@@ -79,8 +81,8 @@ func addServiceReadData(dispatcher *iorpc.Dispatcher, dg common.DataGen) {
 }
 
 func addServiceReadMemory(dispatcher *iorpc.Dispatcher) {
-	ServiceReadMemory, _ = dispatcher.AddService(
-		"ReadMemory",
+	dispatcher.AddService(
+		ServiceReadMemory,
 		func(clientAddr string, request iorpc.Request) (*iorpc.Response, error) {
 			request.Body.Close()
 			return &iorpc.Response{
@@ -0,0 +1,225 @@
+package jnet
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const defaultBatchDelay = 10 * time.Microsecond
+
+// BatchPolicy bounds the batches collected by a submit worker.
+// The zero values take the defaults.
+type BatchPolicy struct {
+	// MaxCount is the number of messages of a batch, MaxBatchCount by default.
+	MaxCount int
+
+	// MaxBytes is the body size of a batch, MaxBatchSize by default.
+	MaxBytes int
+
+	// MaxDelay is how long the first message of a batch waits for
+	// the others, 10µs by default. Negative doesn't wait, only the
+	// messages queued already are batched.
+	MaxDelay time.Duration
+
+	// Adaptive stops waiting once the next message is overdue by
+	// the observed arrival rate, so sparse messages aren't delayed
+	// by MaxDelay.
+	Adaptive bool
+}
+
+func (p BatchPolicy) withDefaults() BatchPolicy {
+	if p.MaxCount <= 0 {
+		p.MaxCount = MaxBatchCount
+	}
+	if p.MaxBytes <= 0 {
+		p.MaxBytes = MaxBatchSize
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = defaultBatchDelay
+	}
+	return p
+}
+
+// BatchBuckets is the number of buckets of BatchHistogram.
+const BatchBuckets = 12
+
+// BatchHistogram counts batches by their number of messages.
+//
+// Buckets[i] counts the batches of (2^(i-1), 2^i] messages, Buckets[0]
+// the single messages. The last bucket counts all the larger batches too.
+type BatchHistogram struct {
+	Buckets  [BatchBuckets]uint64
+	Messages uint64
+	Bytes    uint64
+}
+
+func (h *BatchHistogram) observe(count, size int) {
+	i := bits.Len(uint(count - 1))
+	if i >= BatchBuckets {
+		i = BatchBuckets - 1
+	}
+	atomic.AddUint64(&h.Buckets[i], 1)
+	atomic.AddUint64(&h.Messages, uint64(count))
+	atomic.AddUint64(&h.Bytes, uint64(size))
+}
+
+// Snapshot returns a copy of the histogram updated concurrently.
+func (h *BatchHistogram) Snapshot() BatchHistogram {
+	var s BatchHistogram
+	for i := range h.Buckets {
+		s.Buckets[i] = atomic.LoadUint64(&h.Buckets[i])
+	}
+	s.Messages = atomic.LoadUint64(&h.Messages)
+	s.Bytes = atomic.LoadUint64(&h.Bytes)
+	return s
+}
+
+// Add adds the counts of other.
+func (h *BatchHistogram) Add(other BatchHistogram) {
+	for i, c := range other.Buckets {
+		h.Buckets[i] += c
+	}
+	h.Messages += other.Messages
+	h.Bytes += other.Bytes
+}
+
+// Batches returns the number of observed batches.
+func (h *BatchHistogram) Batches() uint64 {
+	var n uint64
+	for _, c := range h.Buckets {
+		n += c
+	}
+	return n
+}
+
+// AvgCount returns the average number of messages of a batch.
+func (h *BatchHistogram) AvgCount() float64 {
+	n := h.Batches()
+	if n == 0 {
+		return 0
+	}
+	return float64(h.Messages) / float64(n)
+}
+
+func (h BatchHistogram) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "batches %d, avg count %.1f, avg bytes %d", h.Batches(), h.AvgCount(), h.Bytes/max(h.Batches(), 1))
+	for i, c := range h.Buckets {
+		if c > 0 {
+			fmt.Fprintf(&b, ", <=%d: %d", 1<<i, c)
+		}
+	}
+	return b.String()
+}
+
+// batcher collects the batches of a submit worker from ch.
+type batcher[T any] struct {
+	policy BatchPolicy
+	ch     <-chan T
+	done   <-chan struct{}
+	size   func(T) int
+	hist   *BatchHistogram
+
+	timer *time.Timer
+	last  time.Time
+	gap   time.Duration // moving average of the arrival gaps
+}
+
+func newBatcher[T any](policy BatchPolicy, ch <-chan T, done <-chan struct{}, size func(T) int, hist *BatchHistogram) *batcher[T] {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	return &batcher[T]{
+		policy: policy.withDefaults(),
+		ch:     ch,
+		done:   done,
+		size:   size,
+		hist:   hist,
+		timer:  timer,
+	}
+}
+
+func (b *batcher[T]) arrived() {
+	now := time.Now()
+	if !b.last.IsZero() {
+		gap := now.Sub(b.last)
+		if b.gap == 0 {
+			b.gap = gap
+		} else {
+			b.gap += (gap - b.gap) / 8
+		}
+	}
+	b.last = now
+}
+
+// wait returns how long to wait for the next message until deadline.
+func (b *batcher[T]) wait(deadline time.Time) time.Duration {
+	d := time.Until(deadline)
+	if b.policy.Adaptive && b.gap > 0 {
+		if b.gap > d {
+			// Not expected before the deadline.
+			return 0
+		}
+		d = min(d, 2*b.gap)
+	}
+	return d
+}
+
+func (b *batcher[T]) stopTimer() {
+	if !b.timer.Stop() {
+		select {
+		case <-b.timer.C:
+		default:
+		}
+	}
+}
+
+// next appends the next batch to batch[:0]. It returns false once done
+// is closed and nothing is collected.
+func (b *batcher[T]) next(batch []T) ([]T, bool) {
+	batch = batch[:0]
+	var m T
+	select {
+	case m = <-b.ch:
+	case <-b.done:
+		return batch, false
+	}
+	b.arrived()
+	batch = append(batch, m)
+	size := b.size(m)
+	deadline := time.Now().Add(b.policy.MaxDelay)
+	for len(batch) < b.policy.MaxCount && size < b.policy.MaxBytes {
+		select {
+		case m = <-b.ch:
+			b.arrived()
+			batch = append(batch, m)
+			size += b.size(m)
+			continue
+		default:
+		}
+		d := b.wait(deadline)
+		if d <= 0 {
+			break
+		}
+		b.timer.Reset(d)
+		timedOut := false
+		select {
+		case m = <-b.ch:
+			b.arrived()
+			batch = append(batch, m)
+			size += b.size(m)
+		case <-b.timer.C:
+			timedOut = true
+		case <-b.done:
+			timedOut = true
+		}
+		b.stopTimer()
+		if timedOut {
+			break
+		}
+	}
+	b.hist.observe(len(batch), size)
+	return batch, true
+}
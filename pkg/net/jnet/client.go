@@ -3,24 +3,25 @@ package jnet
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"sync"
 	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/codingpoeta/net-model-bench/utils"
 )
 
-const heartBeatInterval = 10
-
-var shouldSubmit = make(chan struct{})
-
 type batchHdrDesc struct {
 	Version    uint32
 	Cookie     uint64
 	HeadLength uint32
-	ChkSum     uint32   // bachhdr + request headers only
+	ChkSum     uint32   // CRC32C of the batch header and the message headers, see seal
 	Buf        [64]byte // cpu cache line
 }
 
@@ -43,53 +44,79 @@ func (d *batchHdrDesc) Decode(b []byte) error {
 
 type request struct {
 	common.Request
-	compressOn bool
+	codec      codec.Spec // of the response body
 	crcOn      bool
 	ContentLen uint32
-	Buf        [8]byte
+	ChkSum     uint32 // CRC32C of the body if crcOn
+	Buf        [64]byte
 	Body       io.Reader
 	callback   func(*common.Response, error)
 	resp       *response
+	err        error
 	wait       chan struct{}
 
-	encodedHead net.Buffers
+	encodedHead []byte
 	batchId     uint64
 	idx         uint32
 	backend     *IOQueueBackend
+	badBody     bool // the body doesn't match ChkSum
 }
 
-func (r *request) Encode() net.Buffers {
-	var buffs net.Buffers
-	buf := r.Buf
-	buf[0] = r.CMD & 0xF
-	buf[1] = byte(len(r.Key))
-	buf[2] = 0
-	if r.compressOn {
-		buf[2] |= 0x01
-	}
-	if r.crcOn {
-		buf[2] |= 0x02
-	}
-	if len(r.Key) > 255 {
-		buf[0] += byte(len(r.Key)>>8) << 4
+// Encode encodes the message header of the version: the lengths of the
+// body, then the frame.V2 header. The baseVersion header is the frame.V1
+// header with the length of the body between its flags and the key.
+func (r *request) Encode(version uint32) ([]byte, error) {
+	if version == baseVersion {
+		h := frame.NewHeader(frame.V1, &r.Request, r.codec, r.crcOn)
+		b, err := h.Append(r.Buf[:0])
+		if err != nil {
+			return nil, err
+		}
+		head := make([]byte, 0, len(b)+4)
+		head = append(head, b[:3]...)
+		head = binary.BigEndian.AppendUint32(head, r.ContentLen)
+		return append(head, b[3:]...), nil
 	}
-	binary.BigEndian.PutUint32(buf[3:7], r.ContentLen)
-	buffs = append(buffs, buf[:7], []byte(r.Key))
-	return buffs
+	var lens [8]byte
+	binary.BigEndian.PutUint32(lens[0:4], r.ContentLen)
+	binary.BigEndian.PutUint32(lens[4:8], r.ChkSum)
+	h := frame.NewHeader(frame.V2, &r.Request, r.codec, r.crcOn)
+	return h.Append(lens[:])
 }
 
-func (r *request) Decode(b []byte) (int, error) {
-	r.CMD = b[0] & 0x0F
-	size := int(b[1]) + int(b[0]>>4)<<8
-	if b[2]&0x01 != 0 {
-		r.compressOn = true
+func (r *request) Decode(b []byte, version uint32) (int, error) {
+	if version == baseVersion {
+		// The bodies are sent as is, without checksums.
+		if len(b) < 7 {
+			return 0, fmt.Errorf("short request header: %d bytes", len(b))
+		}
+		r.Request = common.Request{CMD: uint32(b[0] & 0x0F)}
+		size := int(b[1]) + int(b[0]>>4)<<8
+		r.codec, r.crcOn, r.ChkSum = codec.Spec{}, false, 0
+		r.ContentLen = binary.BigEndian.Uint32(b[3:7])
+		if len(b) < 7+size {
+			return 0, fmt.Errorf("short request key: %d bytes, want %d", len(b)-7, size)
+		}
+		r.Key = string(b[7 : 7+size])
+		return 7 + size, nil
+	}
+	if len(b) < 8 {
+		return 0, fmt.Errorf("short request header: %d bytes", len(b))
 	}
-	if b[2]&0x02 != 0 {
-		r.crcOn = true
+	r.ContentLen = binary.BigEndian.Uint32(b[0:4])
+	r.ChkSum = binary.BigEndian.Uint32(b[4:8])
+	var h frame.Header
+	n, err := frame.Decode(b[8:], &h)
+	if err == frame.ErrShort {
+		return 0, fmt.Errorf("short request header: %d bytes", len(b))
 	}
-	r.ContentLen = binary.BigEndian.Uint32(b[3:7])
-	r.Key = string(b[7 : 7+size])
-	return 7 + size, nil
+	if err != nil {
+		return 0, err
+	}
+	r.Request = h.Request()
+	r.codec = h.Codec
+	r.crcOn = h.CRC
+	return 8 + n, nil
 }
 
 type response struct {
@@ -97,15 +124,23 @@ type response struct {
 	Idx        uint32
 	ErrorCode  uint32
 	ErrorMsg   string
-	ContentLen uint32
+	ContentLen uint32 // of the body sent
+	ChkSum     uint32 // CRC32C of the original body if crcOn
+	RawLen     uint32 // of the original body
+	Codec      codec.ID
+	crcOn      bool
 	Buf        [64]byte
 	Body       io.Reader
-	bdBuf      *common.BodyBuffer
+	vec        []common.BodySlice // the body received by the client
+	bodyBuf    *common.BodyBuffer // holds the body read or compressed by the server
 
 	encodedHead []byte
 }
 
-func (r *response) Encode() []byte {
+// Encode encodes the message header of the version, the original length
+// and the codec of the body follow the checksum. The baseVersion header
+// ends before the checksum.
+func (r *response) Encode(version uint32) []byte {
 	buf := r.Buf
 	binary.BigEndian.PutUint64(buf[0:8], r.BatchId)
 	binary.BigEndian.PutUint32(buf[8:12], r.Idx)
@@ -113,18 +148,42 @@ func (r *response) Encode() []byte {
 	if r.ErrorCode != 0 {
 		binary.BigEndian.PutUint32(buf[16:20], uint32(len(r.ErrorMsg)))
 		r.Body = bytes.NewBuffer([]byte(r.ErrorMsg))
+		if r.crcOn {
+			r.ChkSum = crc32.Checksum([]byte(r.ErrorMsg), crcTable)
+		}
 	} else {
 		binary.BigEndian.PutUint32(buf[16:20], r.ContentLen)
 	}
-	return buf[:20]
+	if version == baseVersion {
+		return buf[:baseRespLen]
+	}
+	binary.BigEndian.PutUint32(buf[20:24], r.ChkSum)
+	binary.BigEndian.PutUint32(buf[24:28], r.RawLen)
+	buf[28] = byte(r.Codec)
+	clear(buf[29:respHeaderLen])
+	return buf[:respHeaderLen]
 }
 
-func (r *response) Decode(b []byte) (int, error) {
+func (r *response) Decode(b []byte, version uint32) (int, error) {
+	n := respHeaderLen
+	if version == baseVersion {
+		n = baseRespLen
+	}
+	if len(b) < n {
+		return 0, fmt.Errorf("short response header: %d bytes", len(b))
+	}
 	r.BatchId = binary.BigEndian.Uint64(b[0:8])
 	r.Idx = binary.BigEndian.Uint32(b[8:12])
 	r.ErrorCode = binary.BigEndian.Uint32(b[12:16])
 	r.ContentLen = binary.BigEndian.Uint32(b[16:20])
-	return 20, nil
+	if version == baseVersion {
+		r.ChkSum, r.RawLen, r.Codec = 0, r.ContentLen, codec.None
+		return n, nil
+	}
+	r.ChkSum = binary.BigEndian.Uint32(b[20:24])
+	r.RawLen = binary.BigEndian.Uint32(b[24:28])
+	r.Codec = codec.ID(b[28])
+	return respHeaderLen, nil
 }
 
 type encodedRequest struct {
@@ -137,177 +196,396 @@ type inflightBatchEntry struct {
 	left int
 }
 
+// ErrClosed is returned for the requests submitted to a closed IOQueue.
+var ErrClosed = errors.New("jnet: io queue closed")
+
+// ConnError fails the requests in flight on a broken connection.
+// The IOQueue redials on the next batch.
+type ConnError struct {
+	Addr string
+	Err  error
+}
+
+func (e *ConnError) Error() string {
+	return fmt.Sprintf("jnet: connection to %s failed: %v", e.Addr, e.Err)
+}
+
+func (e *ConnError) Unwrap() error {
+	return e.Err
+}
+
+const (
+	minRedialDelay = 10 * time.Millisecond
+	maxRedialDelay = time.Second
+)
+
 type IOQueue struct {
+	addr            string
+	dialer          *net.Dialer
 	nextCookie      uint64
-	conn            net.Conn
+	conn            net.Conn // nil while broken
 	reqCH           chan *request
 	mu              sync.RWMutex
 	inflightBatches map[uint64]*inflightBatchEntry
+	closed          bool
+	done            chan struct{}
+	batchPolicy     BatchPolicy
+	batches         BatchHistogram
+	version         uint32 // of the protocol spoken
 }
 
-func NewIOQueue(addr string) (*IOQueue, error) {
+// NewIOQueue connects to addr. The frame.V1 requests are sent with the
+// baseVersion framing, the others with ProtocolVersion.
+func NewIOQueue(addr string, batch BatchPolicy, framing frame.Version) (*IOQueue, error) {
 	q := &IOQueue{
+		version:         ProtocolVersion,
+		addr:            addr,
+		dialer:          &net.Dialer{Timeout: time.Second + time.Millisecond*100, KeepAlive: time.Minute},
 		reqCH:           make(chan *request, 2048),
 		inflightBatches: make(map[uint64]*inflightBatchEntry),
+		done:            make(chan struct{}),
+		batchPolicy:     batch,
+	}
+	if framing == frame.V1 {
+		q.version = baseVersion
 	}
-	dialer := &net.Dialer{Timeout: time.Second + time.Millisecond*100, KeepAlive: time.Minute}
-	c, err := dialer.Dial("tcp", addr)
+	c, err := q.dial()
 	if err != nil {
 		return nil, err
 	}
 	q.conn = c
 	go q.submitWorker()
-	go q.recvWorker()
+	go q.recvWorker(c)
 	return q, nil
 }
 
-func (q *IOQueue) submit(req *request) *response {
-	req.encodedHead = req.Encode()
-again:
+// dial connects to the server and checks its protocol version, the
+// baseVersion servers have no hello.
+func (q *IOQueue) dial() (net.Conn, error) {
+	conn, err := utils.Dial(q.dialer, q.addr)
+	if err != nil || q.version == baseVersion {
+		return conn, err
+	}
+	if err = clientHandshake(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// BatchStats returns the sizes of the batches sent.
+func (q *IOQueue) BatchStats() BatchHistogram {
+	return q.batches.Snapshot()
+}
+
+func (q *IOQueue) submit(req *request) (*response, error) {
+	req.ChkSum = 0
+	if b, ok := req.Body.(*bytes.Buffer); ok && req.crcOn {
+		req.ChkSum = crc32.Checksum(b.Bytes(), crcTable)
+	}
+	var err error
+	if req.encodedHead, err = req.Encode(q.version); err != nil {
+		reqPool.Put(req)
+		return nil, err
+	}
+	req.resp, req.err = nil, nil
+	q.mu.RLock()
+	closed := q.closed
+	q.mu.RUnlock()
+	if closed {
+		reqPool.Put(req)
+		return nil, ErrClosed
+	}
+	// Don't hold mu while waiting for room: the submit worker
+	// draining reqCH takes it to register the batches.
 	select {
 	case q.reqCH <- req:
-		//fmt.Println("submit request")
-	default:
-		fmt.Println("submit request failed, channel full, start another worker")
-		goto again
+		select {
+		case <-q.done:
+			// Closed meanwhile, the submit worker may be gone.
+			q.failQueued()
+		default:
+		}
+	case <-q.done:
+		reqPool.Put(req)
+		return nil, ErrClosed
 	}
 	<-req.wait
-	resp := req.resp
+	resp, err := req.resp, req.err
 	reqPool.Put(req)
-	return resp
+	return resp, err
+}
+
+// complete hands the result to the request waiting in submit.
+func (req *request) complete(resp *response, err error) {
+	req.resp = resp
+	req.err = err
+	close(req.wait)
 }
 
 const MaxBatchCount = 64
 const MaxBatchSize = 1024 * 1024
 
-func (q *IOQueue) flush(requests []*request) error {
+// flush sends the batch on conn. The batch is failed if conn breaks
+// before all of its responses are received.
+func (q *IOQueue) flush(conn net.Conn, requests []*request) error {
 	hlen := 0
-	var bufs net.Buffers
+	var heads net.Buffers
+	var bodies []io.Reader
 	for _, req := range requests {
-		for _, s := range req.encodedHead {
-			hlen += len(s)
+		hlen += len(req.encodedHead)
+		heads = append(heads, req.encodedHead)
+		if req.Body != nil {
+			bodies = append(bodies, req.Body)
 		}
 	}
 	batch := &batchHdrDesc{
-		Version:    1,
 		Cookie:     q.nextCookie,
 		HeadLength: uint32(hlen),
-		ChkSum:     0,
 	}
 	q.nextCookie += 1
+	bufs := append(net.Buffers{batch.seal(q.version, heads)}, heads...)
+
+	// The recv worker completes the requests once registered.
 	q.mu.Lock()
+	if q.conn != conn {
+		// Broken by the recv worker meanwhile.
+		q.mu.Unlock()
+		for _, req := range requests {
+			req.complete(nil, &ConnError{Addr: q.addr, Err: net.ErrClosed})
+		}
+		return nil
+	}
 	q.inflightBatches[batch.Cookie] = &inflightBatchEntry{
 		reqs: requests,
 		left: len(requests),
 	}
 	q.mu.Unlock()
 
-	bufs = append(bufs, batch.Encode())
-	for _, req := range requests {
-		bufs = append(bufs, req.encodedHead...)
-	}
 	for len(bufs) > 0 {
-		_, err := bufs.WriteTo(q.conn)
+		_, err := bufs.WriteTo(conn)
 		if err != nil {
 			return err
 		}
 	}
-	for _, req := range requests {
-		if req.Body != nil {
-			_, err := io.Copy(q.conn, req.Body)
-			if err != nil {
-				return err
-			}
+	for _, body := range bodies {
+		_, err := io.Copy(conn, body)
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// connect returns the connection, redialing with backoff while it's
+// broken. It fails only if the queue is closed.
+func (q *IOQueue) connect() (net.Conn, error) {
+	q.mu.RLock()
+	conn := q.conn
+	q.mu.RUnlock()
+	if conn != nil {
+		return conn, nil
+	}
+	delay := minRedialDelay
+	for {
+		conn, err := q.dial()
+		if err == nil {
+			q.mu.Lock()
+			if q.closed {
+				q.mu.Unlock()
+				conn.Close()
+				return nil, ErrClosed
+			}
+			q.conn = conn
+			q.mu.Unlock()
+			fmt.Println("reconnected to", q.addr)
+			go q.recvWorker(conn)
+			return conn, nil
+		}
+		fmt.Printf("redial %s failed: %v, retry in %v\n", q.addr, err, delay)
+		select {
+		case <-q.done:
+			return nil, ErrClosed
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxRedialDelay)
+	}
+}
+
+// broken closes conn and fails the batches in flight on it with err.
+func (q *IOQueue) broken(conn net.Conn, err error) {
+	q.mu.Lock()
+	if q.conn != conn {
+		q.mu.Unlock()
+		return
+	}
+	q.conn = nil
+	batches := q.inflightBatches
+	q.inflightBatches = make(map[uint64]*inflightBatchEntry)
+	closed := q.closed
+	q.mu.Unlock()
+
+	conn.Close()
+	if closed {
+		err = ErrClosed
+	} else {
+		fmt.Printf("connection to %s broken: %v\n", q.addr, err)
+		err = &ConnError{Addr: q.addr, Err: err}
+	}
+	for _, ents := range batches {
+		for _, req := range ents.reqs {
+			if req != nil {
+				req.complete(nil, err)
+			}
+		}
+	}
+}
+
+func (q *IOQueue) send(requests []*request) {
+	conn, err := q.connect()
+	if err != nil {
+		for _, req := range requests {
+			req.complete(nil, err)
+		}
+		return
+	}
+	if err = q.flush(conn, requests); err != nil {
+		q.broken(conn, err)
+	}
+}
+
 func (q *IOQueue) submitWorker() {
 	fmt.Println("submit worker started")
 	defer fmt.Println("submit worker closed")
 
-	// no batch in this version
-	requests := make([]*request, 0)
-	totalPayloadSize := 0
+	b := newBatcher(q.batchPolicy, q.reqCH, q.done, func(req *request) int {
+		return int(req.ContentLen)
+	}, &q.batches)
+	for {
+		// The batch stays in flight, so its slice isn't reused.
+		requests, ok := b.next(nil)
+		if !ok {
+			q.failQueued()
+			return
+		}
+		q.send(requests)
+	}
+}
+
+// failQueued fails the requests left in reqCH of the closed queue.
+// The submits queuing a request after close call it too, since the
+// submit worker may have exited.
+func (q *IOQueue) failQueued() {
 	for {
 		select {
 		case req := <-q.reqCH:
-			if req == nil {
-				return
-			}
-			requests = append(requests, req)
-			for {
-				shouldBreak := false
-				select {
-				case req = <-q.reqCH:
-					if req == nil {
-						return
-					}
-					requests = append(requests, req)
-					totalPayloadSize += int(req.ContentLen)
-					if len(requests) >= MaxBatchCount {
-						shouldBreak = true
-					}
-
-					if totalPayloadSize >= MaxBatchSize {
-						shouldBreak = true
-					}
-				case <-shouldSubmit:
-					shouldBreak = true
-				}
-				if shouldBreak {
-					break
-				}
-			}
-			if err := q.flush(requests); err != nil {
-				panic(err)
-			}
-			requests = make([]*request, 0)
-			totalPayloadSize = 0
+			req.complete(nil, ErrClosed)
+		default:
+			return
 		}
 	}
 }
 
+const bodyBufSize = 4 << 20
+
 var bodyBufPool = &sync.Pool{
 	New: func() any {
 		return &common.BodyBuffer{
-			Buf: make([]byte, 4096*1024),
+			Buf: make([]byte, bodyBufSize),
 		}
 	},
 }
 
-func (q *IOQueue) recvWorker() {
+// bodyCursor hands out the bodies of a batch read into body buffers.
+type bodyCursor struct {
+	bufs []*common.BodyBuffer
+	idx  int
+	off  int
+}
+
+// next appends the slices of the next body of size bytes to vec, the
+// bodies larger than the rest of a buffer span the following ones.
+// Every slice holds a reference to its buffer.
+func (c *bodyCursor) next(vec []common.BodySlice, size int) []common.BodySlice {
+	for size > 0 {
+		bb := c.bufs[c.idx]
+		n := min(size, len(bb.Buf)-c.off)
+		bb.Inc()
+		vec = append(vec, common.BodySlice{Buf: bb.Buf[c.off : c.off+n], BB: bb})
+		size -= n
+		c.off += n
+		if c.off == len(bb.Buf) {
+			c.idx++
+			c.off = 0
+		}
+	}
+	return vec
+}
+
+func checksumVec(vec []common.BodySlice) uint32 {
+	var crc uint32
+	for _, s := range vec {
+		crc = crc32.Update(crc, crcTable, s.Buf)
+	}
+	return crc
+}
+
+// recvWorker receives the responses on conn until it breaks.
+func (q *IOQueue) recvWorker(conn net.Conn) {
 	fmt.Println("recv worker started")
 	defer fmt.Println("recv worker closed")
 
 	var desc batchHdrDesc
-	var respHeaderBuffer [20 * 512]byte
+	respHeaderBuffer := make([]byte, respHeaderLen*MaxBatchCount)
 	resps := make([]*response, 0)
+	// The server numbers its batches on every connection.
+	var cookie uint64
 	for {
 		resps = resps[:0]
-		_, err := io.ReadFull(q.conn, desc.Buf[:])
+		_, err := io.ReadFull(conn, desc.Buf[:])
 		if err != nil {
-			// TODO:
-			panic(err)
+			q.broken(conn, err)
+			return
 		}
 		err = desc.Decode(desc.Buf[:])
+		if err == nil {
+			err = desc.checkVersion(q.version)
+		}
 		if err != nil {
-			panic(err)
+			q.broken(conn, err)
+			return
+		}
+		if desc.HeadLength > maxHeadLength {
+			q.broken(conn, fmt.Errorf("response headers too long: %d bytes", desc.HeadLength))
+			return
+		}
+		if int(desc.HeadLength) > len(respHeaderBuffer) {
+			respHeaderBuffer = make([]byte, desc.HeadLength)
 		}
 		// read headers
-		_, err = io.ReadFull(q.conn, respHeaderBuffer[:desc.HeadLength])
+		_, err = io.ReadFull(conn, respHeaderBuffer[:desc.HeadLength])
+		if err == nil {
+			err = desc.verify(respHeaderBuffer[:desc.HeadLength])
+		}
+		// The baseVersion servers number no batches.
+		if err == nil && q.version != baseVersion && desc.Cookie != cookie {
+			err = fmt.Errorf("response batch %d, want %d", desc.Cookie, cookie)
+		}
 		if err != nil {
-			panic(err)
+			q.broken(conn, err)
+			return
 		}
+		cookie++
 		left := desc.HeadLength
 		idx := 0
 		bodyLen := 0
 		for left > 0 {
 			resp := respPool.Get().(*response)
-			n, err := resp.Decode(respHeaderBuffer[idx:])
+			resp.vec = resp.vec[:0]
+			n, err := resp.Decode(respHeaderBuffer[idx:desc.HeadLength], q.version)
 			if err != nil {
-				panic(err)
+				q.broken(conn, err)
+				return
 			}
 			left -= uint32(n)
 			idx += n
@@ -315,120 +593,248 @@ func (q *IOQueue) recvWorker() {
 			resps = append(resps, resp)
 		}
 
-		left = uint32(bodyLen)
+		// The bodies are read into as many buffers as they need, the
+		// worker holds a reference to every buffer until the responses
+		// hold theirs, so no buffer is released while handed out.
+		left64 := int64(bodyLen)
 		var bodyBufs []*common.BodyBuffer
-		for left > 0 {
+		for left64 > 0 {
 			bodyBuf := bodyBufPool.Get().(*common.BodyBuffer)
 			bodyBuf.Release = func() {
 				bodyBufPool.Put(bodyBuf)
 			}
-			fetchLen := min(left, 1024*4096)
-			_, err = io.ReadFull(q.conn, bodyBuf.Buf[:fetchLen])
+			bodyBuf.Inc()
+			fetchLen := min(left64, int64(len(bodyBuf.Buf)))
+			bodyBufs = append(bodyBufs, bodyBuf)
+			_, err = io.ReadFull(conn, bodyBuf.Buf[:fetchLen])
 			if err != nil {
-				panic(err)
+				releaseBodyBufs(bodyBufs)
+				q.broken(conn, err)
+				return
 			}
-			bodyBufs = append(bodyBufs, bodyBuf)
-			left -= fetchLen
+			left64 -= fetchLen
 		}
-		off := 0
-		bodyIdx := 0
-		for _, resp := range resps {
-			if resp.ContentLen > 0 {
-				if off+int(resp.ContentLen) <= 1024*4096 {
-					resp.Body = bytes.NewBuffer(bodyBufs[bodyIdx].Buf[off : off+int(resp.ContentLen)])
-					resp.bdBuf = bodyBufs[bodyIdx]
-					resp.bdBuf.Inc()
-					off = off + int(resp.ContentLen)
-					if off == 1024*4096 {
-						off = 0
-						bodyIdx += 1
-					}
-				} else {
-					buf := make([]byte, resp.ContentLen)
-					n := copy(buf, bodyBufs[bodyIdx].Buf[off:])
-					bodyIdx += 1
-					copy(buf[n:], bodyBufs[bodyIdx].Buf[:int(resp.ContentLen)-n])
-					off = int(resp.ContentLen) - n
-				}
-			}
-			if resp.ContentLen == 0 {
-				panic("")
-			}
-			q.mu.RLock()
+		cursor := bodyCursor{bufs: bodyBufs}
+		for i, resp := range resps {
+			resp.vec = cursor.next(resp.vec, int(resp.ContentLen))
+			q.mu.Lock()
 			ents, ok := q.inflightBatches[resp.BatchId]
 			if !ok {
 				fmt.Printf("batch %d is not found\n", resp.BatchId)
-				q.mu.RUnlock()
+				q.mu.Unlock()
+				resp.release()
 				continue
 			}
-			q.mu.RUnlock()
+			if resp.Idx >= uint32(len(ents.reqs)) || ents.reqs[resp.Idx] == nil {
+				q.mu.Unlock()
+				for _, resp := range resps[i:] {
+					resp.release()
+				}
+				releaseBodyBufs(bodyBufs)
+				q.broken(conn, fmt.Errorf("unexpected response %d of batch %d", resp.Idx, resp.BatchId))
+				return
+			}
 			req := ents.reqs[resp.Idx]
+			ents.reqs[resp.Idx] = nil
 			ents.left -= 1
 			if ents.left == 0 {
-				q.mu.Lock()
 				delete(q.inflightBatches, resp.BatchId)
-				q.mu.Unlock()
 			}
-			req.resp = resp
-			close(req.wait)
+			q.mu.Unlock()
+			// The compressed bodies are checked once decompressed by Get,
+			// the baseVersion bodies have no checksums.
+			if req.crcOn && q.version != baseVersion && resp.Codec == codec.None && checksumVec(resp.vec) != resp.ChkSum {
+				resp.release()
+				req.complete(nil, ErrChecksum)
+				continue
+			}
+			req.complete(resp, nil)
 		}
+		releaseBodyBufs(bodyBufs)
+	}
+}
+
+func releaseBodyBufs(bufs []*common.BodyBuffer) {
+	for _, bb := range bufs {
+		bb.Dec()
 	}
 }
 
 func (q *IOQueue) Close() {
-	q.conn.Close()
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	q.closed = true
+	close(q.done)
+	conn := q.conn
+	q.mu.Unlock()
+	if conn != nil {
+		q.broken(conn, ErrClosed)
+	}
 }
 
 type Client struct {
 	sync.Mutex
-	q          *IOQueue
-	addr       string
-	compressOn bool
-	crcOn      bool
+	queues *queues
+	addr   string
+	codec  codec.Spec
+	crcOn  bool
+}
+
+// ClientOptions configures the client created by NewClientWithOptions.
+type ClientOptions struct {
+	// Conns is the number of IOQueues, each with its own connection.
+	Conns int
+
+	// CompressOn asks for the response bodies compressed with LZ4.
+	CompressOn bool
+
+	// Codec compresses the response bodies, it overrides CompressOn.
+	// The frame.V1 requests get the bodies as is.
+	Codec codec.Spec
+
+	// CrcOn checksums the request and response bodies with CRC32C.
+	// The batch and message headers are always checksummed.
+	CrcOn bool
+
+	// Framing is the message header format, frame.V2 by default.
+	// frame.V1 speaks the baseVersion framing of the servers before
+	// the hello, without checksums.
+	Framing frame.Version
+
+	// Queue chooses the queue of every request, RoundRobin by default.
+	Queue QueuePolicy
+
+	// Batch bounds the request batches of every queue.
+	Batch BatchPolicy
 }
 
+// NewClient opens cons IOQueues to addr and spreads the requests over
+// them round-robin.
 func NewClient(addr string, cons int, compressOn, crcOn bool) (common.BlockClient, error) {
-	q, err := NewIOQueue(addr)
-	if err != nil {
-		return nil, err
+	return NewClientWithOptions(addr, ClientOptions{
+		Conns:      cons,
+		CompressOn: compressOn,
+		CrcOn:      crcOn,
+	})
+}
+
+// NewClientWithOptions opens opts.Conns IOQueues to addr.
+func NewClientWithOptions(addr string, opts ClientOptions) (*Client, error) {
+	cons := opts.Conns
+	if cons <= 0 {
+		cons = 1
 	}
-	cli := &Client{
-		addr:       addr,
-		compressOn: compressOn,
-		crcOn:      crcOn,
-		q:          q,
-	}
-	go func() {
-		for {
-			time.Sleep(heartBeatInterval * time.Microsecond)
-			shouldSubmit <- struct{}{}
+	qs := make([]*IOQueue, 0, cons)
+	for i := 0; i < cons; i++ {
+		q, err := NewIOQueue(addr, opts.Batch, opts.Framing)
+		if err != nil {
+			for _, q := range qs {
+				q.Close()
+			}
+			return nil, err
 		}
-	}()
+		qs = append(qs, q)
+	}
+	cli := &Client{
+		addr:   addr,
+		codec:  opts.Codec,
+		crcOn:  opts.CrcOn,
+		queues: newQueues(qs, opts.Queue),
+	}
+	if opts.CompressOn && cli.codec.ID == codec.None {
+		cli.codec = codec.Spec{ID: codec.LZ4}
+	}
 	return cli, nil
 }
 
+// BatchStats returns the sizes of the request batches of all the queues.
+func (c *Client) BatchStats() BatchHistogram {
+	var h BatchHistogram
+	for _, q := range c.queues.qs {
+		h.Add(q.BatchStats())
+	}
+	return h
+}
+
 func (c *Client) Close() {
-	c.q.Close()
+	c.queues.Close()
 }
 
 func (c *Client) Get(req_ common.Request) (*common.Response, error) {
 	req := reqPool.Get().(*request)
 	req.Request = req_
-	req.compressOn = c.compressOn
+	req.Body = nil
+	req.ContentLen = 0
+	req.codec = c.codec
 	req.crcOn = c.crcOn
 	req.wait = make(chan struct{})
-	resp := c.q.submit(req)
-	var err error
-	if resp.ErrorCode != 0 {
-		err = fmt.Errorf(resp.ErrorMsg)
+	resp, err := c.queues.pick(req.Key).submit(req)
+	if err != nil {
+		return nil, err
 	}
-	buf := resp.Body.(*bytes.Buffer)
-	body := buf.Bytes()
+	if resp.ErrorCode == 0 && resp.Codec != codec.None {
+		return c.decompress(resp)
+	}
+	res := &common.Response{Size: resp.ContentLen}
+	switch len(resp.vec) {
+	case 0:
+	case 1:
+		res.Body = resp.vec[0].Buf
+		res.BB = resp.vec[0].BB
+	default:
+		// The response takes over the references.
+		res.Vec = resp.vec
+		resp.vec = nil
+	}
+	code := resp.ErrorCode
+	resp.vec = resp.vec[:0]
 	respPool.Put(resp)
+	if code != 0 {
+		// The body is the error message.
+		msg := bytes.Join(res.Buffers(), nil)
+		res.Release()
+		return nil, fmt.Errorf("jnet: server error %d: %s", code, msg)
+	}
+	return res, nil
+}
 
-	return &common.Response{
-		Body: body,
-		Size: uint32(len(body)),
-		BB:   resp.bdBuf,
-	}, err
+// decompress returns the body of the compressed response in a buffer
+// of codec.GetBuffer, and puts the response to the pool.
+func (c *Client) decompress(resp *response) (*common.Response, error) {
+	defer resp.release()
+	comp, err := codec.Spec{ID: resp.Codec}.Codec()
+	if err != nil {
+		return nil, err
+	}
+	var src []byte
+	switch len(resp.vec) {
+	case 0:
+	case 1:
+		src = resp.vec[0].Buf
+	default:
+		// The body spans several buffers.
+		joined := codec.GetBuffer(int(resp.ContentLen))
+		defer joined.Dec()
+		src = joined.Buf[:0]
+		for _, s := range resp.vec {
+			src = append(src, s.Buf...)
+		}
+	}
+	bb := codec.GetBuffer(int(resp.RawLen))
+	body := bb.Buf[:resp.RawLen]
+	n, err := comp.Decompress(body, src)
+	if err == nil && n != len(body) {
+		err = fmt.Errorf("jnet: decompressed %d bytes, want %d", n, len(body))
+	}
+	if err == nil && c.crcOn && crc32.Checksum(body, crcTable) != resp.ChkSum {
+		err = ErrChecksum
+	}
+	if err != nil {
+		bb.Dec()
+		return nil, err
+	}
+	return &common.Response{Size: resp.RawLen, Body: body, BB: bb}, nil
 }
@@ -0,0 +1,284 @@
+package jnet
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/datagen"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer hands the test the connections of the clients once their
+// hello is answered, so the test breaks them as it likes.
+func fakeServer(t *testing.T) (string, <-chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if _, _, err = serverHandshake(conn); err != nil {
+				conn.Close()
+				continue
+			}
+			t.Cleanup(func() { conn.Close() })
+			conns <- conn
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+func accept(t *testing.T, conns <-chan net.Conn) net.Conn {
+	select {
+	case conn := <-conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client hasn't connected")
+		return nil
+	}
+}
+
+// readBatch reads a request batch and returns its cookie.
+func readBatch(t *testing.T, conn net.Conn) uint64 {
+	var desc batchHdrDesc
+	if _, err := io.ReadFull(conn, desc.Buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	desc.Decode(desc.Buf[:])
+	heads := make([]byte, desc.HeadLength)
+	if _, err := io.ReadFull(conn, heads); err != nil {
+		t.Fatal(err)
+	}
+	return desc.Cookie
+}
+
+// writeBatch answers the first request of the batch with body, in the
+// response batch numbered cookie.
+func writeBatch(t *testing.T, conn net.Conn, cookie, batch uint64, body []byte) {
+	resp := &response{BatchId: batch, ContentLen: uint32(len(body)), RawLen: uint32(len(body))}
+	head := resp.Encode(ProtocolVersion)
+	desc := &batchHdrDesc{Cookie: cookie, HeadLength: uint32(len(head))}
+	bufs := net.Buffers{desc.seal(ProtocolVersion, net.Buffers{head}), head, body}
+	if _, err := bufs.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(c *Client) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		res, err := c.Get(common.Request{CMD: 1, Key: "key1"})
+		if err == nil {
+			if body := bytes.Join(res.Buffers(), nil); string(body) != "hello" {
+				err = fmt.Errorf("unexpected body %q", body)
+			}
+			res.Release()
+		}
+		errc <- err
+	}()
+	return errc
+}
+
+func TestFailInFlight(t *testing.T) {
+	a := assert.New(t)
+
+	addr, conns := fakeServer(t)
+	c, err := NewClientWithOptions(addr, ClientOptions{Conns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// A dropped connection fails the batch in flight.
+	conn := accept(t, conns)
+	errc := get(c)
+	readBatch(t, conn)
+	conn.Close()
+	var ce *ConnError
+	a.ErrorAs(<-errc, &ce)
+
+	// The next request redials, a lost response batch breaks it too.
+	errc = get(c)
+	conn = accept(t, conns)
+	writeBatch(t, conn, 1, readBatch(t, conn), []byte("hello"))
+	err = <-errc
+	if a.ErrorAs(err, &ce) {
+		a.EqualError(ce.Err, "response batch 1, want 0")
+	}
+
+	errc = get(c)
+	conn = accept(t, conns)
+	writeBatch(t, conn, 0, readBatch(t, conn), []byte("hello"))
+	a.NoError(<-errc)
+	errc = get(c)
+	writeBatch(t, conn, 1, readBatch(t, conn), []byte("hello"))
+	a.NoError(<-errc)
+}
+
+func TestRedial(t *testing.T) {
+	a := assert.New(t)
+
+	s, err := NewServerWithOptions(fmt.Sprintf("unix-abstract://jnet-test-%d", os.Getpid()), "", datagen.NewMemData(), ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+
+	var c *Client
+	for deadline := time.Now().Add(5 * time.Second); c == nil; {
+		if c, err = NewClientWithOptions(s.Addr(), ClientOptions{Conns: 2, CrcOn: true}); err != nil {
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer c.Close()
+
+	for round := 0; round < 3; round++ {
+		// Dropping the connections fails the requests on them only
+		// until the queues redial.
+		s.Close()
+		ok := 0
+		for i := 0; i < 100 && ok < 10; i++ {
+			res, err := c.Get(common.Request{CMD: 1, Key: fmt.Sprint(i)})
+			if err != nil {
+				var ce *ConnError
+				a.ErrorAs(err, &ce)
+				continue
+			}
+			a.Len(bytes.Join(res.Buffers(), nil), 64<<10)
+			res.Release()
+			ok++
+		}
+		a.Equal(10, ok, "round %d", round)
+	}
+}
+
+type closeCounter struct {
+	io.Reader
+	closes *atomic.Int32
+}
+
+func (c closeCounter) Close() error {
+	c.closes.Add(1)
+	return nil
+}
+
+func TestBrokenConnReleasesResponses(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	q := &IOQueueBackend{
+		conn:   server,
+		respCH: make(chan *response, 4),
+		done:   make(chan struct{}),
+	}
+
+	var closes atomic.Int32
+	body := func() *response {
+		return &response{Body: closeCounter{Reader: bytes.NewReader(nil), closes: &closes}, ContentLen: 1}
+	}
+	q.submit(body())
+	q.submit(body())
+	q.fail(errors.New("broken"))
+	q.submitWorker()
+	q.submit(body())
+	assert.Equal(t, int32(3), closes.Load())
+}
+
+func TestSubmitFullQueue(t *testing.T) {
+	s, err := NewServerWithOptions(fmt.Sprintf("unix-abstract://jnet-full-%d", os.Getpid()), "", datagen.NewMemData(), ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	var c *Client
+	for deadline := time.Now().Add(5 * time.Second); c == nil; {
+		if c, err = NewClientWithOptions(s.Addr(), ClientOptions{Conns: 1}); err != nil {
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// More requests than reqCH holds wait for room, not for each other.
+	const n = 3 * 2048
+	errc := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			res, err := c.Get(common.Request{CMD: 0, Key: "key0"})
+			if err == nil {
+				res.Release()
+			}
+			errc <- err
+		}()
+	}
+	timeout := time.After(20 * time.Second)
+	for i := 0; i < n; i++ {
+		select {
+		case err := <-errc:
+			assert.NoError(t, err)
+		case <-timeout:
+			t.Fatalf("%d of %d requests completed", i, n)
+		}
+	}
+
+	c.Close()
+	_, err = c.Get(common.Request{CMD: 0, Key: "key0"})
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestBaseVersion(t *testing.T) {
+	a := assert.New(t)
+
+	s, err := NewServerWithOptions(fmt.Sprintf("unix-abstract://jnet-base-%d", os.Getpid()), "", datagen.NewMemData(), ServerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	defer s.Close()
+
+	var c *Client
+	for deadline := time.Now().Add(5 * time.Second); c == nil; {
+		if c, err = NewClientWithOptions(s.Addr(), ClientOptions{Conns: 1, CrcOn: true, Framing: frame.V1}); err != nil {
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer c.Close()
+
+	// The message header is the frame.V1 header with the body length
+	// after the flags.
+	req := &request{Request: common.Request{CMD: 1, Key: "key1"}, crcOn: true, ContentLen: 5}
+	head, err := req.Encode(baseVersion)
+	a.NoError(err)
+	a.Equal(append([]byte{1, 4, frame.FlagCRC, 0, 0, 0, 5}, "key1"...), head)
+
+	res, err := c.Get(common.Request{CMD: 1, Key: "key1"})
+	if a.NoError(err) {
+		a.Len(bytes.Join(res.Buffers(), nil), 64<<10)
+		res.Release()
+	}
+	_, err = c.Get(common.Request{CMD: 9, Key: "key9"})
+	a.ErrorContains(err, "invalid command")
+}
@@ -0,0 +1,165 @@
+package jnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// ProtocolVersion is the version of the batch framing spoken by this
+// package.
+//
+// Every connection starts with the client sending a hello of the version
+// it speaks, the server answers with the same version, or with 0 if it
+// doesn't speak it and closes the connection.
+const ProtocolVersion = 2
+
+// baseVersion is the framing of the jnet peers before the hello, spoken
+// by the clients of frame.V1 requests: no hello and no checksums, the
+// message headers are the frame.V1 request header with the body length
+// after its flags, and the 20 bytes response header before the checksum.
+// The bodies are sent as is.
+const baseVersion = 1
+
+const (
+	helloMagic     = 0x4a4e4554 // "JNET"
+	helloLen       = 8
+	batchHdrLen    = 20
+	respHeaderLen  = 32
+	baseRespLen    = 20 // of baseVersion
+	maxHeadLength  = 1 << 20
+	handshakeLimit = 5 * time.Second
+)
+
+var (
+	// ErrChecksum is returned for the responses whose body doesn't
+	// match its checksum. The connection stays usable.
+	ErrChecksum = errors.New("jnet: body checksum mismatch")
+
+	errBadMagic = errors.New("jnet: not a jnet peer")
+)
+
+// VersionError is returned if the peers speak different protocol versions.
+type VersionError struct {
+	Version uint32
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("jnet: unsupported protocol version %d", e.Version)
+}
+
+func encodeHello(version uint32) []byte {
+	var b [helloLen]byte
+	binary.BigEndian.PutUint32(b[0:4], helloMagic)
+	binary.BigEndian.PutUint32(b[4:8], version)
+	return b[:]
+}
+
+func readHello(conn net.Conn) (uint32, error) {
+	var b [helloLen]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(b[0:4]) != helloMagic {
+		return 0, errBadMagic
+	}
+	return binary.BigEndian.Uint32(b[4:8]), nil
+}
+
+// clientHandshake checks the server of a new connection speaks
+// ProtocolVersion.
+func clientHandshake(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(handshakeLimit))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(encodeHello(ProtocolVersion)); err != nil {
+		return err
+	}
+	answer, err := readHello(conn)
+	if err != nil {
+		return err
+	}
+	if answer != ProtocolVersion {
+		// 0 is the server rejecting ours.
+		return &VersionError{Version: answer}
+	}
+	return nil
+}
+
+// serverHandshake answers the hello of a new connection and returns its
+// version, rejecting the clients speaking neither ProtocolVersion nor
+// baseVersion. The baseVersion clients send no hello but their first
+// batch header, r replays the part of it read to tell.
+func serverHandshake(conn net.Conn) (version uint32, r io.Reader, err error) {
+	var b [helloLen]byte
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return 0, nil, err
+	}
+	switch binary.BigEndian.Uint32(b[:4]) {
+	case helloMagic:
+	case baseVersion:
+		return baseVersion, io.MultiReader(bytes.NewReader(b[:4]), conn), nil
+	default:
+		return 0, nil, errBadMagic
+	}
+	// The connection may idle before its first message, the limit
+	// applies to the rest of the hello.
+	conn.SetDeadline(time.Now().Add(handshakeLimit))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := io.ReadFull(conn, b[4:]); err != nil {
+		return 0, nil, err
+	}
+	if version = binary.BigEndian.Uint32(b[4:]); version != ProtocolVersion {
+		conn.Write(encodeHello(0))
+		return 0, nil, &VersionError{Version: version}
+	}
+	_, err = conn.Write(encodeHello(version))
+	return version, conn, err
+}
+
+// seal encodes the batch header of the version with the checksum over
+// itself and the message headers. The baseVersion headers have none.
+func (d *batchHdrDesc) seal(version uint32, heads net.Buffers) []byte {
+	d.Version = version
+	d.ChkSum = 0
+	b := d.Encode()
+	if version == baseVersion {
+		return b
+	}
+	crc := crc32.Update(0, crcTable, b[:batchHdrLen])
+	for _, h := range heads {
+		crc = crc32.Update(crc, crcTable, h)
+	}
+	d.ChkSum = crc
+	binary.BigEndian.PutUint32(b[16:20], crc)
+	return b
+}
+
+// checkVersion checks the decoded header is of the version of the
+// connection before its HeadLength is trusted.
+func (d *batchHdrDesc) checkVersion(version uint32) error {
+	if d.Version != version {
+		return &VersionError{Version: d.Version}
+	}
+	return nil
+}
+
+// verify checks the checksum of the decoded header and the message headers.
+func (d *batchHdrDesc) verify(heads []byte) error {
+	if d.Version == baseVersion {
+		return nil
+	}
+	var b [batchHdrLen]byte
+	copy(b[:], d.Buf[:batchHdrLen])
+	binary.BigEndian.PutUint32(b[16:20], 0)
+	crc := crc32.Update(0, crcTable, b[:])
+	crc = crc32.Update(crc, crcTable, heads)
+	if crc != d.ChkSum {
+		return fmt.Errorf("jnet: batch %d header checksum mismatch", d.Cookie)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package jnet
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// QueuePolicy chooses the IOQueue of every request of a Client.
+type QueuePolicy int
+
+const (
+	// RoundRobin spreads the requests over the queues in turn.
+	RoundRobin QueuePolicy = iota
+
+	// KeyHash sends requests with the same key to the same queue.
+	KeyHash
+
+	// CPU keeps the requests of a scheduler P, thus of the goroutines
+	// running on a CPU, on the same queue.
+	CPU
+)
+
+var queuePolicyNames = []string{
+	RoundRobin: "roundrobin",
+	KeyHash:    "hash",
+	CPU:        "cpu",
+}
+
+func (p QueuePolicy) String() string {
+	if p < 0 || int(p) >= len(queuePolicyNames) {
+		return "QueuePolicy(" + strconv.Itoa(int(p)) + ")"
+	}
+	return queuePolicyNames[p]
+}
+
+// ParseQueuePolicy returns the policy with the given name:
+// roundrobin, hash or cpu.
+func ParseQueuePolicy(name string) (QueuePolicy, error) {
+	for p, n := range queuePolicyNames {
+		if n == name {
+			return QueuePolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown queue policy %q", name)
+}
+
+// queues is the set of IOQueues of a Client.
+type queues struct {
+	qs     []*IOQueue
+	policy QueuePolicy
+	next   atomic.Uint64
+
+	// The pool caches a queue index per P, see CPU.
+	cpuIdx sync.Pool
+}
+
+func newQueues(qs []*IOQueue, policy QueuePolicy) *queues {
+	s := &queues{
+		qs:     qs,
+		policy: policy,
+	}
+	s.cpuIdx.New = func() any {
+		idx := int(s.next.Add(1) % uint64(len(s.qs)))
+		return &idx
+	}
+	return s
+}
+
+func (s *queues) pick(key string) *IOQueue {
+	if len(s.qs) == 1 {
+		return s.qs[0]
+	}
+	switch s.policy {
+	case KeyHash:
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return s.qs[h.Sum32()%uint32(len(s.qs))]
+	case CPU:
+		idx := s.cpuIdx.Get().(*int)
+		q := s.qs[*idx]
+		s.cpuIdx.Put(idx)
+		return q
+	default:
+		return s.qs[s.next.Add(1)%uint64(len(s.qs))]
+	}
+}
+
+func (s *queues) Close() {
+	for _, q := range s.qs {
+		q.Close()
+	}
+}
@@ -2,14 +2,18 @@ package jnet
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"net"
+	"os"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
 	"github.com/codingpoeta/net-model-bench/utils"
 )
 
@@ -25,15 +29,34 @@ type IOQueueBackend struct {
 	conn    net.Conn
 	dataGen common.DataGen
 	respCH  chan *response
+
+	// mode is how the bodies are sent: MODE_SENDBUF copies them
+	// to memory, MODE_SENDFILE and MODE_SPLICE send the files of
+	// the data generator without a copy.
+	mode        common.ServerMode
+	batchPolicy BatchPolicy
+	recvBatches BatchHistogram
+	sendBatches BatchHistogram
+
+	// nextCookie numbers the response batches, the client checks
+	// none is lost.
+	nextCookie uint64
+	version    atomic.Uint32 // of the client's hello, or baseVersion
+
+	closeOnce sync.Once
+	done      chan struct{}
 }
 
 var workPool = NewWorkerPool()
 
-func NewIOQueueBackend(dataGen common.DataGen, c net.Conn) *IOQueueBackend {
+func NewIOQueueBackend(dataGen common.DataGen, c net.Conn, mode common.ServerMode, batch BatchPolicy) *IOQueueBackend {
 	q := &IOQueueBackend{
-		conn:    c,
-		dataGen: dataGen,
-		respCH:  make(chan *response, 2048),
+		conn:        c,
+		dataGen:     dataGen,
+		respCH:      make(chan *response, 2048),
+		mode:        mode,
+		batchPolicy: batch,
+		done:        make(chan struct{}),
 	}
 	go q.submitWorker()
 	go q.recvWorker()
@@ -44,61 +67,75 @@ func (q *IOQueueBackend) recvWorker() {
 	fmt.Println("server recv worker started")
 	defer fmt.Println("server recv worker closed")
 
+	version, r, err := serverHandshake(q.conn)
+	if err != nil {
+		q.fail(err)
+		return
+	}
+	q.version.Store(version)
+
 	var desc batchHdrDesc
-	var reqHeaderBuffer [1024 * 1024]byte
+	var reqHeaderBuffer [maxHeadLength]byte
 	reqs := make([]*request, 0)
-	totalMergeCount := 0
-	totalCallCount := 0
-	lastPrintTime := time.Now()
-	lastPrintMergeCount := 0
-	lastPrintCallCount := 0
 	for {
 		reqs = reqs[:0]
-		_, err := io.ReadFull(q.conn, desc.Buf[:])
+		_, err := io.ReadFull(r, desc.Buf[:])
 		if err != nil {
-			// TODO:
-			panic(err)
+			q.fail(err)
+			return
 		}
 		err = desc.Decode(desc.Buf[:])
+		if err == nil {
+			err = desc.checkVersion(version)
+		}
 		if err != nil {
-			panic(err)
+			q.fail(err)
+			return
+		}
+		if desc.HeadLength > uint32(len(reqHeaderBuffer)) {
+			q.fail(fmt.Errorf("request headers too long: %d bytes", desc.HeadLength))
+			return
 		}
 
 		// read headers
-		_, err = io.ReadFull(q.conn, reqHeaderBuffer[:desc.HeadLength])
+		heads := reqHeaderBuffer[:desc.HeadLength]
+		_, err = io.ReadFull(r, heads)
+		if err == nil {
+			err = desc.verify(heads)
+		}
 		if err != nil {
-			panic(err)
+			q.fail(err)
+			return
 		}
 		left := desc.HeadLength
 		idx := 0
+		size := 0
 		for left > 0 {
 			req := reqPool.Get().(*request)
-			n, err := req.Decode(reqHeaderBuffer[idx:])
+			req.Body = nil
+			req.badBody = false
+			n, err := req.Decode(heads[idx:], version)
 			if err != nil {
-				panic(err)
+				q.fail(err)
+				return
 			}
 			left -= uint32(n)
 			idx += n
 			if req.ContentLen > 0 {
 				buf := bytes.NewBuffer(nil)
-				_, err = io.CopyN(buf, q.conn, int64(req.ContentLen))
+				_, err = io.CopyN(buf, r, int64(req.ContentLen))
 				if err != nil {
-					panic(err)
+					q.fail(err)
+					return
 				}
 				req.Body = buf
+				// The headers are intact, so only this request fails.
+				req.badBody = req.crcOn && crc32.Checksum(buf.Bytes(), crcTable) != req.ChkSum
 			}
 			reqs = append(reqs, req)
+			size += int(req.ContentLen)
 		}
-		totalMergeCount += len(reqs)
-		totalCallCount += 1
-		if time.Now().After(lastPrintTime.Add(time.Second * 10)) {
-			callCount := totalCallCount - lastPrintCallCount
-			mergeCount := totalMergeCount - lastPrintMergeCount
-			fmt.Printf("server recv: avg batch count %d\n", mergeCount/callCount)
-			lastPrintMergeCount = totalMergeCount
-			lastPrintCallCount = totalCallCount
-			lastPrintTime = time.Now()
-		}
+		q.recvBatches.observe(len(reqs), size)
 		for idx, req := range reqs {
 			req.batchId = desc.Cookie
 			req.idx = uint32(idx)
@@ -118,197 +155,420 @@ func (q *IOQueueBackend) processRequest(req *request) {
 	resp := respPool.Get().(*response)
 	resp.Idx = req.idx
 	resp.BatchId = req.batchId
-	var buf []byte
-	switch req.CMD {
-	case 0:
-		buf = q.dataGen.Get("key0")
-	case 1:
-		buf = q.dataGen.Get("key1")
-	case 2:
-		buf = q.dataGen.Get("key2")
-	case 3:
-		buf = q.dataGen.Get("key3")
-	case 4:
-		buf = q.dataGen.Get("key4")
-	default:
-		resp.ErrorCode = 1
-		resp.ErrorMsg = "invalid command"
-	}
+	resp.ErrorCode = 0
+	resp.ErrorMsg = ""
+	resp.crcOn = req.crcOn
+	resp.ChkSum = 0
+	cmd, op, offset, length := req.CMD, req.Op, req.Offset, req.Length
+	spec, badBody := req.codec, req.badBody
 	reqPool.Put(req)
-	resp.ContentLen = uint32(len(buf))
-	resp.Body = bytes.NewBuffer(buf)
+	if badBody {
+		q.submitError(resp, errCodeChecksum, "request body checksum mismatch")
+		return
+	}
+	if cmd > 4 || op != common.OpGet {
+		q.submitError(resp, errCodeInvalid, fmt.Sprintf("invalid command %d, op %s", cmd, op))
+		return
+	}
+	key := fmt.Sprintf("key%d", cmd)
+	size := uint64(q.dataGen.GetSize(key))
+	n, err := frame.Range(size, offset, length)
+	if err != nil {
+		q.submitError(resp, errCodeInvalid, err.Error())
+		return
+	}
+	resp.ContentLen = uint32(n)
+	resp.RawLen = resp.ContentLen
+	resp.Codec = codec.None
+	if spec.ID != codec.None {
+		c, err := spec.Codec()
+		if err == nil {
+			err = q.compressBody(resp, key, offset, n, c)
+		}
+		if err != nil {
+			q.submitError(resp, errCodeInternal, err.Error())
+			return
+		}
+	} else if q.mode == common.MODE_SENDBUF {
+		buf := q.dataGen.Get(key)[offset : offset+n]
+		resp.Body = bytes.NewBuffer(buf)
+		if resp.crcOn {
+			resp.ChkSum = crc32.Checksum(buf, crcTable)
+		}
+	} else {
+		resp.Body = q.dataGen.GetReadCloser(key)
+		if offset != 0 {
+			if err := seekBody(resp.Body, int64(offset)); err != nil {
+				q.submitError(resp, errCodeInternal, err.Error())
+				return
+			}
+		}
+		if resp.crcOn {
+			// The file is read twice, the checksum costs what the
+			// zero-copy send saves.
+			if err := checksumFile(resp); err != nil {
+				q.submitError(resp, errCodeInternal, err.Error())
+				return
+			}
+		}
+	}
 	q.submit(resp)
 }
 
+// Error codes of the responses, the body is the message.
+const (
+	errCodeInvalid  = 1
+	errCodeChecksum = 2
+	errCodeInternal = 3
+)
+
+func (q *IOQueueBackend) submitError(resp *response, code uint32, msg string) {
+	if c, ok := resp.Body.(io.Closer); ok {
+		c.Close()
+	}
+	resp.ErrorCode = code
+	resp.ErrorMsg = msg
+	resp.ContentLen = 0
+	resp.ChkSum = 0
+	resp.RawLen = 0
+	resp.Codec = codec.None
+	q.submit(resp)
+}
+
+// compressBody sets the body compressed by c, or as is if it doesn't
+// shrink. The file bodies are read to memory first, the codecs need
+// them there.
+func (q *IOQueueBackend) compressBody(resp *response, key string, offset, n uint64, c codec.Codec) error {
+	var body []byte
+	if q.mode == common.MODE_SENDBUF {
+		body = q.dataGen.Get(key)[offset : offset+n]
+	} else {
+		f := q.dataGen.GetReadCloser(key)
+		defer f.Close()
+		if offset != 0 {
+			if err := seekBody(f, int64(offset)); err != nil {
+				return err
+			}
+		}
+		resp.bodyBuf = codec.GetBuffer(int(n))
+		body = resp.bodyBuf.Buf[:n]
+		if _, err := io.ReadFull(f, body); err != nil {
+			return err
+		}
+	}
+	if resp.crcOn {
+		resp.ChkSum = crc32.Checksum(body, crcTable)
+	}
+	// The bodies the codec fails on are sent as is too, the codec
+	// counts the failures in its report.
+	bb, comp, _ := codec.CompressBody(c, body)
+	if bb != nil {
+		if resp.bodyBuf != nil {
+			resp.bodyBuf.Dec()
+		}
+		resp.bodyBuf = bb
+		body = comp
+		resp.Codec = c.Spec().ID
+		resp.ContentLen = uint32(len(comp))
+	}
+	resp.Body = bytes.NewBuffer(body)
+	return nil
+}
+
+func seekBody(body io.Reader, offset int64) error {
+	f, ok := body.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("can't seek %T body", body)
+	}
+	_, err := f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// checksumFile sets the checksum of the file body and rewinds it.
+func checksumFile(resp *response) error {
+	f, ok := resp.Body.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("can't checksum %T body", resp.Body)
+	}
+	h := crc32.New(crcTable)
+	if _, err := io.CopyN(h, f, int64(resp.ContentLen)); err != nil {
+		return err
+	}
+	if _, err := f.Seek(-int64(resp.ContentLen), io.SeekCurrent); err != nil {
+		return err
+	}
+	resp.ChkSum = h.Sum32()
+	return nil
+}
+
+// submit queues the response, or drops it if the connection is broken.
 func (q *IOQueueBackend) submit(resp *response) {
-	resp.encodedHead = resp.Encode()
-	q.respCH <- resp
+	resp.encodedHead = resp.Encode(q.version.Load())
+	select {
+	case q.respCH <- resp:
+	case <-q.done:
+		resp.release()
+		return
+	}
+	select {
+	case <-q.done:
+		// Queued after submitWorker drained the queue, or before,
+		// it's drained either way.
+		q.drain()
+	default:
+	}
+}
+
+// drain releases the queued responses of the broken connection,
+// closing their files and dropping their buffers.
+func (q *IOQueueBackend) drain() {
+	for {
+		select {
+		case resp := <-q.respCH:
+			resp.release()
+		default:
+			return
+		}
+	}
 }
 
-func (q *IOQueueBackend) flush(resps []*response) {
+// release closes the file body of the response, drops the references
+// to the body buffers and puts it to the pool.
+func (resp *response) release() {
+	if c, ok := resp.Body.(io.Closer); ok {
+		c.Close()
+	}
+	resp.Body = nil
+	if resp.bodyBuf != nil {
+		resp.bodyBuf.Dec()
+		resp.bodyBuf = nil
+	}
+	for _, s := range resp.vec {
+		s.BB.Dec()
+	}
+	resp.vec = resp.vec[:0]
+	respPool.Put(resp)
+}
+
+func (q *IOQueueBackend) flush(resps []*response) error {
 	hLen := 0
 	for _, resp := range resps {
 		hLen += len(resp.encodedHead)
 	}
-	var bufs net.Buffers
+	var heads net.Buffers
+	for _, resp := range resps {
+		heads = append(heads, resp.encodedHead)
+	}
 	batch := &batchHdrDesc{
-		Version:    1,
-		Cookie:     0, // TODO: resp should have a invalid cookie
+		Cookie:     q.nextCookie,
 		HeadLength: uint32(hLen),
-		ChkSum:     0,
-	}
-	bufs = append(bufs, batch.Encode())
-	for _, resp := range resps {
-		bufs = append(bufs, resp.encodedHead)
 	}
-	writeBody := true
+	q.nextCookie++
+	bufs := append(net.Buffers{batch.seal(q.version.Load(), heads)}, heads...)
+	defer func() {
+		for _, resp := range resps {
+			resp.release()
+		}
+	}()
+
+	// The memory bodies follow the headers in the same writev, the file
+	// bodies are sent on their own in between.
 	for _, resp := range resps {
-		if buf, ok := resp.Body.(*bytes.Buffer); resp.Body != nil && ok {
-			bufs = append(bufs, buf.Bytes())
-			writeBody = false
+		switch body := resp.Body.(type) {
+		case nil:
+		case *bytes.Buffer:
+			bufs = append(bufs, body.Bytes())
+		default:
+			if err := writeBuffers(q.conn, bufs); err != nil {
+				return err
+			}
+			bufs = bufs[:0]
+			if err := q.sendBody(body, int(resp.ContentLen)); err != nil {
+				return err
+			}
 		}
 	}
+	return writeBuffers(q.conn, bufs)
+}
 
+func writeBuffers(conn net.Conn, bufs net.Buffers) error {
 	for len(bufs) > 0 {
-		_, err := bufs.WriteTo(q.conn)
-		if err != nil {
-			// TODO: reconnect
-			panic(err)
-		}
-	}
-	if writeBody {
-		for _, resp := range resps {
-			if resp.Body != nil {
-				_, err := io.Copy(q.conn, resp.Body)
-				if err != nil {
-					// TODO: reconnect
-					panic(err)
-				}
-			}
+		if _, err := bufs.WriteTo(conn); err != nil {
+			return err
 		}
 	}
-	for _, resp := range resps {
-		respPool.Put(resp)
-	}
+	return nil
+}
 
+// sendBody sends the file body with splice in MODE_SPLICE, with sendfile
+// otherwise. The other readers are copied.
+func (q *IOQueueBackend) sendBody(body io.Reader, size int) error {
+	if f, ok := body.(*os.File); ok && q.mode == common.MODE_SPLICE {
+		return utils.SpliceSendFile(q.conn, f, size)
+	}
+	// io.CopyN sends files to both TCP and unix sockets with sendfile.
+	_, err := io.CopyN(q.conn, body, int64(size))
+	return err
 }
 
 func (q *IOQueueBackend) submitWorker() {
-	// no batch in this version
 	fmt.Println("server submit worker started")
 	defer fmt.Println("server submit worker closed")
-	totalMergeCount := 0
-	totalCallCount := 0
-	lastPrintTime := time.Now()
-	lastPrintMergeCount := 0
-	lastPrintCallCount := 0
-	resps := make([]*response, 0)
-	totalPayloadSize := 0
-	for resp := range q.respCH {
-		if resp == nil {
+	// The worker returns once done is closed, so the responses
+	// submitted before are drained here and the later ones by submit.
+	defer q.drain()
+
+	b := newBatcher(q.batchPolicy, q.respCH, q.done, func(resp *response) int {
+		return int(resp.ContentLen)
+	}, &q.sendBatches)
+	var resps []*response
+	for {
+		var ok bool
+		if resps, ok = b.next(resps); !ok {
 			return
 		}
-		resps = append(resps, resp)
-		for {
-			shouldBreak := false
-			select {
-			case resp = <-q.respCH:
-				if resp == nil {
-					return
-				}
-				resps = append(resps, resp)
-				totalPayloadSize += int(resp.ContentLen)
-				if len(resps) > MaxBatchCount {
-					shouldBreak = true
-				}
-				if totalPayloadSize > MaxBatchSize {
-					shouldBreak = true
-				}
-			case <-shouldSubmit:
-				shouldBreak = true
-			}
-			if shouldBreak {
-				break
-			}
-		}
-		totalMergeCount += len(resps)
-		totalCallCount += 1
-		if time.Now().After(lastPrintTime.Add(time.Second * 10)) {
-			callCount := totalCallCount - lastPrintCallCount
-			mergeCount := totalMergeCount - lastPrintMergeCount
-			fmt.Printf("server submit: avg merge count %d\n", mergeCount/callCount)
-			lastPrintMergeCount = totalMergeCount
-			lastPrintCallCount = totalCallCount
-			lastPrintTime = time.Now()
+		if err := q.flush(resps); err != nil {
+			q.fail(err)
+			return
 		}
-		q.flush(resps)
-		resps = make([]*response, 0)
-		totalPayloadSize = 0
 	}
 }
 
+// fail closes the broken connection, the other connections are served on.
+func (q *IOQueueBackend) fail(err error) {
+	q.closeOnce.Do(func() {
+		if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+			fmt.Printf("drop connection %s: %v\n", q.conn.RemoteAddr(), err)
+		}
+		q.conn.Close()
+		close(q.done)
+	})
+}
+
+// Done is closed when the connection is closed.
+func (q *IOQueueBackend) Done() <-chan struct{} {
+	return q.done
+}
+
 func (q *IOQueueBackend) Close() {
-	q.conn.Close()
+	q.fail(net.ErrClosed)
+}
+
+// BatchStats returns the sizes of the request batches received and
+// of the response batches sent.
+func (q *IOQueueBackend) BatchStats() (recv, sent BatchHistogram) {
+	return q.recvBatches.Snapshot(), q.sendBatches.Snapshot()
 }
 
 type Server struct {
 	sync.Mutex
+	mode     common.ServerMode
 	listener net.Listener
 	ip       string
 	port     int
 	dataGen  common.DataGen
 	backends []*IOQueueBackend
+	opts     ServerOptions
+
+	// Batches of the closed connections.
+	recvBatches BatchHistogram
+	sendBatches BatchHistogram
+}
+
+// ServerOptions configures the server created by NewServerWithOptions.
+type ServerOptions struct {
+	// Batch bounds the response batches of every connection.
+	Batch BatchPolicy
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
-	ip, err := utils.FindLocalIP(ip, iname)
+	return NewServerWithOptions(ip, iname, dg, ServerOptions{})
+}
+
+func NewServerWithOptions(ip, iname string, dg common.DataGen, opts ServerOptions) (*Server, error) {
+	ip, err := utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
 
 	svr := &Server{
+		mode:     common.MODE_SENDBUF,
 		ip:       ip,
 		port:     8000,
 		dataGen:  dg,
 		backends: make([]*IOQueueBackend, 0),
+		opts:     opts,
+	}
+	switch os.Getenv("SERVER_MODE") {
+	case "sendfile":
+		svr.mode = common.MODE_SENDFILE
+	case "splice":
+		svr.mode = common.MODE_SPLICE
 	}
-	go func() {
-		for {
-			time.Sleep(heartBeatInterval * time.Microsecond)
-			shouldSubmit <- struct{}{}
-		}
-	}()
-
 	return svr, nil
 }
 
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.ip, s.port)
+	return utils.JoinHostPort(s.ip, s.port)
 }
 
 func (s *Server) Serve() (err error) {
-	for {
-		s.listener, err = net.Listen("tcp", s.Addr())
-		if err == nil {
-			break
-		}
-		s.port++
+	if s.listener, err = utils.ListenPort(s.ip, &s.port); err != nil {
+		return err
 	}
 	fmt.Println("listening on", s.Addr())
+	fmt.Println("zero-copy:", utils.ProbeZeroCopy(s.Addr()))
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
 			fmt.Println(err)
 			break
 		}
-		q := NewIOQueueBackend(s.dataGen, conn)
+		q := NewIOQueueBackend(s.dataGen, conn, s.mode, s.opts.Batch)
+		s.Lock()
 		s.backends = append(s.backends, q)
+		s.Unlock()
+		go func() {
+			<-q.Done()
+			s.removeBackend(q)
+		}()
 	}
 	return err
 }
 
-func (s *Server) Close() {
+func (s *Server) removeBackend(q *IOQueueBackend) {
+	s.Lock()
+	defer s.Unlock()
+	for i, b := range s.backends {
+		if b == q {
+			s.backends = append(s.backends[:i], s.backends[i+1:]...)
+			recv, sent := q.BatchStats()
+			s.recvBatches.Add(recv)
+			s.sendBatches.Add(sent)
+			return
+		}
+	}
+}
+
+// BatchStats returns the sizes of the request batches received and
+// of the response batches sent on all the connections.
+func (s *Server) BatchStats() (recv, sent BatchHistogram) {
+	s.Lock()
+	defer s.Unlock()
+	recv, sent = s.recvBatches, s.sendBatches
 	for _, b := range s.backends {
+		r, w := b.BatchStats()
+		recv.Add(r)
+		sent.Add(w)
+	}
+	return recv, sent
+}
+
+func (s *Server) Close() {
+	s.Lock()
+	backends := append([]*IOQueueBackend(nil), s.backends...)
+	s.Unlock()
+	for _, b := range backends {
 		b.Close()
 	}
 }
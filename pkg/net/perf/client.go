@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/utils"
 )
 
 type Client struct {
@@ -18,7 +19,7 @@ type Client struct {
 
 func (c *Client) getConn() (net.Conn, error) {
 	dialer := &net.Dialer{Timeout: time.Second + time.Millisecond*100, KeepAlive: time.Minute}
-	conn, err := dialer.Dial("tcp", c.addr)
+	conn, err := utils.Dial(dialer, c.addr)
 	if err != nil {
 		return nil, err
 	}
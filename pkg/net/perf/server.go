@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"github.com/codingpoeta/net-model-bench/common"
 	"github.com/codingpoeta/net-model-bench/utils"
+	"io"
 	"log"
 	"net"
 	"os"
@@ -20,18 +21,15 @@ type Server struct {
 }
 
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.ip, s.port)
+	return utils.JoinHostPort(s.ip, s.port)
 }
 
 func (s *Server) Serve() (err error) {
-	for {
-		s.listener, err = net.Listen("tcp", s.Addr())
-		if err == nil {
-			break
-		}
-		s.port++
+	if s.listener, err = utils.ListenPort(s.ip, &s.port); err != nil {
+		return err
 	}
 	fmt.Println("listening on", s.Addr())
+	fmt.Println("zero-copy:", utils.ProbeZeroCopy(s.Addr()))
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -46,8 +44,7 @@ func (s *Server) Serve() (err error) {
 const basepath = "./data/file"
 
 func (s *Server) handle(conn net.Conn) {
-	tcpConn := conn.(*net.TCPConn)
-	defer tcpConn.Close()
+	defer conn.Close()
 
 	for {
 		file, err := os.OpenFile(basepath, os.O_RDONLY, 0)
@@ -59,11 +56,11 @@ func (s *Server) handle(conn net.Conn) {
 		switch s.mode {
 		case common.MODE_SENDBUF:
 			buf := s.dataGen.Get("key4")
-			_, err = tcpConn.Write(buf)
+			_, err = conn.Write(buf)
 		case common.MODE_SENDFILE:
-			_, err = tcpConn.ReadFrom(file)
+			_, err = io.Copy(conn, file)
 		case common.MODE_SPLICE:
-			err = utils.SpliceSendFile(tcpConn, file, s.dataGen.GetSize("key4"))
+			err = utils.SpliceSendFile(conn, file, s.dataGen.GetSize("key4"))
 		}
 		file.Close()
 		if err != nil {
@@ -84,7 +81,7 @@ func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error)
 	file.Write(dg.Get(fmt.Sprintf("key%d", 4)))
 	file.Close()
 
-	ip, err = utils.FindLocalIP(ip, iname)
+	ip, err = utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
@@ -1,6 +1,7 @@
 package quic
 
 import (
+	"bufio"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
@@ -8,7 +9,6 @@ import (
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
-	"io"
 	"math/big"
 	"net"
 	"strconv"
@@ -17,56 +17,19 @@ import (
 	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
 	"github.com/quic-go/quic-go"
 )
 
 type request struct {
-	common.Request
-	compressOn bool
-	crcOn      bool
-	Buf        [256]byte
+	frame.Header
 }
 
-func (r *request) Write(w io.Writer) error {
-	buf := r.Buf[:]
-	buf[0] = r.CMD & 0xF
-	buf[1] = byte(len(r.Key))
-	buf[2] = 0
-	if r.compressOn {
-		buf[2] |= 0x01
-	}
-	if r.crcOn {
-		buf[2] |= 0x02
-	}
-	if len(r.Key) > 255 {
-		buf[0] += byte(len(r.Key)>>8) << 4
-	}
-	copy(buf[3:], r.Key)
-	// fmt.Printf("CMD: %d, Key: %s\n", r.CMD, r.Key)
-	if _, err := w.Write(buf[:len(r.Key)+3]); err != nil {
-		return err
-	}
-	return nil
-}
-
-func (r *request) Read(str io.Reader) error {
-	if _, err := io.ReadFull(str, r.Buf[:3]); err != nil {
+func (r *request) Read(br *bufio.Reader) error {
+	if err := frame.Read(br, &r.Header); err != nil {
 		return err
 	}
-	r.CMD = r.Buf[0] & 0x0F
-	size := int(r.Buf[1]) + int(r.Buf[0]>>4)<<8
-	if r.Buf[2]&0x01 != 0 {
-		r.compressOn = true
-	}
-	if r.Buf[2]&0x02 != 0 {
-		r.crcOn = true
-	}
-
-	buf := r.Buf[:size]
-	if _, err := io.ReadFull(str, buf); err != nil {
-		return err
-	}
-	r.Key = string(buf)
 	// fmt.Println("CMD:", r.CMD, "Key:", r.Key)
 	return nil
 }
@@ -78,11 +41,17 @@ type quicConn struct {
 
 type Client struct {
 	sync.Mutex
-	addr       *net.UDPAddr
-	compressOn bool
-	crcOn      bool
-	quicConf   *quic.Config
-	quicConns  chan *quicConn
+	addr      *net.UDPAddr
+	crcOn     bool
+	quicConf  *quic.Config
+	quicConns chan *quicConn
+
+	// Framing is the request header format, frame.V2 by default.
+	Framing frame.Version
+
+	// Codec compresses the response bodies, LZ4 if compressOn.
+	// The codecs other than LZ4 need frame.V2.
+	Codec codec.Spec
 }
 
 func NewClient(addr string, cons int, compressOn, crcOn bool) common.BlockClient {
@@ -90,13 +59,17 @@ func NewClient(addr string, cons int, compressOn, crcOn bool) common.BlockClient
 	if err != nil {
 		return nil
 	}
-	return &Client{
-		addr:       &net.UDPAddr{IP: net.ParseIP(strings.Split(addr, ":")[0]), Port: port},
-		compressOn: compressOn,
-		crcOn:      crcOn,
-		quicConns:  make(chan *quicConn, cons),
-		quicConf:   &quic.Config{Allow0RTT: true},
+	c := &Client{
+		Framing:   frame.V2,
+		addr:      &net.UDPAddr{IP: net.ParseIP(strings.Split(addr, ":")[0]), Port: port},
+		crcOn:     crcOn,
+		quicConns: make(chan *quicConn, cons),
+		quicConf:  &quic.Config{Allow0RTT: true},
 	}
+	if compressOn {
+		c.Codec = codec.Spec{ID: codec.LZ4}
+	}
+	return c
 }
 
 func NewTLSConfig() (*tls.Config, error) {
@@ -197,14 +170,20 @@ func (c *Client) Close() {
 func (c *Client) Get(req_ common.Request) (*common.Response, error) {
 	var res response
 
-	err := c.withConn(func(conn *quicConn) error {
-		req := request{Request: req_, compressOn: c.compressOn, crcOn: c.crcOn}
+	// Encoded first, so the requests the framing can't hold fail
+	// without taking a connection.
+	req := request{frame.NewHeader(c.Framing, &req_, c.Codec, c.crcOn)}
+	head, err := req.Append(nil)
+	if err != nil {
+		return nil, err
+	}
+	err = c.withConn(func(conn *quicConn) error {
 		// fmt.Println("CMD:", req.CMD, "Key:", req.Key)
-		if err := req.Write(conn.str); err != nil {
+		if _, err := conn.str.Write(head); err != nil {
 			fmt.Println("write error:", err)
 			return err
 		}
-		if err := res.Read(conn.str); err != nil {
+		if err := res.Read(conn.str, c.Framing); err != nil {
 			fmt.Println("read error:", err)
 			return err
 		} else if res.Err != nil {
@@ -1,6 +1,7 @@
 package quic
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"errors"
@@ -11,6 +12,8 @@ import (
 	"sync"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
 	"github.com/codingpoeta/net-model-bench/utils"
 
 	"github.com/quic-go/quic-go"
@@ -21,72 +24,108 @@ import (
 
 var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
+// respHeaderLen is the size of the response header: the compressed and
+// the original size, the checksum, the flags and the codec of the body.
+// The responses to the frame.V1 requests have the v1RespHeaderLen bytes
+// before the flags only, and the error messages no original size.
+const (
+	respHeaderLen   = 14
+	v1RespHeaderLen = 12
+)
+
+// respFlagError marks the responses whose body is an error message.
+const respFlagError = 0x01
+
 type response struct {
 	common.Response
-	Header [13]byte
+	Header [respHeaderLen]byte
 	Err    error
 	tsz    int
+	comp   codec.Codec // compresses the body, nil to send it as is
 }
 
-func (r *response) Write(w io.Writer, comp, crc bool) error {
-	var header [12]byte
+// Write writes the response to a request of the framing version with the
+// body compressed by r.comp, or as is if it doesn't shrink. The checksum
+// is of the original body.
+func (r *response) Write(w io.Writer, v frame.Version, crc bool) error {
+	var hdr [respHeaderLen]byte
+	header := hdr[:]
+	if v == frame.V1 {
+		header = hdr[:v1RespHeaderLen]
+	}
 	var buf = bytebufferpool.Get()
 	defer bytebufferpool.Put(buf)
-	//var buf1 = bytebufferpool.Get()
 	if r.Err != nil {
 		msg := r.Err.Error()
-		binary.BigEndian.PutUint32(header[:4], uint32(len(msg)))
-		binary.BigEndian.PutUint32(header[4:8], 0)
-		binary.BigEndian.PutUint32(header[8:12], 0)
-		_, _ = buf.Write(header[:])
+		if v == frame.V1 {
+			binary.BigEndian.PutUint32(header[:4], uint32(len(msg)))
+		} else {
+			binary.BigEndian.PutUint32(header[4:8], uint32(len(msg)))
+			header[12] = respFlagError
+		}
+		_, _ = buf.Write(header)
 		_, _ = buf.WriteString(msg)
 		_, err := w.Write(buf.Bytes())
 		return err
 	}
-	if comp {
-		sz := utils.LZ4_compressBound(len(r.Body) + 1)
-		_, _ = buf.Write(make([]byte, 12+sz))
-		//copy(buf1.Bytes()[:len(r.Body)], r.Body)
-		//buf1.Bytes()[0] = utils.Letters[rand.Intn(len(utils.Letters))]
-		compsize := utils.LZ4_compress_default(r.Body, buf.Bytes()[12:])
-		binary.BigEndian.PutUint32(header[:4], compsize)
-		binary.BigEndian.PutUint32(header[4:8], uint32(len(r.Body)))
-		//binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(buf1.Bytes()[:len(r.Body)], crcTable))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(r.Body)))
+	if crc {
 		binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(r.Body, crcTable))
-		// fmt.Printf("compressed size: %d -> %d\n", len(r.Body), sz)
-		// fmt.Println("Header:", header[:12])
-		copy(buf.Bytes()[:12], header[:])
-		_, err := w.Write(buf.Bytes()[:12+compsize])
-		// _, err := w.Write([]byte("hello"))
-		return err
-	} else {
-		binary.BigEndian.PutUint32(header[:4], 0)
-		binary.BigEndian.PutUint32(header[4:8], uint32(len(r.Body)))
-		if crc {
-			binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(r.Body, crcTable))
-		} else {
-			binary.BigEndian.PutUint32(header[8:12], 0)
+	}
+	body := r.Body
+	if r.comp != nil {
+		// The bodies the codec fails on are sent as is too, the codec
+		// counts the failures in its report.
+		bb, comp, _ := codec.CompressBody(r.comp, r.Body)
+		if bb != nil {
+			defer bb.Dec()
+			binary.BigEndian.PutUint32(header[:4], uint32(len(comp)))
+			if v != frame.V1 {
+				// The V1 requests ask for LZ4 only.
+				header[13] = byte(r.comp.Spec().ID)
+			}
+			body = comp
 		}
-		_, _ = buf.Write(header[:])
-		_, _ = buf.Write(r.Body)
-		_, err := w.Write(buf.Bytes())
-		return err
 	}
+	// The stream isn't a net.Conn, the header and the body are
+	// written at once.
+	_, _ = buf.Write(header)
+	_, _ = buf.Write(body)
+	_, err := w.Write(buf.Bytes())
+	return err
 }
 
-func (r *response) Read(conn io.Reader) error {
-	if _, err := io.ReadFull(conn, r.Header[:12]); err != nil {
+// Read reads the response to a request of the framing version.
+func (r *response) Read(conn io.Reader, v frame.Version) error {
+	header := r.Header[:]
+	if v == frame.V1 {
+		header = r.Header[:v1RespHeaderLen]
+	}
+	if _, err := io.ReadFull(conn, header); err != nil {
 		return err
 	}
 	compsize := binary.BigEndian.Uint32(r.Header[:4])
 	osize := binary.BigEndian.Uint32(r.Header[4:8])
-	if compsize > 20<<20 {
-		return fmt.Errorf("payload is too big: %d", compsize)
+	if compsize > 20<<20 || osize > 20<<20 {
+		return fmt.Errorf("payload is too big: %d", max(compsize, osize))
+	}
+	id := codec.ID(r.Header[13])
+	failed := r.Header[12]&respFlagError != 0
+	if v == frame.V1 {
+		// The error messages have no original size, the other
+		// compressed bodies are LZ4.
+		failed = osize == 0
+		if failed {
+			osize, compsize = compsize, 0
+		}
+		if compsize != 0 {
+			id = codec.LZ4
+		}
 	}
 
-	r.tsz = int(compsize)
-	if r.tsz == 0 {
-		r.tsz = int(osize)
+	r.tsz = int(osize)
+	if id != codec.None {
+		r.tsz = int(compsize)
 	}
 	// fmt.Println("size:", size)
 	payload := make([]byte, r.tsz)
@@ -109,15 +148,19 @@ func (r *response) Read(conn io.Reader) error {
 	if cnt > 0 {
 		//fmt.Println("read count:", cnt)
 	}
-	if osize == 0 {
+	if failed {
 		r.Err = errors.New(string(payload))
 		return nil
 	}
-	if compsize == 0 {
+	if id == codec.None {
 		r.Body = payload
 	} else {
+		c, err := codec.Spec{ID: id}.Codec()
+		if err != nil {
+			return err
+		}
 		r.Body = make([]byte, osize)
-		n, err := utils.LZ4_decompress_fast(payload, r.Body)
+		n, err := c.Decompress(r.Body, payload)
 		if err != nil {
 			return err
 		}
@@ -125,7 +168,7 @@ func (r *response) Read(conn io.Reader) error {
 			return fmt.Errorf("unexpected size: %d != %d", n, osize)
 		}
 	}
-	r.CRCSum = binary.BigEndian.Uint32(r.Header[8:])
+	r.CRCSum = binary.BigEndian.Uint32(r.Header[8:12])
 	if r.CRCSum != 0 {
 		if s := crc32.Checksum(r.Body, crcTable); s != r.CRCSum {
 			return fmt.Errorf("checksum %d != %d", s, r.CRCSum)
@@ -150,6 +193,9 @@ func (s *Server) Close() {
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
+	if utils.IsUnixAddr(ip) {
+		return nil, fmt.Errorf("quic runs over UDP, unix address %s is not supported", ip)
+	}
 	ip, err := utils.FindLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
@@ -224,15 +270,19 @@ func (s *Server) handle(conn quic.EarlyConnection) {
 	}
 	defer str.Close()
 
+	br := bufio.NewReader(str)
 	for {
 		var req request
 
-		if err := req.Read(str); err != nil {
+		if err := req.Read(br); err != nil {
 			fmt.Println(err)
 			return
 		}
 		// fmt.Println("CMD:", req.CMD, "Key:", req.Key)
 		var res response
+		if req.Op != common.OpGet {
+			res.Err = fmt.Errorf("unsupported op %s", req.Op)
+		}
 		switch req.CMD {
 		case 0:
 			res.Body = s.dataGen.Get("key0")
@@ -247,7 +297,13 @@ func (s *Server) handle(conn quic.EarlyConnection) {
 		default:
 			res.Err = errors.New("invalid command")
 		}
-		if err := res.Write(str, req.compressOn, req.crcOn); err != nil {
+		if res.Err == nil {
+			res.Body, res.Err = req.Range(res.Body)
+		}
+		if res.Err == nil && req.Codec.ID != codec.None {
+			res.comp, res.Err = req.Codec.Codec()
+		}
+		if err := res.Write(str, req.Version, req.CRC); err != nil {
 			fmt.Println(err)
 			return
 		}
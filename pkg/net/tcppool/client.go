@@ -1,149 +1,281 @@
 package tcppool
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/codingpoeta/net-model-bench/utils"
 )
 
+// request is the frame header followed by the request ID, the responses
+// of a connection may come in any order. The frame.V1 requests have no
+// ID, they are answered in order.
 type request struct {
-	common.Request
-	compressOn bool
-	crcOn      bool
-	Buf        [256]byte
+	frame.Header
+	ID uint64
 }
 
-func (r *request) Write(w io.Writer) error {
-	buf := r.Buf[:]
-	buf[0] = r.CMD & 0xF
-	buf[1] = byte(len(r.Key))
-	buf[2] = 0
-	if r.compressOn {
-		buf[2] |= 0x01
+func (r *request) Append(b []byte) ([]byte, error) {
+	b, err := r.Header.Append(b)
+	if err != nil || r.Version == frame.V1 {
+		return b, err
 	}
-	if r.crcOn {
-		buf[2] |= 0x02
+	return binary.BigEndian.AppendUint64(b, r.ID), nil
+}
+
+func (r *request) Read(br *bufio.Reader) error {
+	if err := frame.Read(br, &r.Header); err != nil {
+		return err
 	}
-	if len(r.Key) > 255 {
-		buf[0] += byte(len(r.Key)>>8) << 4
+	r.ID = 0
+	if r.Version == frame.V1 {
+		return nil
 	}
-	copy(buf[3:], r.Key)
-	if _, err := w.Write(buf[:len(r.Key)+3]); err != nil {
+	var id [8]byte
+	if _, err := io.ReadFull(br, id[:]); err != nil {
 		return err
 	}
+	r.ID = binary.BigEndian.Uint64(id[:])
 	return nil
 }
 
-func (r *request) Read(conn net.Conn) error {
-	if _, err := io.ReadFull(conn, r.Buf[:3]); err != nil {
-		return err
+// ErrClosed is returned by the Gets of a closed Client.
+var ErrClosed = errors.New("tcppool: client closed")
+
+// call is a request waiting for its response.
+type call struct {
+	res  *response
+	err  error
+	done chan struct{}
+}
+
+// clientConn multiplexes the requests of many Gets over a connection.
+// A connection failing mid-exchange fails all its calls and is
+// discarded, the next Get dials a new one.
+type clientConn struct {
+	conn    net.Conn
+	framing frame.Version
+
+	wmu    sync.Mutex // serializes the request writes
+	nextID uint64     // of the next request written
+
+	// recvID is the ID of the next frame.V1 response, the requests
+	// without IDs are answered in the order written.
+	recvID uint64
+
+	mu      sync.Mutex
+	pending map[uint64]*call
+	err     error // why the connection is broken
+}
+
+func newClientConn(conn net.Conn, framing frame.Version) *clientConn {
+	cc := &clientConn{
+		conn:    conn,
+		framing: framing,
+		pending: make(map[uint64]*call),
 	}
-	r.CMD = r.Buf[0] & 0x0F
-	size := int(r.Buf[1]) + int(r.Buf[0]>>4)<<8
-	if r.Buf[2]&0x01 != 0 {
-		r.compressOn = true
+	go cc.recvWorker()
+	return cc
+}
+
+func (cc *clientConn) broken() bool {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.err != nil
+}
+
+// fail closes the connection and fails the calls in flight.
+func (cc *clientConn) fail(err error) {
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return
 	}
-	if r.Buf[2]&0x02 != 0 {
-		r.crcOn = true
+	cc.err = err
+	pending := cc.pending
+	cc.pending = nil
+	cc.mu.Unlock()
+	cc.conn.Close()
+	for _, cl := range pending {
+		cl.err = err
+		close(cl.done)
 	}
+}
 
-	buf := r.Buf[:size]
-	if _, err := io.ReadFull(conn, buf); err != nil {
-		return err
+func (cc *clientConn) recvWorker() {
+	for {
+		res := &response{}
+		if err := res.Read(cc.conn, cc.framing); err != nil {
+			cc.fail(err)
+			return
+		}
+		if cc.framing == frame.V1 {
+			res.ID = cc.recvID
+			cc.recvID++
+		}
+		cc.mu.Lock()
+		cl, ok := cc.pending[res.ID]
+		delete(cc.pending, res.ID)
+		cc.mu.Unlock()
+		if !ok {
+			res.Release()
+			cc.fail(fmt.Errorf("unexpected response %d", res.ID))
+			return
+		}
+		cl.res = res
+		close(cl.done)
 	}
-	r.Key = string(buf)
-	return nil
+}
+
+// send numbers the requests, registers their calls and writes them at
+// once. The IDs follow the order of the writes.
+func (cc *clientConn) send(reqs []request) ([]*call, error) {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	var buf []byte
+	for i := range reqs {
+		var err error
+		reqs[i].ID = cc.nextID + uint64(i)
+		if buf, err = reqs[i].Append(buf); err != nil {
+			return nil, err
+		}
+	}
+	calls := make([]*call, len(reqs))
+	cc.mu.Lock()
+	if cc.err != nil {
+		cc.mu.Unlock()
+		return nil, cc.err
+	}
+	for i := range reqs {
+		calls[i] = &call{done: make(chan struct{})}
+		cc.pending[reqs[i].ID] = calls[i]
+	}
+	cc.mu.Unlock()
+	cc.nextID += uint64(len(reqs))
+
+	if _, err := cc.conn.Write(buf); err != nil {
+		cc.fail(err)
+	}
+	return calls, nil
 }
 
 type Client struct {
 	sync.Mutex
-	addr       string
-	compressOn bool
-	crcOn      bool
-	conns      chan net.Conn
+	addr   string
+	crcOn  bool
+	conns  []*clientConn // dialed on demand
+	closed bool
+	next   atomic.Uint32
+
+	// Framing is the request header format, frame.V2 by default.
+	// frame.V1 speaks the wire format of the servers before the
+	// request IDs, one request at a time per connection on their side.
+	// Set it before the first Get.
+	Framing frame.Version
+
+	// Codec compresses the response bodies, LZ4 if compressOn.
+	// The codecs other than LZ4 need frame.V2.
+	Codec codec.Spec
 }
 
 func NewClient(addr string, cons int, compressOn, crcOn bool) common.BlockClient {
-	return &Client{
-		addr:       addr,
-		compressOn: compressOn,
-		crcOn:      crcOn,
-		conns:      make(chan net.Conn, cons),
+	c := &Client{
+		Framing: frame.V2,
+		addr:    addr,
+		crcOn:   crcOn,
+		conns:   make([]*clientConn, max(cons, 1)),
 	}
-}
-
-func (c *Client) getConn() (net.Conn, error) {
-	var conn net.Conn
-	select {
-	case conn = <-c.conns:
-	default:
-		// one connect at a time
-		c.Lock()
-		defer c.Unlock()
-		dialer := &net.Dialer{Timeout: time.Second + time.Millisecond*100, KeepAlive: time.Minute}
-		c, err := dialer.Dial("tcp", c.addr)
-		// bfsz := 10 << 20
-		// c.(*net.TCPConn).SetWriteBuffer(bfsz)
-		// c.(*net.TCPConn).SetReadBuffer(bfsz)
-		if err != nil {
-			return nil, err
-		}
-		conn = c
+	if compressOn {
+		c.Codec = codec.Spec{ID: codec.LZ4}
 	}
-	return conn, nil
+	return c
 }
 
-func (c *Client) withConn(f func(conn net.Conn) error) error {
-	conn, err := c.getConn()
-	if err != nil {
-		return err
+// getConn returns the next connection, dialing it if it's broken.
+func (c *Client) getConn() (*clientConn, error) {
+	i := int(c.next.Add(1)) % len(c.conns)
+	// one connect at a time
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return nil, ErrClosed
 	}
-	err = f(conn)
-	if err != nil {
-		return err
+	if cc := c.conns[i]; cc != nil && !cc.broken() {
+		return cc, nil
 	}
-	select {
-	case c.conns <- conn:
-	default:
-		_ = conn.Close()
+	dialer := &net.Dialer{Timeout: time.Second + time.Millisecond*100, KeepAlive: time.Minute}
+	conn, err := utils.Dial(dialer, c.addr)
+	// bfsz := 10 << 20
+	// c.(*net.TCPConn).SetWriteBuffer(bfsz)
+	// c.(*net.TCPConn).SetReadBuffer(bfsz)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	c.conns[i] = newClientConn(conn, c.Framing)
+	return c.conns[i], nil
 }
 
 func (c *Client) Close() {
-	close(c.conns)
+	c.Lock()
+	defer c.Unlock()
+	c.closed = true
+	for _, cc := range c.conns {
+		if cc != nil {
+			cc.fail(ErrClosed)
+		}
+	}
 }
 
+// Get pipelines req_.Batch copies of the request on a connection and
+// returns the last response, or the first error.
 func (c *Client) Get(req_ common.Request) (*common.Response, error) {
-	var res = &response{}
-
-	err := c.withConn(func(conn net.Conn) error {
-		req := request{Request: req_, compressOn: c.compressOn, crcOn: c.crcOn}
-		// fmt.Println("CMD:", req.CMD, "Key:", req.Key)
-		for i := 0; i < req_.Batch; i++ {
-			if err := req.Write(conn); err != nil {
-				fmt.Println("write error:", err)
-				return err
-			}
+	cc, err := c.getConn()
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]request, max(req_.Batch, 1))
+	for i := range reqs {
+		reqs[i] = request{Header: frame.NewHeader(c.Framing, &req_, c.Codec, c.crcOn)}
+	}
+	// fmt.Println("CMD:", req.CMD, "Key:", req.Key)
+	calls, err := cc.send(reqs)
+	if err != nil {
+		return nil, err
+	}
+	var res *response
+	for _, cl := range calls {
+		<-cl.done
+		if cl.err == nil && cl.res.Err != nil {
+			cl.err = cl.res.Err
 		}
-		for i := 0; i < req_.Batch; i++ {
-			if err := res.Read(conn); err != nil {
-				fmt.Println("read error:", err)
-				return err
-			} else if res.Err != nil {
-				fmt.Println("response error:", res.Err)
-				return res.Err
-			}
+		if err == nil {
+			err = cl.err
 		}
-		return nil
-	})
+		if res != nil {
+			res.Release()
+		}
+		res = cl.res
+	}
+	if err != nil {
+		if res != nil {
+			res.Release()
+		}
+		return nil, err
+	}
 	return &common.Response{
-		Body: res.Body,
-		Size: uint32(len(res.Body)),
-		BB:   res.BB,
-	}, err
+		Body:   res.Body,
+		Size:   uint32(len(res.Body)),
+		CRCSum: res.CRCSum,
+		BB:     res.BB,
+	}, nil
 }
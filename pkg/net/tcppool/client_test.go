@@ -0,0 +1,152 @@
+package tcppool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer hands the test the connections of the clients, so the test
+// answers them in any order or breaks them.
+func fakeServer(t *testing.T) (string, <-chan net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			conns <- conn
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+func accept(t *testing.T, conns <-chan net.Conn) net.Conn {
+	select {
+	case conn := <-conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("the client hasn't connected")
+		return nil
+	}
+}
+
+// answer writes the key of the request as the response body.
+func answer(t *testing.T, conn net.Conn, req *request) {
+	res := &response{ID: req.ID}
+	res.Body = []byte(req.Key)
+	bufs, done := res.Encode(req.CRC)
+	defer done()
+	if _, err := bufs.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(c common.BlockClient, key string) <-chan error {
+	errc := make(chan error, 1)
+	go func() {
+		res, err := c.Get(common.Request{CMD: 1, Key: key})
+		if err == nil {
+			if string(res.Body) != key {
+				err = assert.AnError
+			}
+			res.Release()
+		}
+		errc <- err
+	}()
+	return errc
+}
+
+func TestOutOfOrderResponses(t *testing.T) {
+	a := assert.New(t)
+
+	addr, conns := fakeServer(t)
+	c := NewClient(addr, 1, false, true)
+	defer c.Close()
+
+	first := get(c, "first")
+	conn := accept(t, conns)
+	br := bufio.NewReader(conn)
+	var reqs [2]request
+	a.Nil(reqs[0].Read(br))
+	second := get(c, "second")
+	a.Nil(reqs[1].Read(br))
+
+	// The responses are matched to the calls by ID.
+	answer(t, conn, &reqs[1])
+	a.Nil(<-second)
+	answer(t, conn, &reqs[0])
+	a.Nil(<-first)
+}
+
+func TestBrokenConn(t *testing.T) {
+	a := assert.New(t)
+
+	addr, conns := fakeServer(t)
+	c := NewClient(addr, 1, false, true)
+	defer c.Close()
+
+	// A dropped connection fails the calls in flight.
+	errc := get(c, "key")
+	conn := accept(t, conns)
+	var req request
+	a.Nil(req.Read(bufio.NewReader(conn)))
+	conn.Close()
+	a.NotNil(<-errc)
+
+	// The next Get dials a new connection.
+	errc = get(c, "key")
+	conn = accept(t, conns)
+	a.Nil(req.Read(bufio.NewReader(conn)))
+	answer(t, conn, &req)
+	a.Nil(<-errc)
+}
+
+func TestV1Framing(t *testing.T) {
+	a := assert.New(t)
+
+	addr, conns := fakeServer(t)
+	c := NewClient(addr, 1, false, true)
+	c.(*Client).Framing = frame.V1
+	defer c.Close()
+
+	// The requests are the frame header alone.
+	first := get(c, "first")
+	conn := accept(t, conns)
+	b := make([]byte, 8)
+	_, err := io.ReadFull(conn, b)
+	a.NoError(err)
+	a.Equal(append([]byte{1, 5, frame.FlagCRC}, "first"...), b)
+	second := get(c, "second")
+	b = make([]byte, 9)
+	_, err = io.ReadFull(conn, b)
+	a.NoError(err)
+	a.Equal(append([]byte{1, 6, frame.FlagCRC}, "second"...), b)
+
+	// The responses have the 12 bytes header and come in order, the
+	// error messages have no original size.
+	head := make([]byte, v1RespHeaderLen)
+	binary.BigEndian.PutUint32(head[4:8], 5)
+	_, err = conn.Write(append(head, "first"...))
+	a.NoError(err)
+	a.Nil(<-first)
+	binary.BigEndian.PutUint32(head[0:4], 7)
+	binary.BigEndian.PutUint32(head[4:8], 0)
+	_, err = conn.Write(append(head, "invalid"...))
+	a.NoError(err)
+	a.EqualError(<-second, "invalid")
+}
@@ -1,6 +1,7 @@
 package tcppool
 
 import (
+	"bufio"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -8,93 +9,142 @@ import (
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"sync"
+	"syscall"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/codec"
+	"github.com/codingpoeta/net-model-bench/pkg/frame"
+	"github.com/codingpoeta/net-model-bench/pkg/zerocopy"
 	"github.com/codingpoeta/net-model-bench/utils"
-
-	"github.com/valyala/bytebufferpool"
 )
 
 var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
+const payloadBufSize = 5120 * 1024
+
 var payloadBufPool = &sync.Pool{
 	New: func() any {
 		return &common.BodyBuffer{
-			Buf: make([]byte, 5120*1024),
+			Buf: make([]byte, payloadBufSize),
 		}
 	},
 }
 
+// respHeaderLen is the size of the response header: the request ID,
+// the compressed and the original size, the checksum, the flags and the
+// codec of the body. The responses to the frame.V1 requests have the
+// v1RespHeaderLen bytes between the ID and the flags only, and the
+// error messages no original size.
+const (
+	respHeaderLen   = 22
+	v1RespHeaderLen = 12
+)
+
+// respFlagError marks the responses whose body is an error message.
+const respFlagError = 0x01
+
 type response struct {
 	common.Response
-	Header [13]byte
-	Err    error
-	tsz    int
+	ID      uint64
+	Version frame.Version // of the request
+	Header  [respHeaderLen]byte
+	Err     error
+	tsz     int
+	comp    codec.Codec // compresses the body, nil to send it as is
 }
 
-func (r *response) Write(w io.Writer, comp, crc bool) error {
-	var header [12]byte
-	var buf = bytebufferpool.Get()
-	defer bytebufferpool.Put(buf)
-	//var buf1 = bytebufferpool.Get()
+// Encode returns the header and the body of the response, the body
+// compressed by r.comp, or as is if it doesn't shrink. The checksum is of
+// the original body. done drops the compressed body once it's written.
+func (r *response) Encode(crc bool) (bufs net.Buffers, done func()) {
+	done = func() {}
+	// The header may be sent with MSG_ZEROCOPY, so it's not on the stack.
+	header := make([]byte, respHeaderLen)
+	binary.BigEndian.PutUint64(header[:8], r.ID)
 	if r.Err != nil {
 		msg := r.Err.Error()
-		binary.BigEndian.PutUint32(header[:4], uint32(len(msg)))
-		binary.BigEndian.PutUint32(header[4:8], 0)
-		binary.BigEndian.PutUint32(header[8:12], 0)
-		_, _ = buf.Write(header[:])
-		_, _ = buf.WriteString(msg)
-		_, err := w.Write(buf.Bytes())
-		return err
+		if r.Version == frame.V1 {
+			binary.BigEndian.PutUint32(header[8:12], uint32(len(msg)))
+			return net.Buffers{header[8:20], []byte(msg)}, done
+		}
+		binary.BigEndian.PutUint32(header[12:16], uint32(len(msg)))
+		header[20] = respFlagError
+		return net.Buffers{header, []byte(msg)}, done
 	}
-	if comp {
-		sz := utils.LZ4_compressBound(len(r.Body) + 1)
-		_, _ = buf.Write(make([]byte, 12+sz))
-		//copy(buf1.Bytes()[:len(r.Body)], r.Body)
-		//buf1.Bytes()[0] = utils.Letters[rand.Intn(len(utils.Letters))]
-		compsize := utils.LZ4_compress_default(r.Body, buf.Bytes()[12:])
-		binary.BigEndian.PutUint32(header[:4], compsize)
-		binary.BigEndian.PutUint32(header[4:8], uint32(len(r.Body)))
-		//binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(buf1.Bytes()[:len(r.Body)], crcTable))
-		binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(r.Body, crcTable))
-		// fmt.Printf("compressed size: %d -> %d\n", len(r.Body), sz)
-		// fmt.Println("Header:", header[:12])
-		copy(buf.Bytes()[:12], header[:])
-		_, err := w.Write(buf.Bytes()[:12+compsize])
-		// _, err := w.Write([]byte("hello"))
-		return err
-	} else {
-		binary.BigEndian.PutUint32(header[:4], 0)
-		binary.BigEndian.PutUint32(header[4:8], uint32(len(r.Body)))
-		if crc {
-			binary.BigEndian.PutUint32(header[8:12], crc32.Checksum(r.Body, crcTable))
-		} else {
-			binary.BigEndian.PutUint32(header[8:12], 0)
-		}
-		//_, _ = buf.Write(header[:])
-		//_, _ = buf.Write(r.Body)
-		//_, err := w.Write(buf.Bytes())
-		var bufs net.Buffers
-		bufs = append(bufs, header[:])
-		bufs = append(bufs, r.Body)
-		_, err := bufs.WriteTo(w)
-		return err
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(r.Body)))
+	if crc {
+		binary.BigEndian.PutUint32(header[16:20], crc32.Checksum(r.Body, crcTable))
 	}
+	body := r.Body
+	if r.comp != nil {
+		// The bodies the codec fails on are sent as is too, the codec
+		// counts the failures in its report.
+		bb, comp, _ := codec.CompressBody(r.comp, r.Body)
+		if bb != nil {
+			done = bb.Dec
+			binary.BigEndian.PutUint32(header[8:12], uint32(len(comp)))
+			header[21] = byte(r.comp.Spec().ID)
+			body = comp
+		}
+	}
+	if r.Version == frame.V1 {
+		// No ID, and no codec since the V1 requests ask for LZ4 only.
+		header = header[8:20]
+	}
+	return net.Buffers{header, body}, done
 }
 
-func (r *response) Read(conn net.Conn) error {
-	if _, err := io.ReadFull(conn, r.Header[:12]); err != nil {
+// WriteZeroCopy writes the encoded uncompressed response, sending it with
+// MSG_ZEROCOPY. The reference of BB, if any, is held until the kernel
+// completes the send.
+func (r *response) WriteZeroCopy(zc *zerocopy.Conn, bufs net.Buffers) error {
+	if r.Err != nil {
+		return errors.New("zero-copy error responses aren't supported")
+	}
+	var release func()
+	if r.BB != nil {
+		r.BB.Inc()
+		release = r.BB.Dec
+	}
+	return zc.Writev(bufs, release)
+}
+
+// Read reads the next response of the connection to a request of the
+// framing version, the V1 responses have no ID. The errors returned
+// leave the connection out of sync, the server errors and the corrupted
+// bodies are set to r.Err.
+func (r *response) Read(conn net.Conn, v frame.Version) error {
+	header := r.Header[:]
+	if v == frame.V1 {
+		header = r.Header[8:20]
+	}
+	if _, err := io.ReadFull(conn, header); err != nil {
 		return err
 	}
-	compsize := binary.BigEndian.Uint32(r.Header[:4])
-	osize := binary.BigEndian.Uint32(r.Header[4:8])
-	if compsize > 20<<20 {
-		return fmt.Errorf("payload is too big: %d", compsize)
+	r.ID = binary.BigEndian.Uint64(r.Header[:8])
+	compsize := binary.BigEndian.Uint32(r.Header[8:12])
+	osize := binary.BigEndian.Uint32(r.Header[12:16])
+	if compsize > payloadBufSize || osize > payloadBufSize {
+		return fmt.Errorf("payload is too big: %d", max(compsize, osize))
+	}
+	id := codec.ID(r.Header[21])
+	failed := r.Header[20]&respFlagError != 0
+	if v == frame.V1 {
+		// The error messages have no original size, the other
+		// compressed bodies are LZ4.
+		failed = osize == 0
+		if failed {
+			osize, compsize = compsize, 0
+		}
+		if compsize != 0 {
+			id = codec.LZ4
+		}
 	}
 
 	r.tsz = int(compsize)
-	if r.tsz == 0 {
+	if id == codec.None {
 		r.tsz = int(osize)
 	}
 	// fmt.Println("size:", size)
@@ -123,11 +173,12 @@ func (r *response) Read(conn net.Conn) error {
 	if cnt > 0 {
 		//fmt.Println("read count:", cnt)
 	}
-	if osize == 0 {
+	if failed {
 		r.Err = errors.New(string(payload))
+		payloadBufPool.Put(payloadBuf)
 		return nil
 	}
-	if compsize == 0 {
+	if id == codec.None {
 		r.Body = payload
 		r.BB = payloadBuf
 		r.BB.Inc()
@@ -135,20 +186,28 @@ func (r *response) Read(conn net.Conn) error {
 		tmp := payloadBufPool.Get().(*common.BodyBuffer)
 		tmp.Release = func() { payloadBufPool.Put(tmp) }
 		r.Body = tmp.Buf[:osize]
-		n, err := utils.LZ4_decompress_fast(payload, r.Body)
+		c, err := codec.Spec{ID: id}.Codec()
+		var n int
+		if err == nil {
+			n, err = c.Decompress(r.Body, payload)
+		}
+		payloadBufPool.Put(payloadBuf)
 		r.BB = tmp
 		r.BB.Inc()
-		if err != nil {
-			return err
+		if err == nil && n != int(osize) {
+			err = fmt.Errorf("unexpected size: %d != %d", n, osize)
 		}
-		if n != int(osize) {
-			return fmt.Errorf("unexpected size: %d != %d", n, osize)
+		if err != nil {
+			r.Release()
+			r.Err = err
+			return nil
 		}
 	}
-	r.CRCSum = binary.BigEndian.Uint32(r.Header[8:])
+	r.CRCSum = binary.BigEndian.Uint32(r.Header[16:20])
 	if r.CRCSum != 0 {
 		if s := crc32.Checksum(r.Body, crcTable); s != r.CRCSum {
-			return fmt.Errorf("checksum %d != %d", s, r.CRCSum)
+			r.Release()
+			r.Err = fmt.Errorf("checksum %d != %d", s, r.CRCSum)
 		}
 	}
 	// fmt.Println("decompressed size:", n)
@@ -162,10 +221,12 @@ type Server struct {
 	ip       string
 	port     int
 	dataGen  common.DataGen
+
+	zeroCopyMinSize int
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
-	ip, err := utils.FindLocalIP(ip, iname)
+	ip, err := utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
@@ -182,26 +243,31 @@ func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error)
 		svr.mode = common.MODE_SENDBUF
 	case "splice":
 		svr.mode = common.MODE_SPLICE
+	case "zerocopy":
+		svr.mode = common.MODE_ZEROCOPY
 	default:
 		svr.mode = common.MODE_SENDFILE
 	}
+	// Smaller responses are copied even in the zerocopy mode.
+	if minSize := os.Getenv("ZEROCOPY_MIN_SIZE"); minSize != "" {
+		if svr.zeroCopyMinSize, err = strconv.Atoi(minSize); err != nil {
+			return nil, fmt.Errorf("invalid ZEROCOPY_MIN_SIZE: %w", err)
+		}
+	}
 
 	return svr, nil
 }
 
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.ip, s.port)
+	return utils.JoinHostPort(s.ip, s.port)
 }
 
 func (s *Server) Serve() (err error) {
-	for {
-		s.listener, err = net.Listen("tcp", s.Addr())
-		if err == nil {
-			break
-		}
-		s.port++
+	if s.listener, err = utils.ListenPort(s.ip, &s.port); err != nil {
+		return err
 	}
 	fmt.Println("listening on", s.Addr())
+	fmt.Println("zero-copy:", utils.ProbeZeroCopy(s.Addr()))
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -218,34 +284,98 @@ func (s *Server) handle(conn net.Conn) {
 	// conn.(*net.TCPConn).SetWriteBuffer(bfsz)
 	// conn.(*net.TCPConn).SetReadBuffer(bfsz)
 	defer conn.Close()
-	for {
-		var req request
-		if err := req.Read(conn); err != nil {
+	var zc *zerocopy.Conn
+	if s.mode == common.MODE_ZEROCOPY {
+		var err error
+		if zc, err = zerocopy.New(conn.(syscall.Conn), s.zeroCopyMinSize); err != nil {
 			fmt.Println(err)
-			return
+		} else {
+			// Keep the sends in flight until they complete, past closing
+			// the connection.
+			defer zc.Close()
+		}
+	}
+	// The requests are served concurrently, the responses are written
+	// as they are ready, so they may be out of order. The frame.V1
+	// requests have no ID, they are served one at a time.
+	var wmu sync.Mutex
+	var wg sync.WaitGroup
+	inflight := make(chan struct{}, maxInflight)
+	defer wg.Wait()
+	reply := func(req *request) {
+		res := s.process(req)
+		// The checksum and the compression are done before taking
+		// wmu, so the responses wait for each other's writes only.
+		bufs, done := res.Encode(req.CRC)
+		defer done()
+		wmu.Lock()
+		defer wmu.Unlock()
+		var err error
+		if zc != nil && res.Err == nil && res.comp == nil {
+			err = res.WriteZeroCopy(zc, bufs)
+		} else {
+			_, err = bufs.WriteTo(conn)
 		}
-		// fmt.Println("CMD:", req.CMD, "Key:", req.Key)
-		var res response
-		switch req.CMD {
-		case 0:
-			res.Body = s.dataGen.Get("key0")
-		case 1:
-			res.Body = s.dataGen.Get("key1")
-		case 2:
-			res.Body = s.dataGen.Get("key2")
-		case 3:
-			res.Body = s.dataGen.Get("key3")
-		case 4:
-			res.Body = s.dataGen.Get("key4")
-		default:
-			res.Err = errors.New("invalid command")
-		}
-		err := res.Write(conn, req.compressOn, req.crcOn)
 		if err != nil {
+			fmt.Println(err)
+			// Fails the reads too, the connection is dropped.
+			conn.Close()
+		}
+	}
+	br := bufio.NewReader(conn)
+	for {
+		req := &request{}
+		if err := req.Read(br); err != nil {
 			fmt.Println(err)
 			return
 		}
+		if req.Version == frame.V1 {
+			reply(req)
+			continue
+		}
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+			reply(req)
+		}()
+	}
+}
+
+// maxInflight bounds the requests of a connection served at once.
+const maxInflight = 128
+
+func (s *Server) process(req *request) *response {
+	// fmt.Println("CMD:", req.CMD, "Key:", req.Key)
+	res := &response{ID: req.ID, Version: req.Version}
+	if req.Op != common.OpGet {
+		res.Err = fmt.Errorf("unsupported op %s", req.Op)
+		return res
+	}
+	switch req.CMD {
+	case 0:
+		res.Body = s.dataGen.Get("key0")
+	case 1:
+		res.Body = s.dataGen.Get("key1")
+	case 2:
+		res.Body = s.dataGen.Get("key2")
+	case 3:
+		res.Body = s.dataGen.Get("key3")
+	case 4:
+		res.Body = s.dataGen.Get("key4")
+	default:
+		res.Err = errors.New("invalid command")
+	}
+	if res.Err == nil {
+		res.Body, res.Err = req.Range(res.Body)
+	}
+	if res.Err == nil && req.Codec.ID != codec.None {
+		res.comp, res.Err = req.Codec.Codec()
 	}
+	return res
 }
 
 func (s *Server) Close() {
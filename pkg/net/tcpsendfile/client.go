@@ -9,6 +9,7 @@ import (
 
 	"github.com/codingpoeta/net-model-bench/common"
 	"github.com/codingpoeta/net-model-bench/pkg/iorpc"
+	"github.com/codingpoeta/net-model-bench/utils"
 )
 
 type request struct {
@@ -18,7 +19,7 @@ type request struct {
 
 func (r *request) Write(w io.Writer) error {
 	buf := r.Buf[:]
-	buf[0] = r.CMD & 0xF
+	buf[0] = byte(r.CMD & 0xF)
 	buf[1] = byte(len(r.Key))
 	if len(r.Key) > 255 {
 		buf[0] += byte(len(r.Key)>>8) << 4
@@ -34,7 +35,7 @@ func (r *request) Read(conn net.Conn) error {
 	if _, err := io.ReadFull(conn, r.Buf[:2]); err != nil {
 		return err
 	}
-	r.CMD = r.Buf[0] & 0x0F
+	r.CMD = uint32(r.Buf[0] & 0x0F)
 	size := int(r.Buf[1]) + int(r.Buf[0]>>4)<<8
 	buf := r.Buf[:size]
 	if _, err := io.ReadFull(conn, buf); err != nil {
@@ -60,7 +61,7 @@ func (c *Client) getConn() (net.Conn, error) {
 		c.Lock()
 		defer c.Unlock()
 		dialer := &net.Dialer{Timeout: time.Second + time.Millisecond*100, KeepAlive: time.Minute}
-		c, err := dialer.Dial("tcp", c.addr)
+		c, err := utils.Dial(dialer, c.addr)
 		if err != nil {
 			return nil, err
 		}
@@ -2,12 +2,16 @@ package tcpsendfile
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"sync"
+	"syscall"
 
 	"github.com/codingpoeta/net-model-bench/common"
+	"github.com/codingpoeta/net-model-bench/pkg/zerocopy"
 	"github.com/codingpoeta/net-model-bench/utils"
 )
 
@@ -18,21 +22,20 @@ type Server struct {
 	ip       string
 	port     int
 	dataGen  common.DataGen
+
+	zeroCopyMinSize int
 }
 
 func (s *Server) Addr() string {
-	return fmt.Sprintf("%s:%d", s.ip, s.port)
+	return utils.JoinHostPort(s.ip, s.port)
 }
 
 func (s *Server) Serve() (err error) {
-	for {
-		s.listener, err = net.Listen("tcp", s.Addr())
-		if err == nil {
-			break
-		}
-		s.port++
+	if s.listener, err = utils.ListenPort(s.ip, &s.port); err != nil {
+		return err
 	}
 	fmt.Println("listening on", s.Addr())
+	fmt.Println("zero-copy:", utils.ProbeZeroCopy(s.Addr()))
 	for {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -45,11 +48,21 @@ func (s *Server) Serve() (err error) {
 }
 
 func (s *Server) handle(conn net.Conn) {
-	tcpConn := conn.(*net.TCPConn)
-	defer tcpConn.Close()
+	defer conn.Close()
+	var zc *zerocopy.Conn
+	if s.mode == common.MODE_ZEROCOPY {
+		var err error
+		if zc, err = zerocopy.New(conn.(syscall.Conn), s.zeroCopyMinSize); err != nil {
+			log.Println(err)
+		} else {
+			// Keep the sends in flight until they complete, past closing
+			// the connection.
+			defer zc.Close()
+		}
+	}
 	for {
 		var req request
-		if err := req.Read(tcpConn); err != nil {
+		if err := req.Read(conn); err != nil {
 			log.Println(err)
 			break
 		}
@@ -58,14 +71,22 @@ func (s *Server) handle(conn net.Conn) {
 		switch s.mode {
 		case common.MODE_SENDBUF:
 			buf := s.dataGen.Get(key)
-			_, err = tcpConn.Write(buf)
+			_, err = conn.Write(buf)
+		case common.MODE_ZEROCOPY:
+			buf := s.dataGen.Get(key)
+			if zc != nil {
+				err = zc.Writev([][]byte{buf}, nil)
+			} else {
+				_, err = conn.Write(buf)
+			}
 		case common.MODE_SPLICE:
 			reader := s.dataGen.GetReadCloser(key)
-			err = utils.SpliceSendFile(tcpConn, reader.(*os.File), s.dataGen.GetSize(fmt.Sprintf("key%d", req.CMD)))
+			err = utils.SpliceSendFile(conn, reader.(*os.File), s.dataGen.GetSize(fmt.Sprintf("key%d", req.CMD)))
 			reader.Close()
 		default:
+			// io.Copy sends files to both TCP and unix sockets with sendfile.
 			reader := s.dataGen.GetReadCloser(key)
-			_, err = tcpConn.ReadFrom(s.dataGen.GetReadCloser(key))
+			_, err = io.Copy(conn, reader)
 			reader.Close()
 		}
 		if err != nil {
@@ -79,7 +100,7 @@ func (s *Server) Close() {
 }
 
 func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error) {
-	ip, err := utils.FindLocalIP(ip, iname)
+	ip, err := utils.ResolveLocalIP(ip, iname)
 	if err != nil {
 		return nil, err
 	}
@@ -96,9 +117,17 @@ func NewServer(ip, iname string, dg common.DataGen) (common.BlockServer, error)
 		svr.mode = common.MODE_SENDBUF
 	case "splice":
 		svr.mode = common.MODE_SPLICE
+	case "zerocopy":
+		svr.mode = common.MODE_ZEROCOPY
 	default:
 		svr.mode = common.MODE_SENDFILE
 	}
+	// Smaller responses are copied even in the zerocopy mode.
+	if minSize := os.Getenv("ZEROCOPY_MIN_SIZE"); minSize != "" {
+		if svr.zeroCopyMinSize, err = strconv.Atoi(minSize); err != nil {
+			return nil, fmt.Errorf("invalid ZEROCOPY_MIN_SIZE: %w", err)
+		}
+	}
 
 	return svr, nil
 }
@@ -0,0 +1,46 @@
+// Package zerocopy sends memory buffers to TCP connections with MSG_ZEROCOPY.
+//
+// The kernel references the pages of a zero-copy send until the peer
+// acknowledges them, and reports that on the socket error queue. Conn reads
+// the notifications and calls the release callbacks of the sends only then,
+// so the buffers aren't reused while the kernel may still transmit them.
+package zerocopy
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMinSize is the default size from which sends are zero-copy.
+// Page pinning and the notifications cost more than copying smaller sends.
+const DefaultMinSize = 16 << 10
+
+// pollInterval is the interval between reads of the error queue
+// of connections with sends in flight.
+const pollInterval = 500 * time.Microsecond
+
+// ErrUnsupported is returned by New when the connection or the kernel
+// doesn't support MSG_ZEROCOPY.
+var ErrUnsupported = errors.New("MSG_ZEROCOPY is not supported")
+
+// Stats counts the sends of a Conn.
+type Stats struct {
+	// The number of sends copied because they are smaller than MinSize.
+	Copied uint64
+
+	// The number of zero-copy sends completed by the kernel.
+	Completed uint64
+
+	// The number of zero-copy sends the kernel fell back to copying,
+	// which is always the case on loopback.
+	KernelCopied uint64
+}
+
+func (s *Stats) snapshot() Stats {
+	return Stats{
+		Copied:       atomic.LoadUint64(&s.Copied),
+		Completed:    atomic.LoadUint64(&s.Completed),
+		KernelCopied: atomic.LoadUint64(&s.KernelCopied),
+	}
+}
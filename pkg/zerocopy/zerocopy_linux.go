@@ -0,0 +1,322 @@
+package zerocopy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Conn sends buffers to a TCP connection with MSG_ZEROCOPY.
+//
+// Writev must not be called concurrently. Reads and copying writes to the
+// connection are not affected.
+type Conn struct {
+	raw     syscall.RawConn
+	minSize int
+
+	mu sync.Mutex
+	// seq is the number of the next zero-copy sendmsg call, the kernel
+	// numbers the successful calls of the socket starting from 0.
+	seq     uint32
+	pending []send
+	polling bool
+	// dup is the duplicate of the socket Close reads the error queue
+	// with once the connection is closed, -1 until then.
+	dup int
+
+	stats Stats
+}
+
+// send is a zero-copy sendmsg call in flight.
+type send struct {
+	seq uint32
+	op  *op
+}
+
+// op is a Writev call, it takes as many sendmsg calls as the socket buffer
+// requires.
+type op struct {
+	refs    int
+	bufs    [][]byte
+	release func()
+}
+
+// New enables MSG_ZEROCOPY on the connection. Sends smaller than minSize are
+// copied, DefaultMinSize is used if minSize is zero.
+func New(conn syscall.Conn, minSize int) (*Conn, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	cerr := raw.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupported, err)
+	}
+	if minSize == 0 {
+		minSize = DefaultMinSize
+	}
+	return &Conn{raw: raw, minSize: minSize, dup: -1}, nil
+}
+
+// MinSize returns the size from which sends are zero-copy.
+func (c *Conn) MinSize() int {
+	return c.minSize
+}
+
+// Stats returns the snapshot of the stats.
+func (c *Conn) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// Writev writes all the buffers to the connection.
+//
+// release, if not nil, is called once the kernel doesn't reference the
+// buffers anymore: right away for the sends smaller than MinSize, otherwise
+// after the peer acknowledges them. The buffers must not be modified until
+// then.
+func (c *Conn) Writev(bufs [][]byte, release func()) error {
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
+	o := &op{refs: 1, bufs: bufs, release: release}
+	defer c.put(o)
+
+	zerocopy := size >= c.minSize
+	if !zerocopy {
+		atomic.AddUint64(&c.stats.Copied, 1)
+	}
+
+	iovec := append([][]byte(nil), bufs...)
+	var eno error
+	err := c.raw.Write(func(fd uintptr) bool {
+		for len(iovec) > 0 {
+			flags := 0
+			if zerocopy {
+				flags = unix.MSG_ZEROCOPY
+			}
+			n, err := unix.SendmsgBuffers(int(fd), iovec, nil, nil, flags)
+			switch err {
+			case nil:
+			case unix.EINTR:
+				continue
+			case unix.EAGAIN:
+				return false
+			case unix.ENOBUFS:
+				if zerocopy {
+					// The pinned pages exceed the socket's optmem limit,
+					// copy the rest.
+					zerocopy = false
+					continue
+				}
+				fallthrough
+			default:
+				eno = err
+				return true
+			}
+			if zerocopy && n > 0 {
+				c.track(o)
+			}
+			iovec = skip(iovec, n)
+		}
+		return true
+	})
+	if err == nil {
+		err = eno
+	}
+	return err
+}
+
+// skip drops the first n bytes of the iovec.
+func skip(iovec [][]byte, n int) [][]byte {
+	for n > 0 && len(iovec) > 0 {
+		if n < len(iovec[0]) {
+			iovec[0] = iovec[0][n:]
+			break
+		}
+		n -= len(iovec[0])
+		iovec = iovec[1:]
+	}
+	for len(iovec) > 0 && len(iovec[0]) == 0 {
+		iovec = iovec[1:]
+	}
+	return iovec
+}
+
+func (c *Conn) track(o *op) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o.refs++
+	c.pending = append(c.pending, send{seq: c.seq, op: o})
+	c.seq++
+	if !c.polling {
+		c.polling = true
+		go c.poll()
+	}
+}
+
+// put drops a reference of the op, releasing it with the last one.
+func (c *Conn) put(o *op) {
+	c.mu.Lock()
+	o.refs--
+	done := o.refs == 0
+	c.mu.Unlock()
+	if done && o.release != nil {
+		o.release()
+	}
+}
+
+func (c *Conn) poll() {
+	for {
+		time.Sleep(pollInterval)
+		readable := c.reap()
+
+		c.mu.Lock()
+		if len(c.pending) == 0 || !readable {
+			c.polling = false
+			if c.dup >= 0 {
+				unix.Close(c.dup)
+				c.dup = -1
+			}
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+}
+
+// reap reads the completion notifications from the error queue. It returns
+// false if the connection is closed without Close: the notifications are
+// lost then, and the sends in flight are never released, since the kernel
+// may still transmit their buffers.
+func (c *Conn) reap() bool {
+	var notes []unix.SockExtendedErr
+	c.mu.Lock()
+	dup := c.dup
+	c.mu.Unlock()
+	if dup >= 0 {
+		notes = readNotes(dup)
+	} else if cerr := c.raw.Control(func(fd uintptr) { notes = readNotes(int(fd)) }); cerr != nil {
+		return false
+	}
+	for _, note := range notes {
+		// The notification covers the calls numbered from Info to Data.
+		c.complete(note.Info, note.Data, note.Code&unix.SO_EE_CODE_ZEROCOPY_COPIED != 0)
+	}
+	return true
+}
+
+// readNotes reads the zero-copy notifications queued to the error queue
+// of the socket.
+func readNotes(fd int) []unix.SockExtendedErr {
+	var oob [256]byte
+	var notes []unix.SockExtendedErr
+	for {
+		_, oobn, _, _, err := unix.Recvmsg(fd, nil, oob[:], unix.MSG_ERRQUEUE|unix.MSG_DONTWAIT)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return notes
+		}
+		msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			return notes
+		}
+		for _, m := range msgs {
+			if !(m.Header.Level == unix.SOL_IP && m.Header.Type == unix.IP_RECVERR) &&
+				!(m.Header.Level == unix.SOL_IPV6 && m.Header.Type == unix.IPV6_RECVERR) {
+				continue
+			}
+			if len(m.Data) < int(unsafe.Sizeof(unix.SockExtendedErr{})) {
+				continue
+			}
+			note := *(*unix.SockExtendedErr)(unsafe.Pointer(&m.Data[0]))
+			if note.Origin == unix.SO_EE_ORIGIN_ZEROCOPY {
+				notes = append(notes, note)
+			}
+		}
+	}
+}
+
+func (c *Conn) complete(lo, hi uint32, copied bool) {
+	n := uint64(hi - lo + 1)
+	atomic.AddUint64(&c.stats.Completed, n)
+	if copied {
+		atomic.AddUint64(&c.stats.KernelCopied, n)
+	}
+
+	var done []*op
+	c.mu.Lock()
+	pending := c.pending[:0]
+	for _, s := range c.pending {
+		if s.seq-lo > hi-lo {
+			pending = append(pending, s)
+			continue
+		}
+		if s.op.refs--; s.op.refs == 0 {
+			done = append(done, s.op)
+		}
+	}
+	c.pending = pending
+	c.mu.Unlock()
+	for _, o := range done {
+		if o.release != nil {
+			o.release()
+		}
+	}
+}
+
+// Close hands the sends in flight over to a duplicate of the socket, which
+// keeps the error queue readable once the connection is closed, and returns.
+// The sends are released on completion only, the duplicate holds the socket
+// open until then: nothing tells when the kernel stops referencing the
+// buffers after the last descriptor of the socket is closed. It must be
+// called before closing the connection.
+func (c *Conn) Close() error {
+	if !c.reap() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) == 0 || c.dup >= 0 {
+		return nil
+	}
+	var dup int
+	var err error
+	cerr := c.raw.Control(func(fd uintptr) {
+		dup, err = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		// Wait for the completions rather than losing them.
+		for len(c.pending) > 0 {
+			c.mu.Unlock()
+			time.Sleep(pollInterval)
+			readable := c.reap()
+			c.mu.Lock()
+			if !readable {
+				break
+			}
+		}
+		return nil
+	}
+	c.dup = dup
+	if !c.polling {
+		c.polling = true
+		go c.poll()
+	}
+	return nil
+}
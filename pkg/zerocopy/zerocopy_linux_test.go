@@ -0,0 +1,108 @@
+package zerocopy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+func TestWritev(t *testing.T) {
+	a := assert.New(t)
+
+	client, server := tcpPair(t)
+	defer server.Close()
+	defer client.Close()
+	zc, err := New(client, 0)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer zc.Close()
+
+	head := []byte("head")
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	for _, bufs := range [][][]byte{{head}, {head, body}} {
+		size := 0
+		for _, b := range bufs {
+			size += len(b)
+		}
+		received := make(chan []byte, 1)
+		go func() {
+			b, _ := io.ReadAll(io.LimitReader(server, int64(size)))
+			received <- b
+		}()
+
+		released := make(chan struct{}, 2)
+		a.Nil(zc.Writev(bufs, func() { released <- struct{}{} }))
+		a.Equal(bytes.Join(bufs, nil), <-received)
+		select {
+		case <-released:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the buffers haven't been released")
+		}
+	}
+
+	time.Sleep(10 * pollInterval)
+	stats := zc.Stats()
+	a.Equal(uint64(1), stats.Copied)
+	a.NotZero(stats.Completed)
+}
+
+func TestCloseKeepsSendsInFlight(t *testing.T) {
+	a := assert.New(t)
+
+	client, server := tcpPair(t)
+	defer server.Close()
+	client.SetWriteBuffer(4 << 20)
+	zc, err := New(client, 0)
+	if err != nil {
+		client.Close()
+		t.Skip(err)
+	}
+
+	// The peer doesn't read, so most of the body stays in the send queue.
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	released := make(chan struct{}, 1)
+	a.Nil(zc.Writev([][]byte{body}, func() { released <- struct{}{} }))
+	a.Nil(zc.Close())
+	a.Nil(client.Close())
+	select {
+	case <-released:
+		t.Fatal("the buffers have been released before the peer got them")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	b, err := io.ReadAll(server)
+	a.Nil(err)
+	a.Equal(body, b)
+	select {
+	case <-released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the buffers haven't been released")
+	}
+}
@@ -0,0 +1,37 @@
+//go:build !linux
+// +build !linux
+
+package zerocopy
+
+import "syscall"
+
+// Conn sends buffers to a TCP connection with MSG_ZEROCOPY.
+type Conn struct {
+	minSize int
+	stats   Stats
+}
+
+// New returns ErrUnsupported, MSG_ZEROCOPY is linux-only.
+func New(conn syscall.Conn, minSize int) (*Conn, error) {
+	return nil, ErrUnsupported
+}
+
+// MinSize returns the size from which sends are zero-copy.
+func (c *Conn) MinSize() int {
+	return c.minSize
+}
+
+// Stats returns the snapshot of the stats.
+func (c *Conn) Stats() Stats {
+	return c.stats.snapshot()
+}
+
+// Writev is never called, New always fails.
+func (c *Conn) Writev(bufs [][]byte, release func()) error {
+	return ErrUnsupported
+}
+
+// Close is never called, New always fails.
+func (c *Conn) Close() error {
+	return nil
+}
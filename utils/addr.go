@@ -0,0 +1,95 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Schemes of the unix domain socket addresses accepted by the servers
+// and clients besides the TCP host:port.
+const (
+	// UnixScheme prefixes the path of a unix socket file: unix:///run/bench.sock.
+	UnixScheme = "unix://"
+
+	// UnixAbstractScheme prefixes the name of a unix socket in the Linux
+	// abstract namespace, which has no file: unix-abstract://bench.
+	UnixAbstractScheme = "unix-abstract://"
+)
+
+// IsUnixAddr reports whether addr is a unix or unix-abstract address.
+func IsUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixScheme) || strings.HasPrefix(addr, UnixAbstractScheme)
+}
+
+// ParseAddr returns the network and the address of addr for net.Dial
+// and net.Listen. Abstract names are prefixed with '@'.
+func ParseAddr(addr string) (network, address string) {
+	switch {
+	case strings.HasPrefix(addr, UnixScheme):
+		return "unix", strings.TrimPrefix(addr, UnixScheme)
+	case strings.HasPrefix(addr, UnixAbstractScheme):
+		return "unix", "@" + strings.TrimPrefix(addr, UnixAbstractScheme)
+	default:
+		return "tcp", addr
+	}
+}
+
+// ResolveLocalIP returns the unix address as is, otherwise the local IP,
+// see FindLocalIP.
+func ResolveLocalIP(ip, iname string) (string, error) {
+	if IsUnixAddr(ip) {
+		return ip, nil
+	}
+	return FindLocalIP(ip, iname)
+}
+
+// JoinHostPort returns the address of the port on the host,
+// or the host itself if it's a unix address.
+func JoinHostPort(host string, port int) string {
+	if IsUnixAddr(host) {
+		return host
+	}
+	return fmt.Sprintf("%s:%d", host, port)
+}
+
+// ListenPort listens to the unix address, or to the first free TCP port
+// of the host starting from *port.
+func ListenPort(host string, port *int) (net.Listener, error) {
+	if IsUnixAddr(host) {
+		return Listen(host)
+	}
+	for {
+		ln, err := net.Listen("tcp", JoinHostPort(host, *port))
+		if err == nil {
+			return ln, nil
+		}
+		*port++
+	}
+}
+
+// Listen listens to the address, see ParseAddr. The socket file left by
+// a previous run is removed.
+func Listen(addr string) (net.Listener, error) {
+	RemoveStaleSocket(addr)
+	return net.Listen(ParseAddr(addr))
+}
+
+// RemoveStaleSocket removes the socket file of the unix address,
+// so it can be listened to again.
+func RemoveStaleSocket(addr string) {
+	if !strings.HasPrefix(addr, UnixScheme) {
+		return
+	}
+	_, path := ParseAddr(addr)
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// Dial connects to the address with the dialer, see ParseAddr.
+func Dial(d *net.Dialer, addr string) (net.Conn, error) {
+	network, address := ParseAddr(addr)
+	return d.Dial(network, address)
+}
@@ -137,7 +137,8 @@ func PipeConn(r IsConn, size int) (IsPipe, error) {
 		var n int
 		n, loadError = pair.LoadFrom(fd, size-loaded)
 		if loadError != nil {
-			return loadError != syscall.EAGAIN && loadError != syscall.EINTR
+			// The splice errors are wrapped in os.SyscallError.
+			return !errors.Is(loadError, syscall.EAGAIN) && !errors.Is(loadError, syscall.EINTR)
 		}
 		loaded += n
 		return loaded == size
@@ -180,14 +181,19 @@ func alignSize(size int) int {
 	return (size-1)/pageSize*pageSize + pageSize
 }
 
+// SpliceSendFile sends size bytes of the file from its current offset.
 func SpliceSendFile(conn net.Conn, file *os.File, size int) error {
 	syscallConn, ok := conn.(syscall.Conn)
 	if !ok {
 		return errors.New("conn is not a syscall.Conn")
 	}
 	reader := &File{F: file}
+	offset, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Wrap(err, "file offset")
+	}
 
-	pipe, err := PipeFile(reader, int64(0), int(size))
+	pipe, err := PipeFile(reader, offset, int(size))
 	if err != nil {
 		// fail to load reader, fallback to normal copy
 		return errors.Wrap(err, "pipe file")
@@ -204,7 +210,8 @@ func SpliceSendFile(conn net.Conn, file *os.File, size int) error {
 		var n int
 		n, writeError = pipe.WriteTo(fd, int(uint64(size)-written))
 		if writeError != nil {
-			return writeError != syscall.EAGAIN && writeError != syscall.EINTR
+			// The splice errors are wrapped in os.SyscallError.
+			return !errors.Is(writeError, syscall.EAGAIN) && !errors.Is(writeError, syscall.EINTR)
 		}
 		written += uint64(n)
 		return written == uint64(size)
@@ -0,0 +1,39 @@
+package utils
+
+import "fmt"
+
+// ZeroCopySupport tells which zero-copy sends work on a kind of socket.
+// The nil errors mean the send works, otherwise the servers fall back
+// to copying.
+//
+// It's probed on a fresh pair of sockets, not on the listener of the
+// server: the sends may still fall back on the accepted connections,
+// such as the ones of other interfaces or of io_uring.
+type ZeroCopySupport struct {
+	// Probed is the pair of sockets probed.
+	Probed string
+
+	// Splice from a pipe, used for the bodies by iorpc and by
+	// SERVER_MODE=splice of tcpsendfile, perf and jnet.
+	Splice error
+
+	// Sendfile from a file, used by SERVER_MODE=sendfile of tcpsendfile
+	// and jnet.
+	Sendfile error
+
+	// MsgZeroCopy sends, used by SERVER_MODE=zerocopy of tcpsendfile
+	// and tcppool.
+	MsgZeroCopy error
+}
+
+func (s ZeroCopySupport) String() string {
+	return fmt.Sprintf("on %s, not the listener: splice: %s, sendfile: %s, MSG_ZEROCOPY: %s",
+		s.Probed, zeroCopyResult(s.Splice), zeroCopyResult(s.Sendfile), zeroCopyResult(s.MsgZeroCopy))
+}
+
+func zeroCopyResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return fmt.Sprintf("falls back to copy (%v)", err)
+}
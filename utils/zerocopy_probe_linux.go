@@ -0,0 +1,105 @@
+package utils
+
+import (
+	"net"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ProbeZeroCopy tries the zero-copy sends on a connected pair of sockets
+// of the kind of addr, see ParseAddr.
+func ProbeZeroCopy(addr string) ZeroCopySupport {
+	network, _ := ParseAddr(addr)
+	probed := "a loopback TCP pair"
+	if network == "unix" {
+		probed = "a unix socketpair"
+	}
+	fds, closeFds, err := socketPair(network)
+	if err != nil {
+		return ZeroCopySupport{Probed: probed, Splice: err, Sendfile: err, MsgZeroCopy: err}
+	}
+	defer closeFds()
+	fd := fds[0]
+
+	s := ZeroCopySupport{Probed: probed}
+	s.Splice = probeSplice(fd)
+	s.Sendfile = probeSendfile(fd)
+	s.MsgZeroCopy = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ZEROCOPY, 1)
+	return s
+}
+
+// socketPair returns the fds of a connected pair of stream sockets.
+func socketPair(network string) ([2]int, func(), error) {
+	if network == "unix" {
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			return fds, nil, err
+		}
+		return fds, func() {
+			unix.Close(fds[0])
+			unix.Close(fds[1])
+		}, nil
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return [2]int{}, nil, err
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return [2]int{}, nil, err
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		client.Close()
+		return [2]int{}, nil, err
+	}
+	// The files hold dups of the fds, the probes write a few bytes only.
+	cf, err := client.(*net.TCPConn).File()
+	if err == nil {
+		var sf *os.File
+		if sf, err = server.(*net.TCPConn).File(); err == nil {
+			client.Close()
+			server.Close()
+			return [2]int{int(cf.Fd()), int(sf.Fd())}, func() {
+				cf.Close()
+				sf.Close()
+			}, nil
+		}
+		cf.Close()
+	}
+	client.Close()
+	server.Close()
+	return [2]int{}, nil, err
+}
+
+func probeSplice(fd int) error {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		return err
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	if _, err := unix.Write(p[1], []byte("probe")); err != nil {
+		return err
+	}
+	_, err := unix.Splice(p[0], nil, fd, nil, 5, 0)
+	return err
+}
+
+func probeSendfile(fd int) error {
+	f, err := os.CreateTemp("", "zerocopy-probe")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.WriteString("probe"); err != nil {
+		return err
+	}
+	var off int64
+	_, err = unix.Sendfile(fd, int(f.Fd()), &off, 5)
+	return err
+}
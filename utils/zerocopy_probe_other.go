@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package utils
+
+import "errors"
+
+var errZeroCopyUnsupported = errors.New("not supported on this platform")
+
+// ProbeZeroCopy tries the zero-copy sends on a connected pair of sockets
+// of the kind of addr, see ParseAddr.
+func ProbeZeroCopy(addr string) ZeroCopySupport {
+	return ZeroCopySupport{
+		Probed:      "no sockets",
+		Splice:      errZeroCopyUnsupported,
+		Sendfile:    errZeroCopyUnsupported,
+		MsgZeroCopy: errZeroCopyUnsupported,
+	}
+}